@@ -1,26 +1,30 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"mime"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type App struct {
+	Config       *Config
 	DB           *sql.DB
 	SessionStore *SessionStore
+	LLM          LLMProvider // nil if no provider is configured; chat endpoints then fail
+	Blobs        BlobStore   // where uploaded images are kept
+	ImageURLs    *ImageURLSigner
+	SupabaseAuth *SupabaseAuth // verifies access tokens from Supabase or LocalAuth
+	LocalAuth    *LocalAuth    // nil unless AUTH_MODE=local
 }
 
 type User struct {
@@ -33,10 +37,15 @@ type User struct {
 type Plushie struct {
 	ID                  int64     `json:"id"`
 	UserID              string    `json:"-"` // Changed to string (UUID) for Supabase
+	HouseholdID         int64     `json:"household_id"`
 	Name                string    `json:"name"`
 	Kind                string    `json:"kind"`
 	AdoptedAt           string    `json:"adopted_at"` // ISO8601 (yyyy-mm-dd)
+	Notes               string    `json:"notes"`
+	Tags                []string  `json:"tags"`
 	ImageURL            string    `json:"image_url"`
+	MediumImageURL      string    `json:"medium_image_url"`
+	ThumbnailURL        string    `json:"thumbnail_url"`
 	ConversationHistory string    `json:"conversation_history"`
 	CreatedAt           time.Time `json:"created_at"`
 	ModifiedAt          time.Time `json:"modified_at"`
@@ -60,13 +69,8 @@ func (a *App) AuthMiddleware(next http.Handler) http.Handler {
 
 // HandleRegister creates a new user (email + password)
 func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
-	// Check user limit (default: 3, configurable via MAX_USERS env var)
-	maxUsers := DefaultMaxUsers
-	if maxUsersStr := os.Getenv("MAX_USERS"); maxUsersStr != "" {
-		if parsed, err := strconv.Atoi(maxUsersStr); err == nil && parsed > 0 {
-			maxUsers = parsed
-		}
-	}
+	// Check user limit (default: 3, configurable via MAX_USERS / max_users)
+	maxUsers := a.Config.MaxUsers
 
 	// Count existing users
 	var count int
@@ -101,7 +105,7 @@ func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	now := time.Now().UTC()
-	res, err := a.DB.Exec(`INSERT INTO users (email, password_hash, created_at) VALUES (?, ?, ?)`, req.Email, string(hashed), now)
+	res, err := a.DB.Exec(`INSERT INTO users (email, password_hash, supabase_user_id, created_at) VALUES (?, ?, ?, ?)`, req.Email, string(hashed), uuid.NewString(), now)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, "failed to create user (maybe email already used)")
 		return
@@ -137,13 +141,18 @@ func (a *App) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := uuid.NewString()
-	a.SessionStore.Set(token, id, time.Now().Add(7*24*time.Hour))
+	expiry := time.Now().Add(SessionLifetime)
+	token, err := a.SessionStore.Create(r.Context(), id, expiry, sessionMetadataFromRequest(r))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to create session")
+		return
+	}
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    token,
 		Path:     "/",
+		Expires:  expiry,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 		// Secure:   true, // enable in production with https
@@ -158,8 +167,16 @@ func (a *App) HandleLogin(w http.ResponseWriter, r *http.Request) {
 func (a *App) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	c, err := r.Cookie(sessionCookieName)
 	if err == nil {
-		a.SessionStore.Delete(c.Value)
+		if err := a.SessionStore.Delete(r.Context(), c.Value); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToRevokeSession)
+			return
+		}
 	}
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    "",
@@ -167,9 +184,72 @@ func (a *App) HandleLogout(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		MaxAge:   -1,
 	})
+}
+
+// SessionMiddleware requires a cookie session from /api/login and sets the user and session IDs in context
+func (a *App) SessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(sessionCookieName)
+		if err != nil || c.Value == "" {
+			respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+			return
+		}
+		sess, err := a.SessionStore.Lookup(r.Context(), c.Value)
+		if err != nil {
+			if !errors.Is(err, ErrSessionNotFound) {
+				log.Printf("API Error [session]: %v", err)
+			}
+			respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+			return
+		}
+		ctx := withSessionID(withUserID(r.Context(), sess.UserID), sess.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// HandleListSessions lists the signed-in user's active sessions (GET /api/sessions)
+func (a *App) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := a.SessionStore.List(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListSessions)
+		return
+	}
+	current := sessionIDFromContext(r.Context())
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	respondJSON(w, http.StatusOK, sessions)
+}
+
+// HandleRevokeSession signs out one of the user's sessions (DELETE /api/sessions/{sessionID})
+func (a *App) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "sessionID")
+	err := a.SessionStore.Revoke(r.Context(), userIDFromContext(r.Context()), id)
+	if errors.Is(err, ErrSessionNotFound) {
+		respondError(w, http.StatusNotFound, ErrSessionNotFoundMsg)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToRevokeSession)
+		return
+	}
+	if id == sessionIDFromContext(r.Context()) {
+		clearSessionCookie(w)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// HandleRevokeAllSessions signs the user out everywhere, including this session (DELETE /api/sessions)
+func (a *App) HandleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	n, err := a.SessionStore.RevokeAll(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToRevokeSession)
+		return
+	}
+	clearSessionCookie(w)
+	respondJSON(w, http.StatusOK, map[string]any{"revoked": n})
+}
+
 func (a *App) HandleMe(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromRequest(r)
 	if err != nil {
@@ -178,7 +258,7 @@ func (a *App) HandleMe(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user info from JWT token
-	email, err := getEmailFromJWT(r)
+	email, err := a.getEmailFromJWT(r)
 	if err == nil && email != "" {
 		// Ensure user exists in users table
 		if err := a.ensureUserExists(userID, email); err != nil {
@@ -198,38 +278,6 @@ func (a *App) HandleMe(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (a *App) HandleListPlushies(w http.ResponseWriter, r *http.Request) {
-	userID, err := getUserIDFromRequest(r)
-	if err != nil {
-		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
-		return
-	}
-
-	rows, err := a.DB.Query(`
-		SELECT id, user_id, name, kind, adopted_at, image_path, conversation_history, created_at, updated_at
-		FROM plushies
-		WHERE user_id = ?
-		ORDER BY created_at DESC
-	`, userID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, ErrFailedToListPlushies)
-		return
-	}
-	defer rows.Close()
-
-	var items []Plushie
-	for rows.Next() {
-		p, err := scanPlushieFromRow(rows)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
-			return
-		}
-		items = append(items, *p)
-	}
-
-	respondJSON(w, http.StatusOK, items)
-}
-
 func (a *App) HandleGetPlushie(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromRequest(r)
 	if err != nil {
@@ -243,15 +291,12 @@ func (a *App) HandleGetPlushie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var p Plushie
-	var adoptedAt sql.NullString
-	var imagePath sql.NullString
-	var conversationHistory sql.NullString
-	err = a.DB.QueryRow(`
-		SELECT id, user_id, name, kind, adopted_at, image_path, conversation_history, created_at, updated_at
+	var version int64
+	p, err := a.scanPlushieFromRow(scanWithVersion(a.DB.QueryRow(`
+		SELECT `+plushieColumns+`, version
 		FROM plushies
-		WHERE id = ? AND user_id = ?
-	`, id, userID).Scan(&p.ID, &p.UserID, &p.Name, &p.Kind, &adoptedAt, &imagePath, &conversationHistory, &p.CreatedAt, &p.ModifiedAt)
+		WHERE id = ? AND deleted_at IS NULL AND `+householdAccess("household_id", permView),
+		userID, id, userID).Scan, &version))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			respondError(w, http.StatusNotFound, ErrPlushieNotFound)
@@ -260,16 +305,16 @@ func (a *App) HandleGetPlushie(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if adoptedAt.Valid {
-		p.AdoptedAt = adoptedAt.String
-	}
-	if imagePath.Valid {
-		p.ImageURL = "/uploads/" + imagePath.String
-	}
-	if conversationHistory.Valid {
-		p.ConversationHistory = conversationHistory.String
-	}
 
+	// Clients revalidate with If-None-Match and get 304 while nothing changed
+	etag := a.plushieETag(version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Add("Vary", "Authorization, Cookie")
+	if ifNoneMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	respondJSON(w, http.StatusOK, p)
 }
 
@@ -292,7 +337,7 @@ func (a *App) HandleCreatePlushie(w http.ResponseWriter, r *http.Request) {
 		log.Printf("WARNING: Failed to ensure user exists: %v", err)
 	}
 
-	if err := r.ParseMultipartForm(MaxMultipartFormSize); err != nil {
+	if err := r.ParseMultipartForm(a.Config.MaxUploadSize); err != nil {
 		respondError(w, http.StatusBadRequest, ErrFailedToParseForm)
 		return
 	}
@@ -300,34 +345,80 @@ func (a *App) HandleCreatePlushie(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("name")
 	kind := r.FormValue("kind")
 	adoptedAt := r.FormValue("adopted_at")
+	notes := r.FormValue("notes")
 	if name == "" {
 		respondError(w, http.StatusBadRequest, ErrNameRequired)
 		return
 	}
+	householdID, err := parseHouseholdIDValue(r.FormValue("household_id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	imagePath, err := saveUploadedFile(r, "image")
+	img, err := a.saveUploadedFile(r, "image")
 	if err != nil && !errors.Is(err, ErrNoFile) {
-		respondError(w, http.StatusBadRequest, ErrFailedToSaveImage+": "+err.Error())
+		respondImageError(w, err)
 		return
 	}
+	if img == nil {
+		img = &savedImage{}
+	}
 
-	now := time.Now().UTC()
-	res, err := a.DB.Exec(`
-		INSERT INTO plushies (user_id, name, kind, adopted_at, image_path, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, userID, name, kind, nullIfEmpty(adoptedAt), nullIfEmpty(imagePath), now, now)
+	id, err := a.createPlushie(userID, householdID, name, kind, adoptedAt, notes, img)
 	if err != nil {
-		if strings.Contains(err.Error(), "FOREIGN KEY") {
+		a.discardSavedImage(img)
+		if errors.Is(err, errPermissionDenied) || err.Error() == ErrHouseholdNotFound {
+			respondAccessError(w, err)
+		} else if strings.Contains(err.Error(), "FOREIGN KEY") {
 			respondError(w, http.StatusBadRequest, ErrUserNotFound)
 		} else {
 			respondError(w, http.StatusInternalServerError, ErrFailedToCreatePlushie)
 		}
 		return
 	}
-	id, _ := res.LastInsertId()
 	respondJSON(w, http.StatusCreated, map[string]any{"id": id})
 }
 
+// createPlushie inserts a plushie with an optional first photo into a
+// household, or the user's personal household for 0
+func (a *App) createPlushie(userID string, householdID int64, name, kind, adoptedAt, notes string, img *savedImage) (int64, error) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	householdID, err = targetHousehold(tx, userID, householdID)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	res, err := tx.Exec(`
+		INSERT INTO plushies (user_id, household_id, name, kind, adopted_at, notes, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, householdID, name, kind, nullIfEmpty(adoptedAt), notes, now, now)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if img.Path != "" {
+		if _, err := insertPlushiePhoto(tx, id, img, "", "", now); err != nil {
+			return 0, err
+		}
+		if err := syncPlushieCover(tx, id, 0); err != nil {
+			return 0, err
+		}
+	}
+	if err := recordRevision(tx, id, userID, RevisionCreate, emptyPlushieSnapshot(), nil); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
 func (a *App) HandleUpdatePlushie(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromRequest(r)
 	if err != nil {
@@ -341,49 +432,78 @@ func (a *App) HandleUpdatePlushie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(MaxMultipartFormSize); err != nil {
+	// A JSON or empty body would otherwise read as a form with every field empty
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+	default:
+		respondError(w, http.StatusUnsupportedMediaType, ErrUnsupportedPutType)
+		return
+	}
+	if err := r.ParseMultipartForm(a.Config.MaxUploadSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
 		respondError(w, http.StatusBadRequest, ErrFailedToParseForm)
 		return
 	}
+	// Photos are added with POST /plushies/{id}/photos
+	if r.MultipartForm != nil && len(r.MultipartForm.File["image"]) > 0 {
+		respondError(w, http.StatusBadRequest, ErrPhotoUploadMoved)
+		return
+	}
 
+	// PUT replaces every field; omitted ones become empty
 	name := r.FormValue("name")
 	kind := r.FormValue("kind")
 	adoptedAt := r.FormValue("adopted_at")
+	notes := r.FormValue("notes")
+	if msg := checkPlushieName(name); msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if msg := checkAdoptedAt(adoptedAt); msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
 
-	// Check ownership and get existing image
-	var existingImage sql.NullString
-	err = a.DB.QueryRow(`SELECT image_path FROM plushies WHERE id = ? AND user_id = ?`, id, userID).Scan(&existingImage)
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tx, err := a.DB.Begin()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			respondError(w, http.StatusNotFound, ErrPlushieNotFound)
-		} else {
-			respondError(w, http.StatusInternalServerError, ErrFailedToGetPlushie)
-		}
+		respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePlushie)
 		return
 	}
+	defer tx.Rollback()
 
-	imagePath := ""
-	filePath, err := saveUploadedFile(r, "image")
-	if err != nil && !errors.Is(err, ErrNoFile) {
-		respondError(w, http.StatusBadRequest, ErrFailedToSaveImage)
+	if err := checkPlushieIfMatch(tx, r, id); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePlushie)
+		}
 		return
 	}
-	if filePath != "" {
-		imagePath = filePath
-	} else if existingImage.Valid {
-		imagePath = existingImage.String
+	before, err := loadPlushieSnapshot(tx, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePlushie)
+		return
 	}
 
-	_, err = a.DB.Exec(`
+	_, err = tx.Exec(`
 		UPDATE plushies
-		SET name = ?, kind = ?, adopted_at = ?, image_path = ?, updated_at = ?
-		WHERE id = ? AND user_id = ?
-	`, name, kind, nullIfEmpty(adoptedAt), nullIfEmpty(imagePath), time.Now().UTC(), id, userID)
+		SET name = ?, kind = ?, adopted_at = ?, notes = ?, updated_at = ?
+		WHERE id = ? AND deleted_at IS NULL AND `+householdAccess("household_id", permEdit), name, kind, nullIfEmpty(adoptedAt), notes, time.Now().UTC(), id, userID)
+	if err == nil {
+		err = recordRevision(tx, id, userID, RevisionUpdate, before, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePlushie)
 		return
 	}
 
+	a.setPlushieETag(w, id)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -400,7 +520,29 @@ func (a *App) HandleDeletePlushie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := a.DB.Exec(`DELETE FROM plushies WHERE id = ? AND user_id = ?`, id, userID)
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePlushie)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkPlushieIfMatch(tx, r, id); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToDeletePlushie)
+		}
+		return
+	}
+	// Deleted plushies go to the trash (see trash.go)
+	res, err := tx.Exec(`
+		UPDATE plushies SET deleted_at = ?
+		WHERE id = ? AND deleted_at IS NULL AND `+householdAccess("household_id", permEdit), time.Now().UTC(), id, userID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePlushie)
 		return
@@ -410,10 +552,16 @@ func (a *App) HandleDeletePlushie(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusNotFound, ErrPlushieNotFound)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePlushie)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// HandleUpdateConversation replaces the whole conversation with a free-text history.
+// Deprecated: use the per-message endpoints in conversation.go instead.
 func (a *App) HandleUpdateConversation(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromRequest(r)
 	if err != nil {
@@ -435,153 +583,24 @@ func (a *App) HandleUpdateConversation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check ownership
-	if err := a.checkPlushieOwnership(id, userID); err != nil {
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+	if err := a.replaceConversation(r, id, userID, req.ConversationHistory); err != nil {
 		if err.Error() == ErrPlushieNotFound {
 			respondError(w, http.StatusNotFound, err.Error())
+		} else if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
 		} else {
-			respondError(w, http.StatusInternalServerError, err.Error())
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdateConv)
 		}
 		return
 	}
 
-	_, err = a.DB.Exec(`
-		UPDATE plushies
-		SET conversation_history = ?, updated_at = ?
-		WHERE id = ? AND user_id = ?
-	`, req.ConversationHistory, time.Now().UTC(), id, userID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, ErrFailedToUpdateConv)
-		return
-	}
-
+	a.setPlushieETag(w, id)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (a *App) HandleChat(w http.ResponseWriter, r *http.Request) {
-	userID, err := getUserIDFromRequest(r)
-	if err != nil {
-		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
-		return
-	}
-
-	id, err := parsePlushieID(r)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
-		return
-	}
-
-	// Get plushie details
-	var name, kind string
-	var conversationHistory sql.NullString
-	err = a.DB.QueryRow(`
-		SELECT name, kind, conversation_history
-		FROM plushies
-		WHERE id = ? AND user_id = ?
-	`, id, userID).Scan(&name, &kind, &conversationHistory)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			respondError(w, http.StatusNotFound, ErrPlushieNotFound)
-		} else {
-			respondError(w, http.StatusInternalServerError, ErrFailedToGetPlushie)
-		}
-		return
-	}
-
-	// Call OpenAI API
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		respondError(w, http.StatusInternalServerError, ErrOpenAIKeyNotSet)
-		return
-	}
-
-	history := ""
-	if conversationHistory.Valid {
-		history = conversationHistory.String
-	}
-
-	prompt := buildChatPrompt(name, kind, history)
-	message, err := callOpenAI(apiKey, prompt)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, ErrFailedToChat+": "+err.Error())
-		return
-	}
-
-	respondJSON(w, http.StatusOK, map[string]string{"message": message})
-}
-
-func buildChatPrompt(name, kind, history string) string {
-	prompt := fmt.Sprintf("あなたは「%s」という名前の%sのぬいぐるみです。", name, kind)
-	if history != "" {
-		prompt += fmt.Sprintf("\n\n過去の会話履歴:\n%s\n\n", history)
-	}
-	prompt += "このぬいぐるみのキャラクターとして、短い一言（1〜2文程度）を話してください。親しみやすく、温かみのある言葉を選んでください。"
-	return prompt
-}
-
-func callOpenAI(apiKey, prompt string) (string, error) {
-	type Message struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	}
-	type Request struct {
-		Model     string    `json:"model"`
-		Messages  []Message `json:"messages"`
-		MaxTokens int       `json:"max_tokens"`
-	}
-
-	reqBody := Request{
-		Model: "gpt-4o-mini",
-		Messages: []Message{
-			{Role: "user", Content: prompt},
-		},
-		MaxTokens: 100,
-	}
-
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to call OpenAI API: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("OpenAI API error: %d - %s", resp.StatusCode, string(body))
-	}
-
-	type Choice struct {
-		Message Message `json:"message"`
-	}
-	type Response struct {
-		Choices []Choice `json:"choices"`
-	}
-
-	var apiResp Response
-	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	if len(apiResp.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
-	}
-
-	return apiResp.Choices[0].Message.Content, nil
-}
-
 func nullIfEmpty(s string) any {
 	if s == "" {
 		return nil
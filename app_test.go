@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpdatePlushieReplacesFormFields(t *testing.T) {
+	ta := newTestApp(t)
+	id := ta.createPlushie(t, ownerUser, 0, "くま")
+	path := plushiePath(id)
+	mustStatus(t, ta.request(t, ownerUser, "PATCH", path, `{"kind": "くま", "adopted_at": "2024-03-05", "notes": "メモ"}`,
+		"Content-Type", "application/merge-patch+json"), http.StatusOK, nil)
+
+	var image bytes.Buffer
+	mw := multipart.NewWriter(&image)
+	mw.WriteField("name", "くま")
+	fw, _ := mw.CreateFormFile("image", "kuma.png")
+	fw.Write([]byte("not really a png"))
+	mw.Close()
+
+	tests := []struct {
+		name string
+		w    *httptest.ResponseRecorder
+		want int
+	}{
+		{"JSON body", ta.request(t, ownerUser, "PUT", path, map[string]string{"name": "かえた"}), http.StatusUnsupportedMediaType},
+		{"empty body", ta.request(t, ownerUser, "PUT", path, nil), http.StatusUnsupportedMediaType},
+		{"no name", ta.form(t, ownerUser, "PUT", path, map[string]string{"kind": "うさぎ"}), http.StatusBadRequest},
+		{"blank name", ta.form(t, ownerUser, "PUT", path, map[string]string{"name": "  "}), http.StatusBadRequest},
+		{"bad adopted_at", ta.form(t, ownerUser, "PUT", path, map[string]string{"name": "かえた", "adopted_at": "2024/3/5"}), http.StatusBadRequest},
+		{"image", ta.request(t, ownerUser, "PUT", path, image.String(), "Content-Type", mw.FormDataContentType()), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mustStatus(t, tt.w, tt.want, nil)
+		})
+	}
+
+	var p Plushie
+	mustStatus(t, ta.request(t, ownerUser, "GET", path, nil), http.StatusOK, &p)
+	if p.Name != "くま" || p.Kind != "くま" || p.Notes != "メモ" || p.AdoptedAt != "2024-03-05" {
+		t.Fatalf("plushie changed by rejected PUTs: %+v", p)
+	}
+
+	// Omitted fields are cleared
+	mustStatus(t, ta.form(t, ownerUser, "PUT", path, map[string]string{"name": "かえた"}), http.StatusNoContent, nil)
+	mustStatus(t, ta.request(t, ownerUser, "GET", path, nil), http.StatusOK, &p)
+	if p.Name != "かえた" || p.Kind != "" || p.Notes != "" || p.AdoptedAt != "" {
+		t.Errorf("after PUT with only a name: %+v", p)
+	}
+}
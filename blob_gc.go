@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Image cleanup settings
+const (
+	BlobDeletionInterval  = time.Minute
+	BlobDeletionBatchSize = 100
+	BlobDeletionMaxTries  = 10
+	// Blobs younger than this are never garbage collected: an upload is stored
+	// before the row that references it is written.
+	BlobGCMinAge = time.Hour
+)
+
+// referencedBlobKeysQuery lists every blob key still referenced by the database.
+// Anything that stores a blob key must be included here, or its blobs will be
+// treated as orphans by the queue and by -gc-images.
+const referencedBlobKeysQuery = `
+	SELECT image_path FROM plushies WHERE image_path IS NOT NULL
+	UNION SELECT image_medium_path FROM plushies WHERE image_medium_path IS NOT NULL
+	UNION SELECT image_thumb_path FROM plushies WHERE image_thumb_path IS NOT NULL
+	UNION SELECT image_path FROM plushie_photos
+	UNION SELECT image_medium_path FROM plushie_photos WHERE image_medium_path IS NOT NULL
+	UNION SELECT image_thumb_path FROM plushie_photos WHERE image_thumb_path IS NOT NULL
+	UNION SELECT cover_image_path FROM collections WHERE cover_image_path IS NOT NULL
+	UNION SELECT cover_image_medium_path FROM collections WHERE cover_image_medium_path IS NOT NULL
+	UNION SELECT cover_image_thumb_path FROM collections WHERE cover_image_thumb_path IS NOT NULL`
+
+// BlobLister is implemented by stores that can enumerate their blobs, which -gc-images needs
+type BlobLister interface {
+	// List calls fn for every blob in the store
+	List(ctx context.Context, fn func(key string, size int64, modTime time.Time) error) error
+}
+
+func blobReferenced(ctx context.Context, db *sql.DB, key string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (`+referencedBlobKeysQuery+`) WHERE image_path = ?`, key).Scan(&n)
+	return n > 0, err
+}
+
+// discardSavedImage removes the blobs of an upload whose database write failed
+func (a *App) discardSavedImage(img *savedImage) {
+	if img == nil {
+		return
+	}
+	for _, key := range []string{img.Path, img.MediumPath, img.ThumbPath} {
+		if key == "" {
+			continue
+		}
+		if err := a.Blobs.Delete(context.Background(), key); err != nil {
+			log.Printf("Warning: failed to remove unused image %s: %v", key, err)
+		}
+	}
+}
+
+// drainBlobDeletions deletes the blobs queued in blob_deletions.
+// Failed deletions stay queued and are retried up to BlobDeletionMaxTries times.
+func (a *App) drainBlobDeletions(ctx context.Context) error {
+	rows, err := a.DB.QueryContext(ctx, `
+		SELECT key FROM blob_deletions
+		WHERE attempts < ?
+		ORDER BY queued_at
+		LIMIT ?
+	`, BlobDeletionMaxTries, BlobDeletionBatchSize)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// Never delete a key that has been referenced again since it was queued
+		referenced, err := blobReferenced(ctx, a.DB, key)
+		if err != nil {
+			return err
+		}
+		if !referenced {
+			if err := a.Blobs.Delete(ctx, key); err != nil {
+				log.Printf("Warning: failed to delete image %s: %v", key, err)
+				if _, err := a.DB.ExecContext(ctx, `UPDATE blob_deletions SET attempts = attempts + 1, last_error = ? WHERE key = ?`, err.Error(), key); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if _, err := a.DB.ExecContext(ctx, `DELETE FROM blob_deletions WHERE key = ?`, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupImagesAsync drains the deletion queue in the background after a request
+// has committed, so deleting from a remote store doesn't delay the response
+func (a *App) cleanupImagesAsync() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), BlobDeletionInterval)
+		defer cancel()
+		if err := a.drainBlobDeletions(ctx); err != nil {
+			log.Printf("Warning: image cleanup failed: %v", err)
+		}
+	}()
+}
+
+// RunBlobDeletionWorker drains the deletion queue every interval until ctx is cancelled.
+// It picks up deletions that failed or were interrupted by a restart.
+func (a *App) RunBlobDeletionWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.drainBlobDeletions(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: image cleanup failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// blobGCReport summarises a garbage collection run
+type blobGCReport struct {
+	Scanned      int
+	Orphaned     int
+	OrphanedSize int64
+	Deleted      int
+	Skipped      int // orphans younger than BlobGCMinAge
+}
+
+// gcBlobs finds blobs that no database row references and, if del is set,
+// deletes them. Every orphan is reported on w.
+func gcBlobs(ctx context.Context, db *sql.DB, blobs BlobStore, del bool, w io.Writer) (*blobGCReport, error) {
+	lister, ok := blobs.(BlobLister)
+	if !ok {
+		return nil, errors.New("the configured storage backend cannot list its blobs")
+	}
+
+	referenced := map[string]bool{}
+	rows, err := db.QueryContext(ctx, referencedBlobKeysQuery)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		referenced[key] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &blobGCReport{}
+	cutoff := time.Now().Add(-BlobGCMinAge)
+	var orphans []string
+	err = lister.List(ctx, func(key string, size int64, modTime time.Time) error {
+		report.Scanned++
+		if referenced[key] {
+			return nil
+		}
+		if modTime.After(cutoff) {
+			report.Skipped++
+			fmt.Fprintf(w, "skip    %s (uploaded %s ago)\n", key, time.Since(modTime).Round(time.Second))
+			return nil
+		}
+		report.Orphaned++
+		report.OrphanedSize += size
+		orphans = append(orphans, key)
+		fmt.Fprintf(w, "orphan  %s (%d bytes)\n", key, size)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !del {
+		return report, nil
+	}
+	for _, key := range orphans {
+		// Re-check: the key may have been referenced since the listing started
+		if ok, err := blobReferenced(ctx, db, key); err != nil {
+			return report, err
+		} else if ok {
+			continue
+		}
+		if err := blobs.Delete(ctx, key); err != nil {
+			return report, err
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM blob_deletions WHERE key = ?`, key); err != nil {
+			return report, err
+		}
+		report.Deleted++
+		fmt.Fprintf(w, "deleted %s\n", key)
+	}
+	return report, nil
+}
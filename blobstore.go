@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// BlobStore stores uploaded images under flat keys such as "<uuid>_thumb.jpg".
+// The key is what ends up in plushies.image_path and in /uploads/<key> URLs,
+// so switching backends does not change any stored path or client URL.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get opens a blob for reading. It returns ErrBlobNotFound if the key does not exist.
+	Get(ctx context.Context, key string) (*Blob, error)
+	// Delete removes a blob. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// BlobPresigner is implemented by stores that can hand out time-limited URLs
+// so clients download directly from the backend instead of through this server.
+type BlobPresigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// Blob is an open blob. Body is an io.ReadSeeker for the local store, which
+// lets the serving route honour Range and If-Modified-Since requests.
+type Blob struct {
+	Body        io.ReadCloser
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Supported values for STORAGE_BACKEND
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+const DefaultPresignTTL = 15 * time.Minute
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// blobKeyPattern matches the keys saveUploadedFile generates. Anything else is
+// rejected before it reaches a backend, which rules out path traversal.
+var blobKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func validBlobKey(key string) bool {
+	return len(key) <= 200 && blobKeyPattern.MatchString(key)
+}
+
+// StorageConfig selects where uploaded images are kept; see Config for how it is loaded
+type StorageConfig struct {
+	Backend string   `yaml:"backend"` // local or s3
+	S3      S3Config `yaml:"s3"`
+}
+
+// S3Config configures the S3-compatible backend (AWS S3, MinIO, Cloudflare R2, ...)
+type S3Config struct {
+	Endpoint        string        `yaml:"endpoint"` // e.g. https://s3.ap-northeast-1.amazonaws.com or http://localhost:9000
+	Region          string        `yaml:"region"`
+	Bucket          string        `yaml:"bucket"`
+	AccessKeyID     string        `yaml:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key"`
+	PathStyle       bool          `yaml:"path_style"`    // http://endpoint/bucket/key instead of http://bucket.endpoint/key (MinIO needs this)
+	PresignReads    bool          `yaml:"presign_reads"` // redirect image requests to presigned URLs instead of proxying them
+	PresignTTL      time.Duration `yaml:"presign_ttl"`   // lifetime of presigned URLs
+}
+
+// NewBlobStore builds the store described by cfg. uploadsDir is used by the local backend.
+func NewBlobStore(cfg StorageConfig, uploadsDir string) (BlobStore, error) {
+	switch cfg.Backend {
+	case StorageBackendLocal:
+		return NewLocalBlobStore(uploadsDir)
+	case StorageBackendS3:
+		return NewS3BlobStore(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// contentTypeForKey guesses a blob's MIME type from its extension
+func contentTypeForKey(key string) string {
+	if ct := mime.TypeByExtension(filepath.Ext(key)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// LocalBlobStore keeps blobs as files in a single directory
+type LocalBlobStore struct {
+	Dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create uploads dir: %w", err)
+	}
+	return &LocalBlobStore{Dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, key), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial image
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, bytes.NewReader(data)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (*Blob, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, ErrBlobNotFound
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrBlobNotFound
+	}
+	return &Blob{
+		Body:        f,
+		Size:        info.Size(),
+		ContentType: contentTypeForKey(key),
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) List(ctx context.Context, fn func(key string, size int64, modTime time.Time) error) error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// Skips directories and in-progress temporary files
+		if !e.Type().IsRegular() || !validBlobKey(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if err := fn(e.Name(), info.Size(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// serveBlob writes an open blob as the response body. Blobs that can seek are
+// served with http.ServeContent, which handles Range and conditional requests.
+func serveBlob(w http.ResponseWriter, r *http.Request, key string, blob *Blob) {
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if rs, ok := blob.Body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, blob.ModTime, rs)
+		return
+	}
+	if blob.Size >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(blob.Size))
+	}
+	if !blob.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", blob.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.Copy(w, blob.Body)
+}
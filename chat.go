@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Number of previous user/assistant turns sent to the model with each chat request
+const ChatHistoryTurns = 20
+
+// ChatMessage is a single message in an LLM chat request
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatPlushie holds what the chat handler needs to know about a plushie
+type chatPlushie struct {
+	ID     int64
+	UserID string
+	Name   string
+	Kind   string
+}
+
+// chatRequest is the body accepted by POST /api/plushies/{id}/chat.
+// An empty message asks the plushie to say something on its own.
+type chatRequest struct {
+	Message string `json:"message"`
+	Speaker string `json:"speaker"`
+}
+
+// decodeChatRequest reads an optional JSON body; an empty body is allowed
+func decodeChatRequest(r *http.Request) (chatRequest, error) {
+	var req chatRequest
+	if r.Body == nil {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return req, err
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	return req, nil
+}
+
+// loadChatPlushie fetches the plushie for a chat request, checking that the
+// user may edit it, since the turn is saved
+func (a *App) loadChatPlushie(plushieID int64, userID string) (*chatPlushie, error) {
+	if err := a.checkPlushieAccess(plushieID, userID, permEdit, false); err != nil {
+		return nil, err
+	}
+	p := chatPlushie{ID: plushieID, UserID: userID}
+	err := a.DB.QueryRow(`SELECT name, kind FROM plushies WHERE id = ? AND deleted_at IS NULL`, plushieID).Scan(&p.Name, &p.Kind)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New(ErrPlushieNotFound)
+		}
+		return nil, errors.New(ErrFailedToGetPlushie)
+	}
+	return &p, nil
+}
+
+// buildChatMessages assembles the model input: a system prompt describing the
+// character (including any system notes), the most recent turns, and finally
+// the new user message or a request for an unprompted remark.
+func (a *App) buildChatMessages(p *chatPlushie, userMessage string) ([]ChatMessage, error) {
+	var notes []string
+	rows, err := a.DB.Query(`
+		SELECT content FROM conversation_messages
+		WHERE plushie_id = ? AND role = ?
+		ORDER BY id
+	`, p.ID, RoleSystem)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		notes = append(notes, content)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = a.DB.Query(`
+		SELECT role, content FROM conversation_messages
+		WHERE plushie_id = ? AND role != ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, p.ID, RoleSystem, ChatHistoryTurns)
+	if err != nil {
+		return nil, err
+	}
+	var turns []ChatMessage
+	for rows.Next() {
+		var m ChatMessage
+		if err := rows.Scan(&m.Role, &m.Content); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		turns = append(turns, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messages := []ChatMessage{{Role: RoleSystem, Content: buildChatPrompt(p.Name, p.Kind, notes)}}
+	for i := len(turns) - 1; i >= 0; i-- {
+		messages = append(messages, turns[i])
+	}
+	if userMessage != "" {
+		messages = append(messages, ChatMessage{Role: RoleUser, Content: userMessage})
+	} else {
+		messages = append(messages, ChatMessage{Role: RoleUser, Content: "（何か一言話しかけてください）"})
+	}
+	return messages, nil
+}
+
+// saveChatTurn stores the user's message (if any) and the plushie's reply in
+// one transaction. It returns errPreconditionFailed if the plushie changed
+// since the If-Match version while the reply was generated.
+func (a *App) saveChatTurn(r *http.Request, p *chatPlushie, req chatRequest, reply string) ([]ConversationMessage, error) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := checkPlushieIfMatch(tx, r, p.ID); err != nil {
+		return nil, err
+	}
+	before, err := loadPlushieSnapshot(tx, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	var msgs []ConversationMessage
+	if req.Message != "" {
+		msgs = append(msgs, ConversationMessage{Speaker: req.Speaker, Role: RoleUser, Content: req.Message, Timestamp: now})
+	}
+	msgs = append(msgs, ConversationMessage{Speaker: p.Name, Role: RoleAssistant, Content: reply, Timestamp: now})
+
+	if err := insertConversationMessages(tx, p.ID, msgs); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, now, p.ID); err != nil {
+		return nil, err
+	}
+	if err := recordRevision(tx, p.ID, p.UserID, RevisionChat, before, nil); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// HandleChat sends the user's message together with the previous turns to the
+// model and stores both the user's turn and the plushie's reply.
+func (a *App) HandleChat(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req, err := decodeChatRequest(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	p, err := a.loadChatPlushie(id, userID)
+	if !respondAccessError(w, err) {
+		return
+	}
+
+	if a.LLM == nil {
+		respondError(w, http.StatusInternalServerError, ErrLLMNotConfigured)
+		return
+	}
+	// Don't generate a reply that can't be saved
+	if !plushieIfMatchOrError(w, a.DB, r, id, ErrFailedToChat) {
+		return
+	}
+
+	messages, err := a.buildChatMessages(p, req.Message)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListMessages)
+		return
+	}
+
+	reply, err := a.LLM.Chat(r.Context(), messages)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToChat+": "+err.Error())
+		return
+	}
+
+	saved, err := a.saveChatTurn(r, p, req, reply)
+	if err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		}
+		return
+	}
+	a.setPlushieETag(w, id)
+
+	resp := map[string]any{
+		"message": reply,
+		"reply":   saved[len(saved)-1],
+	}
+	if len(saved) > 1 {
+		resp["user_message"] = saved[0]
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+func buildChatPrompt(name, kind string, notes []string) string {
+	prompt := fmt.Sprintf("あなたは「%s」という名前の%sのぬいぐるみです。", name, kind)
+	if len(notes) > 0 {
+		prompt += fmt.Sprintf("\n\nあなたについてのメモ:\n%s\n\n", strings.Join(notes, "\n"))
+	}
+	prompt += "このぬいぐるみのキャラクターとして、短い返事（1〜2文程度）をしてください。親しみやすく、温かみのある言葉を選んでください。"
+	return prompt
+}
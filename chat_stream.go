@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sseErrorWriteTimeout is how long the final "error" event may take to send
+// once the route deadline has passed
+const sseErrorWriteTimeout = 5 * time.Second
+
+// sseWriter writes Server-Sent Events and flushes after each one
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering (nginx, Render)
+	w.WriteHeader(http.StatusOK)
+	return &sseWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (s *sseWriter) Event(event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// HandleChatStream is the streaming variant of HandleChat.
+// It relays the reply as "delta" events while the model generates it, then
+// persists both turns and sends a final "done" event with the stored message IDs.
+// If the client disconnects, the upstream request is cancelled and nothing is saved.
+// If ChatStreamTimeout runs out first, an "error" event is sent before closing.
+func (a *App) HandleChatStream(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req, err := decodeChatRequest(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	p, err := a.loadChatPlushie(id, userID)
+	if !respondAccessError(w, err) {
+		return
+	}
+
+	if a.LLM == nil {
+		respondError(w, http.StatusInternalServerError, ErrLLMNotConfigured)
+		return
+	}
+	// Answered with 412 before the stream starts; a change during generation
+	// is reported by an "error" event
+	if !plushieIfMatchOrError(w, a.DB, r, id, ErrFailedToChat) {
+		return
+	}
+
+	messages, err := a.buildChatMessages(p, req.Message)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListMessages)
+		return
+	}
+
+	// The request context is cancelled when the client goes away or the
+	// route deadline passes
+	ctx := r.Context()
+	sse := newSSEWriter(w)
+
+	reply, err := a.LLM.ChatStream(ctx, messages, func(delta string) error {
+		return sse.Event("delta", map[string]string{"content": delta})
+	})
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("Chat stream for plushie %d timed out", id)
+			// routeTimeout set the write deadline to the same instant
+			_ = sse.rc.SetWriteDeadline(time.Now().Add(sseErrorWriteTimeout))
+			_ = sse.Event("error", map[string]string{"error": ErrChatTimedOut})
+			return
+		}
+		if ctx.Err() != nil {
+			log.Printf("Chat stream for plushie %d cancelled by client", id)
+			return
+		}
+		log.Printf("API Error [stream]: %s: %v", ErrFailedToChat, err)
+		_ = sse.Event("error", map[string]string{"error": ErrFailedToChat + ": " + err.Error()})
+		return
+	}
+
+	saved, err := a.saveChatTurn(r, p, req, reply)
+	if errors.Is(err, errPreconditionFailed) {
+		_ = sse.Event("error", map[string]string{"error": ErrPlushieModified})
+		return
+	}
+	if err != nil {
+		log.Printf("API Error [stream]: %s: %v", ErrFailedToSaveMessage, err)
+		_ = sse.Event("error", map[string]string{"error": ErrFailedToSaveMessage})
+		return
+	}
+
+	done := map[string]any{
+		"message":    reply,
+		"message_id": saved[len(saved)-1].ID,
+	}
+	if len(saved) > 1 {
+		done["user_message_id"] = saved[0].ID
+	}
+	_ = sse.Event("done", done)
+}
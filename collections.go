@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Collection is a named, ordered group of plushies. Collections are personal
+// like tags: they can hold plushies of any of the owner's households, but other
+// members never see them, and plushies the owner can no longer see are left out.
+type Collection struct {
+	ID                  int64     `json:"id"`
+	Name                string    `json:"name"`
+	Description         string    `json:"description"`
+	CoverImageURL       string    `json:"cover_image_url"`
+	CoverMediumImageURL string    `json:"cover_medium_image_url"`
+	CoverThumbnailURL   string    `json:"cover_thumbnail_url"`
+	PlushieCount        int       `json:"plushie_count"` // not counting plushies in the trash
+	CreatedAt           time.Time `json:"created_at"`
+	ModifiedAt          time.Time `json:"modified_at"`
+}
+
+// collectionDetail is a collection with its plushies in collection order.
+// conversation_history is left empty to keep the response small.
+type collectionDetail struct {
+	Collection
+	Plushies []Plushie `json:"plushies"`
+}
+
+var collectionColumns = `id, name, description, cover_image_path, cover_image_medium_path, cover_image_thumb_path,
+	(SELECT COUNT(*) FROM collection_plushies cp JOIN plushies p ON p.id = cp.plushie_id
+		WHERE cp.collection_id = collections.id AND p.deleted_at IS NULL
+			AND ` + householdAccessOf("p.household_id", "collections.user_id", permView) + `), created_at, updated_at`
+
+// scanCollection scans a collection selected with collectionColumns and fills in signed cover URLs
+func (a *App) scanCollection(scan func(dest ...any) error) (*Collection, error) {
+	var c Collection
+	var coverPath, mediumPath, thumbPath sql.NullString
+	err := scan(&c.ID, &c.Name, &c.Description, &coverPath, &mediumPath, &thumbPath,
+		&c.PlushieCount, &c.CreatedAt, &c.ModifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	if coverPath.Valid {
+		c.CoverImageURL = a.imageURL(coverPath.String)
+		c.CoverMediumImageURL = c.CoverImageURL
+		c.CoverThumbnailURL = c.CoverImageURL
+	}
+	if mediumPath.Valid {
+		c.CoverMediumImageURL = a.imageURL(mediumPath.String)
+	}
+	if thumbPath.Valid {
+		c.CoverThumbnailURL = a.imageURL(thumbPath.String)
+	}
+	return &c, nil
+}
+
+// getCollectionDetail loads a collection of the user with its plushies
+func (a *App) getCollectionDetail(r *http.Request, id int64, userID string) (*collectionDetail, error) {
+	c, err := a.scanCollection(a.DB.QueryRowContext(r.Context(),
+		`SELECT `+collectionColumns+` FROM collections WHERE id = ? AND user_id = ?`, id, userID).Scan)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := strings.Replace(plushieColumns, conversationHistoryExpr, "NULL", 1)
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT `+columns+`
+		FROM plushies
+		JOIN collection_plushies cp ON cp.plushie_id = plushies.id
+		WHERE cp.collection_id = ? AND plushies.deleted_at IS NULL AND `+householdAccess("plushies.household_id", permView)+`
+		ORDER BY cp.position, cp.added_at
+	`, userID, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	d := &collectionDetail{Collection: *c, Plushies: []Plushie{}}
+	for rows.Next() {
+		p, err := a.scanPlushieFromRow(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		d.Plushies = append(d.Plushies, *p)
+	}
+	return d, rows.Err()
+}
+
+// respondCollectionDetail answers with a collection, or 404 if the user has no such collection
+func (a *App) respondCollectionDetail(w http.ResponseWriter, r *http.Request, status int, id int64, userID string) {
+	d, err := a.getCollectionDetail(r, id, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondError(w, http.StatusNotFound, ErrCollectionNotFound)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToGetCollection)
+		}
+		return
+	}
+	respondJSON(w, status, d)
+}
+
+// ownedCollectionOrError checks that the collection belongs to the user and
+// writes the matching error response. It returns false if the request has
+// already been answered.
+func (a *App) ownedCollectionOrError(w http.ResponseWriter, r *http.Request, id int64, userID string) bool {
+	var exists int
+	err := a.DB.QueryRowContext(r.Context(),
+		`SELECT 1 FROM collections WHERE id = ? AND user_id = ?`, id, userID).Scan(&exists)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondError(w, http.StatusNotFound, ErrCollectionNotFound)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToGetCollection)
+		}
+		return false
+	}
+	return true
+}
+
+// HandleListCollections lists the user's collections by name, without their plushies
+func (a *App) HandleListCollections(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(),
+		`SELECT `+collectionColumns+` FROM collections WHERE user_id = ? ORDER BY name COLLATE NOCASE`, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListCollections)
+		return
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		c, err := a.scanCollection(rows.Scan)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		collections = append(collections, *c)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	respondJSON(w, http.StatusOK, collections)
+}
+
+// HandleGetCollection returns a collection with its plushies in order
+func (a *App) HandleGetCollection(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parseURLInt64(r, "collectionID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.respondCollectionDetail(w, r, http.StatusOK, id, userID)
+}
+
+// HandleCreateCollection creates an empty collection from a multipart form with
+// name, description and an optional cover image
+func (a *App) HandleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	if err := r.ParseMultipartForm(a.Config.MaxUploadSize); err != nil {
+		respondError(w, http.StatusBadRequest, ErrFailedToParseForm)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	description := r.FormValue("description")
+	if name == "" {
+		respondError(w, http.StatusBadRequest, ErrNameRequired)
+		return
+	}
+
+	if err := a.ensureUserExistsFromRequest(r, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+		return
+	}
+
+	img, err := a.saveUploadedFile(r, "cover")
+	if err != nil && !errors.Is(err, ErrNoFile) {
+		respondImageError(w, err)
+		return
+	}
+	if img == nil {
+		img = &savedImage{}
+	}
+
+	now := time.Now().UTC()
+	res, err := a.DB.ExecContext(r.Context(), `
+		INSERT INTO collections (user_id, name, description, cover_image_path, cover_image_medium_path, cover_image_thumb_path, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, name, description,
+		nullIfEmpty(img.Path), nullIfEmpty(img.MediumPath), nullIfEmpty(img.ThumbPath), now, now)
+	if err != nil {
+		a.discardSavedImage(img)
+		if isUniqueConstraintError(err) {
+			respondError(w, http.StatusConflict, ErrCollectionAlreadyExists)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+		}
+		return
+	}
+	id, _ := res.LastInsertId()
+	a.respondCollectionDetail(w, r, http.StatusCreated, id, userID)
+}
+
+// HandleUpdateCollection updates a collection from a multipart form. name is
+// required; description is kept when absent. A new cover replaces the old one
+// and remove_cover=true removes it.
+func (a *App) HandleUpdateCollection(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parseURLInt64(r, "collectionID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := r.ParseMultipartForm(a.Config.MaxUploadSize); err != nil {
+		respondError(w, http.StatusBadRequest, ErrFailedToParseForm)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		respondError(w, http.StatusBadRequest, ErrNameRequired)
+		return
+	}
+	var description any
+	if _, ok := r.MultipartForm.Value["description"]; ok {
+		description = r.FormValue("description")
+	}
+	removeCover := r.FormValue("remove_cover") == "true"
+
+	// Check ownership before storing any upload
+	if !a.ownedCollectionOrError(w, r, id, userID) {
+		return
+	}
+
+	img, err := a.saveUploadedFile(r, "cover")
+	if err != nil && !errors.Is(err, ErrNoFile) {
+		respondImageError(w, err)
+		return
+	}
+	if img == nil {
+		img = &savedImage{}
+	}
+
+	// Without a new upload the cover is kept (COALESCE with NULL) unless removed
+	cover := `cover_image_path = COALESCE(?, cover_image_path),
+		cover_image_medium_path = COALESCE(?, cover_image_medium_path),
+		cover_image_thumb_path = COALESCE(?, cover_image_thumb_path)`
+	if removeCover && img.Path == "" {
+		cover = `cover_image_path = ?, cover_image_medium_path = ?, cover_image_thumb_path = ?`
+	}
+	_, err = a.DB.ExecContext(r.Context(), `
+		UPDATE collections
+		SET name = ?, description = COALESCE(?, description), `+cover+`, updated_at = ?
+		WHERE id = ? AND user_id = ?
+	`, name, description,
+		nullIfEmpty(img.Path), nullIfEmpty(img.MediumPath), nullIfEmpty(img.ThumbPath),
+		time.Now().UTC(), id, userID)
+	if err != nil {
+		a.discardSavedImage(img)
+		if isUniqueConstraintError(err) {
+			respondError(w, http.StatusConflict, ErrCollectionAlreadyExists)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+		}
+		return
+	}
+	if img.Path != "" || removeCover {
+		// The replaced cover was queued for deletion by a trigger
+		a.cleanupImagesAsync()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDeleteCollection deletes a collection. Its plushies are not affected.
+func (a *App) HandleDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parseURLInt64(r, "collectionID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res, err := a.DB.ExecContext(r.Context(), `DELETE FROM collections WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteCollection)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrCollectionNotFound)
+		return
+	}
+	// The cover was queued for deletion by a trigger
+	a.cleanupImagesAsync()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type collectionPlushiesRequest struct {
+	PlushieIDs []int64 `json:"plushie_ids"`
+}
+
+// decodeCollectionPlushies reads the plushie IDs of a membership request, dropping
+// repeats, and checks that they are all the user's. It returns false if the
+// request has already been answered.
+func (a *App) decodeCollectionPlushies(w http.ResponseWriter, r *http.Request, userID string) ([]int64, bool) {
+	var req collectionPlushiesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return nil, false
+	}
+	var ids []int64
+	seen := map[int64]bool{}
+	for _, id := range req.PlushieIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ids, true
+	}
+
+	args := []any{userID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	var n int
+	err := a.DB.QueryRowContext(r.Context(), `
+		SELECT COUNT(*) FROM plushies
+		WHERE `+householdAccess("household_id", permView)+` AND deleted_at IS NULL AND id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)
+	`, args...).Scan(&n)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToGetPlushie)
+		return nil, false
+	}
+	if n != len(ids) {
+		respondError(w, http.StatusNotFound, ErrPlushieNotFound)
+		return nil, false
+	}
+	return ids, true
+}
+
+// HandleSetCollectionPlushies replaces the plushies of a collection with
+// {"plushie_ids": [...]}, in that order
+func (a *App) HandleSetCollectionPlushies(w http.ResponseWriter, r *http.Request) {
+	a.changeCollectionPlushies(w, r, true)
+}
+
+// HandleAddCollectionPlushies appends {"plushie_ids": [...]} to a collection.
+// Plushies already in it keep their position.
+func (a *App) HandleAddCollectionPlushies(w http.ResponseWriter, r *http.Request) {
+	a.changeCollectionPlushies(w, r, false)
+}
+
+func (a *App) changeCollectionPlushies(w http.ResponseWriter, r *http.Request, replace bool) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parseURLInt64(r, "collectionID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	plushieIDs, ok := a.decodeCollectionPlushies(w, r, userID)
+	if !ok {
+		return
+	}
+	if !a.ownedCollectionOrError(w, r, id, userID) {
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM collection_plushies WHERE collection_id = ?`, id); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+			return
+		}
+	}
+	for _, plushieID := range plushieIDs {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO collection_plushies (collection_id, plushie_id, position, added_at)
+			VALUES (?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM collection_plushies WHERE collection_id = ?), ?)
+		`, id, plushieID, id, now)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+			return
+		}
+	}
+	if _, err := tx.Exec(`UPDATE collections SET updated_at = ? WHERE id = ?`, now, id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+		return
+	}
+
+	a.respondCollectionDetail(w, r, http.StatusOK, id, userID)
+}
+
+// HandleRemoveCollectionPlushie takes a plushie out of a collection
+func (a *App) HandleRemoveCollectionPlushie(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parseURLInt64(r, "collectionID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	plushieID, err := parseURLInt64(r, "plushieID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.ownedCollectionOrError(w, r, id, userID) {
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(),
+		`DELETE FROM collection_plushies WHERE collection_id = ? AND plushie_id = ?`, id, plushieID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveCollection)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrPlushieNotFound)
+		return
+	}
+	_, _ = a.DB.ExecContext(r.Context(), `UPDATE collections SET updated_at = ? WHERE id = ?`, time.Now().UTC(), id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all runtime settings. Values are resolved in this order, later
+// sources overriding earlier ones: built-in defaults, the YAML config file,
+// environment variables, command-line flags.
+type Config struct {
+	Addr          string        `yaml:"addr"`
+	DBPath        string        `yaml:"db_path"`
+	UploadsDir    string        `yaml:"uploads_dir"`
+	ReadTimeout   time.Duration `yaml:"read_timeout"`
+	WriteTimeout  time.Duration `yaml:"write_timeout"`
+	MaxUploadSize int64         `yaml:"max_upload_size"`
+	MaxImportSize int64         `yaml:"max_import_size"` // ZIP archives sent to /api/import
+	CORSOrigins   []string      `yaml:"cors_origins"`
+	MaxUsers      int           `yaml:"max_users"`
+
+	// AuthMode selects who issues access tokens: a Supabase project or the
+	// built-in identity provider configured by LocalAuth
+	AuthMode  string          `yaml:"auth_mode"`
+	LocalAuth LocalAuthConfig `yaml:"local_auth"`
+
+	// Supabase access tokens are verified with the HMAC secret (legacy projects)
+	// and/or the project's JWKS. Setting SupabaseURL fills in the JWKS URL and issuer.
+	SupabaseURL         string `yaml:"supabase_url"`
+	SupabaseJWTSecret   string `yaml:"supabase_jwt_secret"`
+	SupabaseJWKSURL     string `yaml:"supabase_jwks_url"`
+	SupabaseJWKSFile    string `yaml:"supabase_jwks_file"`
+	SupabaseJWTIssuer   string `yaml:"supabase_jwt_issuer"`
+	SupabaseJWTAudience string `yaml:"supabase_jwt_audience"`
+
+	// ImageURLSecret signs image URLs; if empty a random secret is used and
+	// image URLs stop working when the server restarts
+	ImageURLSecret string        `yaml:"image_url_secret"`
+	ImageURLTTL    time.Duration `yaml:"image_url_ttl"`
+
+	// TrashRetention is how long deleted plushies stay in the trash before
+	// they are purged; 0 keeps them until the user empties the trash
+	TrashRetention time.Duration `yaml:"trash_retention"`
+
+	LLM     LLMConfig     `yaml:"llm"`
+	Storage StorageConfig `yaml:"storage"`
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:          DefaultPort,
+		DBPath:        DefaultDBPath,
+		UploadsDir:    DefaultUploadsDir,
+		ReadTimeout:   DefaultReadTimeout,
+		WriteTimeout:  DefaultWriteTimeout,
+		MaxUploadSize: DefaultMaxUploadSize,
+		MaxImportSize: DefaultMaxImportSize,
+		CORSOrigins:   []string{"http://localhost:5173", "http://127.0.0.1:5173"},
+		MaxUsers:      DefaultMaxUsers,
+		ImageURLTTL:   DefaultImageURLTTL,
+
+		TrashRetention: DefaultTrashRetention,
+
+		AuthMode: AuthModeSupabase,
+		LocalAuth: LocalAuthConfig{
+			AccessTokenTTL:  DefaultAccessTokenTTL,
+			RefreshTokenTTL: DefaultRefreshTokenTTL,
+		},
+		SupabaseJWTAudience: DefaultSupabaseJWTAudience,
+
+		LLM: LLMConfig{
+			Provider:  LLMProviderOpenAI,
+			MaxTokens: DefaultLLMMaxTokens,
+		},
+		Storage: StorageConfig{
+			Backend: StorageBackendLocal,
+			S3: S3Config{
+				PresignTTL: DefaultPresignTTL,
+			},
+		},
+	}
+}
+
+// CLIOptions are command-line switches that are not part of Config itself
+type CLIOptions struct {
+	ConfigFile  string
+	PrintConfig bool
+	MigrateTo   int
+	GCImages    bool
+	GCDelete    bool
+}
+
+// LoadConfig resolves the configuration from defaults, an optional YAML file,
+// environment variables and command-line flags, then validates it.
+func LoadConfig(args []string) (*Config, *CLIOptions, error) {
+	cfg := DefaultConfig()
+	opts := &CLIOptions{}
+
+	fs := flag.NewFlagSet("poppo", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigFile, "config", os.Getenv("CONFIG_FILE"), "path to a YAML config file (env CONFIG_FILE)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	fs.IntVar(&opts.MigrateTo, "migrate-to", -1, "migrate the database schema to the given version (applying or reverting migrations) and exit")
+	fs.BoolVar(&opts.GCImages, "gc-images", false, "report stored images that no plushie references and exit")
+	fs.BoolVar(&opts.GCDelete, "gc-delete", false, "with -gc-images, delete the unreferenced images")
+	addr := fs.String("addr", "", "listen address, e.g. :8080 (env PORT)")
+	dbPath := fs.String("db", "", "SQLite database path (env DB_PATH)")
+	uploadsDir := fs.String("uploads-dir", "", "directory for uploaded images (env UPLOADS_DIR)")
+	corsOrigins := fs.String("cors-origins", "", "comma-separated allowed CORS origins (env CORS_ORIGINS)")
+	llmProvider := fs.String("llm-provider", "", "LLM provider: openai, openai-compatible, anthropic or fake (env LLM_PROVIDER)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.ConfigFile != "" {
+		if err := cfg.loadFile(opts.ConfigFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	if *addr != "" {
+		cfg.Addr = *addr
+	}
+	if *dbPath != "" {
+		cfg.DBPath = *dbPath
+	}
+	if *uploadsDir != "" {
+		cfg.UploadsDir = *uploadsDir
+	}
+	if *corsOrigins != "" {
+		cfg.CORSOrigins = splitList(*corsOrigins)
+	}
+	if *llmProvider != "" {
+		cfg.LLM.Provider = *llmProvider
+	}
+
+	cfg.LLM.Provider = strings.ToLower(strings.TrimSpace(cfg.LLM.Provider))
+	if cfg.SupabaseURL != "" {
+		base := strings.TrimRight(cfg.SupabaseURL, "/") + "/auth/v1"
+		if cfg.SupabaseJWKSURL == "" && cfg.SupabaseJWKSFile == "" {
+			cfg.SupabaseJWKSURL = base + "/.well-known/jwks.json"
+		}
+		if cfg.SupabaseJWTIssuer == "" {
+			cfg.SupabaseJWTIssuer = base
+		}
+	}
+	cfg.AuthMode = strings.ToLower(strings.TrimSpace(cfg.AuthMode))
+	cfg.Storage.Backend = strings.ToLower(strings.TrimSpace(cfg.Storage.Backend))
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, opts, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv applies environment variable overrides:
+//
+//	PORT, DB_PATH, UPLOADS_DIR, READ_TIMEOUT, WRITE_TIMEOUT, MAX_UPLOAD_SIZE, MAX_IMPORT_SIZE,
+//	CORS_ORIGINS, MAX_USERS, IMAGE_URL_SECRET, IMAGE_URL_TTL, TRASH_RETENTION,
+//	AUTH_MODE, LOCAL_AUTH_JWT_SECRET, LOCAL_AUTH_ACCESS_TOKEN_TTL, LOCAL_AUTH_REFRESH_TOKEN_TTL,
+//	LOCAL_AUTH_LOG_RESET_CODES,
+//	SUPABASE_URL, SUPABASE_JWT_SECRET, SUPABASE_JWKS_URL, SUPABASE_JWKS_FILE,
+//	SUPABASE_JWT_ISSUER, SUPABASE_JWT_AUDIENCE,
+//	LLM_PROVIDER, LLM_BASE_URL, LLM_API_KEY, LLM_MODEL, LLM_MAX_TOKENS,
+//	STORAGE_BACKEND, S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY_ID,
+//	S3_SECRET_ACCESS_KEY, S3_PATH_STYLE, S3_PRESIGN_READS, S3_PRESIGN_TTL
+//
+// LLM_API_KEY falls back to OPENAI_API_KEY or ANTHROPIC_API_KEY depending on the provider.
+func (c *Config) loadEnv() error {
+	if v := os.Getenv("PORT"); v != "" {
+		// Hosting platforms such as Render set PORT to a bare number
+		if !strings.Contains(v, ":") {
+			v = ":" + v
+		}
+		c.Addr = v
+	}
+	setString(&c.DBPath, "DB_PATH")
+	setString(&c.UploadsDir, "UPLOADS_DIR")
+	if v := os.Getenv("CORS_ORIGINS"); v != "" {
+		c.CORSOrigins = splitList(v)
+	}
+	setString(&c.AuthMode, "AUTH_MODE")
+	setString(&c.LocalAuth.JWTSecret, "LOCAL_AUTH_JWT_SECRET")
+	setString(&c.SupabaseURL, "SUPABASE_URL")
+	setString(&c.SupabaseJWTSecret, "SUPABASE_JWT_SECRET")
+	setString(&c.SupabaseJWKSURL, "SUPABASE_JWKS_URL")
+	setString(&c.SupabaseJWKSFile, "SUPABASE_JWKS_FILE")
+	setString(&c.SupabaseJWTIssuer, "SUPABASE_JWT_ISSUER")
+	setString(&c.SupabaseJWTAudience, "SUPABASE_JWT_AUDIENCE")
+	setString(&c.ImageURLSecret, "IMAGE_URL_SECRET")
+	setString(&c.LLM.Provider, "LLM_PROVIDER")
+	setString(&c.LLM.BaseURL, "LLM_BASE_URL")
+	setString(&c.LLM.APIKey, "LLM_API_KEY")
+	setString(&c.LLM.Model, "LLM_MODEL")
+	setString(&c.Storage.Backend, "STORAGE_BACKEND")
+	setString(&c.Storage.S3.Endpoint, "S3_ENDPOINT")
+	setString(&c.Storage.S3.Region, "S3_REGION")
+	setString(&c.Storage.S3.Bucket, "S3_BUCKET")
+	setString(&c.Storage.S3.AccessKeyID, "S3_ACCESS_KEY_ID")
+	setString(&c.Storage.S3.SecretAccessKey, "S3_SECRET_ACCESS_KEY")
+	if err := setBool(&c.LocalAuth.LogResetCodes, "LOCAL_AUTH_LOG_RESET_CODES"); err != nil {
+		return err
+	}
+	if err := setBool(&c.Storage.S3.PathStyle, "S3_PATH_STYLE"); err != nil {
+		return err
+	}
+	if err := setBool(&c.Storage.S3.PresignReads, "S3_PRESIGN_READS"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.Storage.S3.PresignTTL, "S3_PRESIGN_TTL"); err != nil {
+		return err
+	}
+
+	if err := setDuration(&c.ReadTimeout, "READ_TIMEOUT"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.WriteTimeout, "WRITE_TIMEOUT"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.ImageURLTTL, "IMAGE_URL_TTL"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.TrashRetention, "TRASH_RETENTION"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.LocalAuth.AccessTokenTTL, "LOCAL_AUTH_ACCESS_TOKEN_TTL"); err != nil {
+		return err
+	}
+	if err := setDuration(&c.LocalAuth.RefreshTokenTTL, "LOCAL_AUTH_REFRESH_TOKEN_TTL"); err != nil {
+		return err
+	}
+	if v := os.Getenv("MAX_UPLOAD_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_UPLOAD_SIZE %q: %w", v, err)
+		}
+		c.MaxUploadSize = n
+	}
+	if v := os.Getenv("MAX_IMPORT_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_IMPORT_SIZE %q: %w", v, err)
+		}
+		c.MaxImportSize = n
+	}
+	if err := setInt(&c.MaxUsers, "MAX_USERS"); err != nil {
+		return err
+	}
+	if err := setInt(&c.LLM.MaxTokens, "LLM_MAX_TOKENS"); err != nil {
+		return err
+	}
+
+	if c.LLM.APIKey == "" {
+		switch strings.ToLower(c.LLM.Provider) {
+		case LLMProviderOpenAI, LLMProviderOpenAICompatible:
+			c.LLM.APIKey = os.Getenv("OPENAI_API_KEY")
+		case LLMProviderAnthropic:
+			c.LLM.APIKey = os.Getenv("ANTHROPIC_API_KEY")
+		}
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting
+func (c *Config) Validate() error {
+	switch {
+	case c.Addr == "":
+		return errors.New("config: addr must not be empty")
+	case c.DBPath == "":
+		return errors.New("config: db_path must not be empty")
+	case c.UploadsDir == "":
+		return errors.New("config: uploads_dir must not be empty")
+	case c.ReadTimeout <= 0:
+		return errors.New("config: read_timeout must be positive")
+	case c.WriteTimeout <= 0:
+		return errors.New("config: write_timeout must be positive")
+	case c.MaxUploadSize <= 0:
+		return errors.New("config: max_upload_size must be positive")
+	case c.MaxImportSize <= 0:
+		return errors.New("config: max_import_size must be positive")
+	case c.MaxUsers <= 0:
+		return errors.New("config: max_users must be positive")
+	case c.ImageURLTTL < time.Second:
+		return errors.New("config: image_url_ttl must be at least 1s")
+	case c.TrashRetention < 0:
+		return errors.New("config: trash_retention must not be negative")
+	case c.LLM.MaxTokens <= 0:
+		return errors.New("config: llm.max_tokens must be positive")
+	}
+	switch c.AuthMode {
+	case AuthModeSupabase:
+	case AuthModeLocal:
+		if len(c.LocalAuth.JWTSecret) < MinLocalAuthSecretLength {
+			return fmt.Errorf("config: local_auth.jwt_secret must be at least %d bytes with auth_mode local", MinLocalAuthSecretLength)
+		}
+		if c.LocalAuth.AccessTokenTTL < time.Minute {
+			return errors.New("config: local_auth.access_token_ttl must be at least 1m")
+		}
+		if c.LocalAuth.RefreshTokenTTL < c.LocalAuth.AccessTokenTTL {
+			return errors.New("config: local_auth.refresh_token_ttl must not be shorter than local_auth.access_token_ttl")
+		}
+	default:
+		return fmt.Errorf("config: unknown auth_mode %q", c.AuthMode)
+	}
+	if c.SupabaseJWKSURL != "" && c.SupabaseJWKSFile != "" {
+		return errors.New("config: set only one of supabase_jwks_url and supabase_jwks_file")
+	}
+	if (c.SupabaseJWKSURL != "" || c.SupabaseJWKSFile != "") && c.SupabaseJWTIssuer == "" {
+		// Without it, any token signed by a key in the set would be accepted
+		return errors.New("config: supabase_jwt_issuer (or supabase_url) is required with supabase_jwks_url or supabase_jwks_file")
+	}
+	for _, u := range []string{c.SupabaseURL, c.SupabaseJWKSURL} {
+		if u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return fmt.Errorf("config: invalid Supabase URL %q", u)
+		}
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("config: invalid CORS origin %q", origin)
+		}
+	}
+	switch c.LLM.Provider {
+	case LLMProviderOpenAI, LLMProviderOpenAICompatible, LLMProviderAnthropic, LLMProviderFake:
+	default:
+		return fmt.Errorf("config: unknown llm.provider %q", c.LLM.Provider)
+	}
+	switch c.Storage.Backend {
+	case StorageBackendLocal:
+	case StorageBackendS3:
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return errors.New("config: storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+		}
+		if c.Storage.S3.PresignTTL <= 0 || c.Storage.S3.PresignTTL > s3MaxPresignTTL {
+			return fmt.Errorf("config: storage.s3.presign_ttl must be between 1s and %s", s3MaxPresignTTL)
+		}
+	default:
+		return fmt.Errorf("config: unknown storage.backend %q", c.Storage.Backend)
+	}
+	return nil
+}
+
+// Print writes the effective configuration as YAML with secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	redacted.SupabaseJWTSecret = redact(c.SupabaseJWTSecret)
+	redacted.ImageURLSecret = redact(c.ImageURLSecret)
+	redacted.LocalAuth.JWTSecret = redact(c.LocalAuth.JWTSecret)
+	redacted.LLM.APIKey = redact(c.LLM.APIKey)
+	redacted.Storage.S3.SecretAccessKey = redact(c.Storage.S3.SecretAccessKey)
+
+	// Marshal through a node so durations print as "15s" instead of nanoseconds
+	var node yaml.Node
+	if err := node.Encode(redacted); err != nil {
+		return err
+	}
+	formatDurations(&node)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(&node)
+}
+
+func formatDurations(n *yaml.Node) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Kind != yaml.MappingNode {
+			break
+		}
+		key, val := n.Content[i], n.Content[i+1]
+		if (strings.HasSuffix(key.Value, "_timeout") || strings.HasSuffix(key.Value, "_ttl")) && val.Kind == yaml.ScalarNode {
+			if ns, err := strconv.ParseInt(val.Value, 10, 64); err == nil {
+				val.Value = time.Duration(ns).String()
+				val.Tag = "!!str"
+			}
+		}
+	}
+	for _, child := range n.Content {
+		formatDurations(child)
+	}
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "********"
+}
+
+func setString(dst *string, env string) {
+	if v := os.Getenv(env); v != "" {
+		*dst = v
+	}
+}
+
+func setInt(dst *int, env string) error {
+	v := os.Getenv(env)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", env, v, err)
+	}
+	*dst = n
+	return nil
+}
+
+func setBool(dst *bool, env string) error {
+	v := os.Getenv(env)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", env, v, err)
+	}
+	*dst = b
+	return nil
+}
+
+func setDuration(dst *time.Duration, env string) error {
+	v := os.Getenv(env)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", env, v, err)
+	}
+	*dst = d
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
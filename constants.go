@@ -16,24 +16,155 @@ const (
 	ErrFailedToChat          = "チャットの生成に失敗しました"
 	ErrFailedToParseForm     = "フォームデータの解析に失敗しました"
 	ErrFailedToSaveImage     = "画像の保存に失敗しました"
+	ErrFailedToLoadImage      = "画像の読み込みに失敗しました"
+	ErrImageURLExpired        = "画像のURLの有効期限が切れています。ページを再読み込みしてください。"
+	ErrUnsupportedImageFormat = "対応していない画像形式です (JPEG, PNG, GIF, WebP のみ)"
 	ErrNameRequired           = "名前は必須です"
 	ErrUserNotFound           = "ユーザー情報が見つかりません。再度ログインしてください。"
 	ErrDataReadFailed         = "データの読み込みに失敗しました"
-	ErrServerConfigError      = "サーバー設定エラー: SUPABASE_JWT_SECRETが設定されていません"
+	ErrServerConfigError      = "サーバー設定エラー: SUPABASE_JWT_SECRET または SUPABASE_JWKS_URL が設定されていません"
 	ErrTokenExpired           = "トークンの有効期限が切れています。再度ログインしてください。"
 	ErrTokenNotFound          = "認証トークンが見つかりません。ログインしてください。"
 	ErrAuthFailed             = "認証に失敗しました"
-	ErrOpenAIKeyNotSet        = "OPENAI_API_KEY not configured"
+	ErrLLMNotConfigured       = "LLM provider not configured (set LLM_PROVIDER / OPENAI_API_KEY)"
+	ErrChatTimedOut           = "応答の生成に時間がかかりすぎたため中断しました"
+	ErrMessageNotFound        = "メッセージが見つかりませんでした"
+	ErrMessageContentRequired = "メッセージの内容は必須です"
+	ErrInvalidMessageRole     = "無効なロールです (user, assistant, system のいずれかを指定してください)"
+	ErrInvalidPagination      = "ページ指定が無効です"
+	ErrInvalidSort            = "並び順の指定が無効です (name, kind, adopted_at, updated_at, created_at のいずれかを指定してください)"
+	ErrInvalidFilter          = "絞り込み条件が無効です (日付は YYYY-MM-DD 形式で指定してください)"
+	ErrInvalidFields          = "fields に指定できない項目が含まれています"
+	ErrSearchQueryRequired    = "検索キーワードを入力してください"
+	ErrSearchQueryTooLong     = "検索キーワードが長すぎます"
+	ErrFailedToSearch         = "検索に失敗しました"
+	ErrFailedToListMessages   = "会話メッセージの取得に失敗しました"
+	ErrFailedToSaveMessage    = "会話メッセージの保存に失敗しました"
+	ErrFailedToDeleteMessage  = "会話メッセージの削除に失敗しました"
+	ErrEmailPasswordRequired  = "メールアドレスとパスワードは必須です"
+	ErrInvalidEmail           = "メールアドレスの形式が正しくありません"
+	ErrPasswordTooShort       = "パスワードは8文字以上にしてください"
+	ErrEmailAlreadyRegistered = "このメールアドレスは既に登録されています"
+	ErrMaxUsersReached        = "登録できるユーザー数の上限 (%d人) に達しています"
+	ErrFailedToSignUp         = "ユーザー登録に失敗しました"
+	ErrInvalidCredentials     = "メールアドレスまたはパスワードが正しくありません"
+	ErrUnsupportedGrantType   = "対応していない grant_type です"
+	ErrInvalidRefreshToken    = "セッションの有効期限が切れています。再度ログインしてください。"
+	ErrFailedToUpdatePassword = "パスワードの変更に失敗しました"
+	ErrInvalidLogoutScope     = "scope には global, local, others のいずれかを指定してください"
+	ErrFailedToLogout         = "ログアウトに失敗しました"
+	ErrInvalidResetToken      = "パスワード再設定コードが無効か、有効期限が切れています"
+	ErrSessionNotFoundMsg     = "セッションが見つかりませんでした"
+	ErrFailedToListSessions   = "セッション一覧の取得に失敗しました"
+	ErrFailedToRevokeSession  = "ログアウトに失敗しました"
+
+	// Tags and collections
+	ErrTagNotFound              = "タグが見つかりませんでした"
+	ErrTagNameRequired          = "タグ名は必須です"
+	ErrTagNameTooLong           = "タグ名は50文字以内にしてください"
+	ErrTagAlreadyExists         = "同じ名前のタグが既にあります"
+	ErrTooManyTags              = "タグは1つのぬいぐるみにつき20個までです"
+	ErrFailedToListTags         = "タグ一覧の取得に失敗しました"
+	ErrFailedToSaveTag          = "タグの保存に失敗しました"
+	ErrFailedToDeleteTag        = "タグの削除に失敗しました"
+	ErrCollectionNotFound       = "コレクションが見つかりませんでした"
+	ErrCollectionAlreadyExists  = "同じ名前のコレクションが既にあります"
+	ErrFailedToListCollections  = "コレクション一覧の取得に失敗しました"
+	ErrFailedToGetCollection    = "コレクション情報の取得に失敗しました"
+	ErrFailedToSaveCollection   = "コレクションの保存に失敗しました"
+	ErrFailedToDeleteCollection = "コレクションの削除に失敗しました"
+
+	// Photo gallery
+	ErrPhotoNotFound       = "写真が見つかりませんでした"
+	ErrPhotoRequired       = "写真を選択してください"
+	ErrPhotoCaptionTooLong = "写真の説明は200文字以内にしてください"
+	ErrInvalidTakenAt      = "撮影日は YYYY-MM-DD 形式で指定してください"
+	ErrTooManyPhotos       = "写真は1つのぬいぐるみにつき50枚までです"
+	ErrPhotoUploadMoved    = "写真の追加は POST /api/plushies/{id}/photos で行ってください"
+	ErrInvalidPhotoOrder   = "写真の並び順には、そのぬいぐるみの写真をすべて1回ずつ指定してください"
+	ErrFailedToListPhotos  = "写真一覧の取得に失敗しました"
+	ErrFailedToSavePhoto   = "写真の保存に失敗しました"
+	ErrFailedToDeletePhoto = "写真の削除に失敗しました"
+
+	// Trash
+	ErrPlushieNotInTrash      = "ゴミ箱にそのぬいぐるみは見つかりませんでした"
+	ErrFailedToListTrash      = "ゴミ箱の取得に失敗しました"
+	ErrFailedToRestorePlushie = "ぬいぐるみの復元に失敗しました"
+
+	// Revision history
+	ErrRevisionNotFound      = "変更履歴が見つかりませんでした"
+	ErrFailedToListRevisions = "変更履歴の取得に失敗しました"
+	ErrFailedToRevert        = "変更履歴からの復元に失敗しました"
+
+	// Partial updates
+	ErrUnsupportedPatchType = "PATCH の Content-Type は application/merge-patch+json にしてください"
+	ErrUnsupportedPutType   = "PUT はフォーム (multipart/form-data か application/x-www-form-urlencoded) で送ってください"
+	ErrInvalidPatchField    = "変更できる項目は name, kind, adopted_at, notes のみです"
+	ErrInvalidPatchValue    = "項目の値は文字列か null で指定してください"
+	ErrInvalidAdoptedAt     = "お迎え日は YYYY-MM-DD 形式で指定してください"
+
+	// Conditional requests
+	ErrPlushieModified = "このぬいぐるみは他の端末で更新されています。再読み込みしてからもう一度保存してください"
+
+	// Export and import
+	ErrFailedToExport     = "エクスポートに失敗しました"
+	ErrFailedToImport     = "インポートに失敗しました"
+	ErrImportFileRequired = "インポートする ZIP ファイルを選択してください"
+	ErrImportTooLarge     = "インポートするファイルが大きすぎます"
+	ErrInvalidImport      = "インポートできないファイルです"
+
+	// CSV import and export
+	ErrFailedToExportCSV     = "CSV の書き出しに失敗しました"
+	ErrFailedToImportCSV     = "CSV の読み込みに失敗しました"
+	ErrCSVFileRequired       = "インポートする CSV ファイルを選択してください"
+	ErrInvalidCSV            = "CSV を読み込めませんでした"
+	ErrCSVNotUTF8            = "CSV は UTF-8 で保存してください"
+	ErrCSVTooManyRows        = "一度にインポートできるのは1000行までです"
+	ErrInvalidCSVMapping     = "列の対応付けは name, kind, adopted_at, notes, tags, custom, ignore のいずれかで指定してください"
+	ErrCSVNameColumnRequired = "名前の列が見つかりません"
+	ErrCSVDuplicateColumn    = "同じ項目に複数の列が対応付けられています"
+	ErrCSVColumnCount        = "列の数がヘッダーと合っていません"
+
+	// Share links
+	ErrShareLinkNotFound         = "共有リンクが見つからないか、有効期限が切れています"
+	ErrFailedToListShareLinks    = "共有リンクの取得に失敗しました"
+	ErrFailedToCreateShareLink   = "共有リンクの作成に失敗しました"
+	ErrFailedToRevokeShareLink   = "共有リンクの削除に失敗しました"
+	ErrFailedToLoadSharedPlushie = "共有されたぬいぐるみの読み込みに失敗しました"
+	ErrInvalidShareExpiry        = "有効期限には未来の日時を指定してください"
+	ErrInvalidShareQuote         = "引用できるのはこのぬいぐるみの会話のメッセージだけです"
+	ErrTooManyShareQuotes        = "引用できるメッセージは10件までです"
+
+	// Households
+	ErrHouseholdNotFound        = "世帯が見つかりませんでした"
+	ErrPermissionDenied         = "この操作を行う権限がありません"
+	ErrInvalidHouseholdRole     = "役割は owner, editor, viewer のいずれかで指定してください"
+	ErrPersonalHousehold        = "個人用の世帯ではこの操作はできません"
+	ErrHouseholdNotEmpty        = "ぬいぐるみ（ゴミ箱を含む）が残っている世帯は削除できません"
+	ErrLastHouseholdOwner       = "世帯には少なくとも1人のオーナーが必要です"
+	ErrMemberNotFound           = "メンバーが見つかりませんでした"
+	ErrAlreadyHouseholdMember   = "すでにこの世帯のメンバーです"
+	ErrInvitationNotFound       = "招待が見つからないか、有効期限が切れています"
+	ErrFailedToListHouseholds   = "世帯の取得に失敗しました"
+	ErrFailedToSaveHousehold    = "世帯の保存に失敗しました"
+	ErrFailedToDeleteHousehold  = "世帯の削除に失敗しました"
+	ErrFailedToInvite           = "招待の作成に失敗しました"
+	ErrFailedToAcceptInvitation = "招待の受け入れに失敗しました"
+	ErrFailedToUpdateMember     = "メンバーの変更に失敗しました"
+	ErrFailedToMovePlushie      = "ぬいぐるみの移動に失敗しました"
 )
 
-// Configuration constants
+// Configuration defaults (see config.go for overrides)
 const (
-	DefaultMaxUsers     = 3
-	MaxMultipartFormSize = 10 << 20 // 10MB
-	DefaultReadTimeout  = 15 * time.Second
-	DefaultWriteTimeout = 15 * time.Second
-	DefaultPort         = ":8080"
-	UploadsDir          = "uploads"
-	DBPath              = "./poppo.db"
+	DefaultMaxUsers      = 3
+	DefaultMaxUploadSize = 10 << 20 // 10MB
+	DefaultMaxImportSize = 1 << 30  // 1GB
+	DefaultReadTimeout   = 15 * time.Second
+	DefaultWriteTimeout  = 15 * time.Second
+	ChatTimeout          = 60 * time.Second // HandleChat waits for the full completion
+	ChatStreamTimeout    = 5 * time.Minute  // long-lived SSE responses
+	ArchiveTimeout       = 10 * time.Minute // export and import of whole collections
+	DefaultPort          = ":8080"
+	DefaultUploadsDir    = "uploads"
+	DefaultDBPath        = "./poppo.db"
 )
-
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conversation message roles
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleSystem    = "system"
+)
+
+// Message list pagination
+const (
+	DefaultMessagePageSize = 50
+	MaxMessagePageSize     = 200
+)
+
+type ConversationMessage struct {
+	ID         int64     `json:"id"`
+	PlushieID  int64     `json:"plushie_id"`
+	Speaker    string    `json:"speaker"`
+	Role       string    `json:"role"`
+	Content    string    `json:"content"`
+	Timestamp  time.Time `json:"timestamp"`
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// conversationHistoryExpr renders a plushie's messages back into the legacy
+// "speaker: content" text form, so conversation_history stays available to
+// API clients and the chat prompt.
+const conversationHistoryExpr = `(
+	SELECT group_concat(CASE WHEN m.speaker = '' THEN m.content ELSE m.speaker || ': ' || m.content END, char(10))
+	FROM (
+		SELECT speaker, content FROM conversation_messages
+		WHERE plushie_id = plushies.id
+		ORDER BY id
+	) m
+)`
+
+func isValidRole(role string) bool {
+	return role == RoleUser || role == RoleAssistant || role == RoleSystem
+}
+
+// speakerLinePattern matches "speaker: content" lines (ASCII or full-width colon)
+var speakerLinePattern = regexp.MustCompile(`^([^:：\s][^:：]{0,19})[:：]\s*(.*)$`)
+
+// parseConversationHistory splits a free-text conversation history into messages.
+// Lines of the form "speaker: text" start a new message; lines spoken by the
+// plushie itself become assistant turns and everything else a user turn.
+// Unlabelled paragraphs (personality notes and the like) become system messages.
+func parseConversationHistory(history, plushieName string, at time.Time) []ConversationMessage {
+	var msgs []ConversationMessage
+	continuing := false
+	for _, line := range strings.Split(strings.ReplaceAll(history, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, " \t　")
+		if strings.TrimSpace(line) == "" {
+			continuing = false
+			continue
+		}
+
+		if m := speakerLinePattern.FindStringSubmatch(line); m != nil && !strings.HasPrefix(m[2], "//") {
+			speaker := strings.TrimSpace(m[1])
+			role := RoleUser
+			if speaker == strings.TrimSpace(plushieName) {
+				role = RoleAssistant
+			}
+			msgs = append(msgs, ConversationMessage{Speaker: speaker, Role: role, Content: m[2], Timestamp: at})
+			continuing = true
+			continue
+		}
+
+		if continuing {
+			msgs[len(msgs)-1].Content += "\n" + line
+			continue
+		}
+		msgs = append(msgs, ConversationMessage{Role: RoleSystem, Content: line, Timestamp: at})
+		continuing = true
+	}
+	return msgs
+}
+
+// insertConversationMessages inserts messages for a plushie, filling in their IDs
+func insertConversationMessages(tx *sql.Tx, plushieID int64, msgs []ConversationMessage) error {
+	now := time.Now().UTC()
+	for i := range msgs {
+		res, err := tx.Exec(`
+			INSERT INTO conversation_messages (plushie_id, speaker, role, content, timestamp, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, plushieID, msgs[i].Speaker, msgs[i].Role, msgs[i].Content, msgs[i].Timestamp, now, now)
+		if err != nil {
+			return err
+		}
+		msgs[i].ID, _ = res.LastInsertId()
+		msgs[i].PlushieID = plushieID
+		msgs[i].CreatedAt = now
+		msgs[i].ModifiedAt = now
+	}
+	return nil
+}
+
+// parseMessageID parses message ID from URL parameter
+func parseMessageID(r *http.Request) (int64, error) {
+	return parseURLInt64(r, "messageID")
+}
+
+// messageRequest is the body accepted when appending a message
+type messageRequest struct {
+	Speaker   string     `json:"speaker"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+func (req *messageRequest) validate() string {
+	if strings.TrimSpace(req.Content) == "" {
+		return ErrMessageContentRequired
+	}
+	if req.Role == "" {
+		req.Role = RoleUser
+	}
+	if !isValidRole(req.Role) {
+		return ErrInvalidMessageRole
+	}
+	return ""
+}
+
+// messageUpdateRequest is the body accepted when editing a message. Fields
+// left out are kept, so editing only the text doesn't change who said it.
+type messageUpdateRequest struct {
+	Speaker   *string    `json:"speaker"`
+	Role      *string    `json:"role"`
+	Content   *string    `json:"content"`
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+func (req *messageUpdateRequest) validate() string {
+	if req.Content != nil && strings.TrimSpace(*req.Content) == "" {
+		return ErrMessageContentRequired
+	}
+	if req.Role != nil && !isValidRole(*req.Role) {
+		return ErrInvalidMessageRole
+	}
+	return ""
+}
+
+func scanConversationMessage(scan func(dest ...any) error) (*ConversationMessage, error) {
+	var m ConversationMessage
+	err := scan(&m.ID, &m.PlushieID, &m.Speaker, &m.Role, &m.Content, &m.Timestamp, &m.CreatedAt, &m.ModifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+const conversationMessageColumns = `id, plushie_id, speaker, role, content, timestamp, created_at, updated_at`
+
+// HandleListMessages returns a page of a plushie's messages in chronological order.
+// Pages are walked backwards from the newest message using the before cursor.
+func (a *App) HandleListMessages(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := DefaultMessagePageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil || parsed <= 0 {
+			respondError(w, http.StatusBadRequest, ErrInvalidPagination)
+			return
+		}
+		limit = min(parsed, MaxMessagePageSize)
+	}
+	var before int64
+	if s := r.URL.Query().Get("before"); s != "" {
+		before, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || before <= 0 {
+			respondError(w, http.StatusBadRequest, ErrInvalidPagination)
+			return
+		}
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permView) {
+		return
+	}
+
+	query := `SELECT ` + conversationMessageColumns + ` FROM conversation_messages WHERE plushie_id = ?`
+	args := []any{id}
+	if before > 0 {
+		query += ` AND id < ?`
+		args = append(args, before)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := a.DB.Query(query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListMessages)
+		return
+	}
+	defer rows.Close()
+
+	items := []ConversationMessage{}
+	for rows.Next() {
+		m, err := scanConversationMessage(rows.Scan)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		items = append(items, *m)
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	// Reverse into chronological order
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+
+	resp := map[string]any{
+		"messages": items,
+		"has_more": hasMore,
+	}
+	if hasMore {
+		resp["next_before"] = items[0].ID
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// HandleAppendMessage adds a single message to the end of a plushie's conversation
+func (a *App) HandleAppendMessage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req messageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	now := time.Now().UTC()
+	msg := ConversationMessage{Speaker: req.Speaker, Role: req.Role, Content: req.Content, Timestamp: now}
+	if req.Timestamp != nil {
+		msg.Timestamp = req.Timestamp.UTC()
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	defer tx.Rollback()
+
+	if !plushieIfMatchOrError(w, tx, r, id, ErrFailedToSaveMessage) {
+		return
+	}
+	before, err := loadPlushieSnapshot(tx, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	msgs := []ConversationMessage{msg}
+	if err := insertConversationMessages(tx, id, msgs); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, now, id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	if err := recordRevision(tx, id, userID, RevisionMessage, before, nil); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+
+	a.setPlushieETag(w, id)
+	respondJSON(w, http.StatusCreated, msgs[0])
+}
+
+// HandleUpdateMessage edits a single message in place
+func (a *App) HandleUpdateMessage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	messageID, err := parseMessageID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req messageUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	defer tx.Rollback()
+
+	if !plushieIfMatchOrError(w, tx, r, id, ErrFailedToSaveMessage) {
+		return
+	}
+	before, err := loadPlushieSnapshot(tx, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	now := time.Now().UTC()
+	query := `UPDATE conversation_messages
+		SET speaker = COALESCE(?, speaker), role = COALESCE(?, role), content = COALESCE(?, content), updated_at = ?`
+	args := []any{req.Speaker, req.Role, req.Content, now}
+	if req.Timestamp != nil {
+		query += `, timestamp = ?`
+		args = append(args, req.Timestamp.UTC())
+	}
+	query += ` WHERE id = ? AND plushie_id = ?`
+	args = append(args, messageID, id)
+
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrMessageNotFound)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, now, id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+	if err := recordRevision(tx, id, userID, RevisionMessage, before, nil); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+
+	m, err := scanConversationMessage(tx.QueryRow(
+		`SELECT `+conversationMessageColumns+` FROM conversation_messages WHERE id = ?`, messageID,
+	).Scan)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveMessage)
+		return
+	}
+
+	a.setPlushieETag(w, id)
+	respondJSON(w, http.StatusOK, m)
+}
+
+// HandleDeleteMessage removes a single message from a plushie's conversation
+func (a *App) HandleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	messageID, err := parseMessageID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteMessage)
+		return
+	}
+	defer tx.Rollback()
+
+	if !plushieIfMatchOrError(w, tx, r, id, ErrFailedToDeleteMessage) {
+		return
+	}
+	before, err := loadPlushieSnapshot(tx, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteMessage)
+		return
+	}
+	res, err := tx.Exec(`DELETE FROM conversation_messages WHERE id = ? AND plushie_id = ?`, messageID, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteMessage)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrMessageNotFound)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, time.Now().UTC(), id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteMessage)
+		return
+	}
+	if err := recordRevision(tx, id, userID, RevisionMessage, before, nil); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteMessage)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteMessage)
+		return
+	}
+
+	a.setPlushieETag(w, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replaceConversation swaps all of a plushie's messages for the parsed form of a
+// legacy free-text history. Used by the deprecated PUT /conversation endpoint.
+func (a *App) replaceConversation(r *http.Request, plushieID int64, userID, history string) error {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow(`SELECT name FROM plushies WHERE id = ? AND deleted_at IS NULL AND `+householdAccess("household_id", permEdit),
+		plushieID, userID).Scan(&name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New(ErrPlushieNotFound)
+		}
+		return err
+	}
+
+	if err := checkPlushieIfMatch(tx, r, plushieID); err != nil {
+		return err
+	}
+	before, err := loadPlushieSnapshot(tx, plushieID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`DELETE FROM conversation_messages WHERE plushie_id = ?`, plushieID); err != nil {
+		return err
+	}
+	if err := insertConversationMessages(tx, plushieID, parseConversationHistory(history, name, now)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, now, plushieID); err != nil {
+		return err
+	}
+	if err := recordRevision(tx, plushieID, userID, RevisionConversation, before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
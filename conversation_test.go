@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestUpdateMessageKeepsOmittedFields(t *testing.T) {
+	ta := newTestApp(t)
+	path := plushiePath(ta.createPlushie(t, ownerUser, 0, "くま"))
+
+	var m ConversationMessage
+	mustStatus(t, ta.request(t, ownerUser, "POST", path+"/messages",
+		map[string]string{"speaker": "くま", "role": RoleAssistant, "content": "こんにちは"}), http.StatusCreated, &m)
+	msgPath := path + "/messages/" + strconv.FormatInt(m.ID, 10)
+
+	mustStatus(t, ta.request(t, ownerUser, "PUT", msgPath, map[string]string{"content": "こんばんは"}), http.StatusOK, &m)
+	if m.Role != RoleAssistant || m.Speaker != "くま" || m.Content != "こんばんは" {
+		t.Errorf("after editing only the content: %+v", m)
+	}
+
+	mustStatus(t, ta.request(t, ownerUser, "PUT", msgPath, map[string]string{"role": RoleUser, "speaker": "わたし"}), http.StatusOK, &m)
+	if m.Role != RoleUser || m.Speaker != "わたし" || m.Content != "こんばんは" {
+		t.Errorf("after editing the role and speaker: %+v", m)
+	}
+
+	mustStatus(t, ta.request(t, ownerUser, "PUT", msgPath, map[string]string{"content": " "}), http.StatusBadRequest, nil)
+	mustStatus(t, ta.request(t, ownerUser, "PUT", msgPath, map[string]string{"role": "robot"}), http.StatusBadRequest, nil)
+
+	// Appending still defaults to the user's role
+	mustStatus(t, ta.request(t, ownerUser, "POST", path+"/messages", map[string]string{"content": "やあ"}), http.StatusCreated, &m)
+	if m.Role != RoleUser {
+		t.Errorf("appended message role = %q, want %q", m.Role, RoleUser)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestChatAndRevertHonourIfMatch(t *testing.T) {
+	ta := newTestApp(t)
+	ta.LLM = FakeLLMProvider{}
+	id := ta.createPlushie(t, ownerUser, 0, "くま")
+	path := plushiePath(id)
+
+	stale := ta.request(t, ownerUser, "GET", path, nil).Header().Get("ETag")
+	mustStatus(t, ta.request(t, ownerUser, "PATCH", path, `{"name": "しろくま"}`,
+		"Content-Type", "application/merge-patch+json"), http.StatusOK, nil)
+
+	var page struct {
+		Revisions []Revision `json:"revisions"`
+	}
+	mustStatus(t, ta.request(t, ownerUser, "GET", path+"/revisions", nil), http.StatusOK, &page)
+	if len(page.Revisions) < 2 {
+		t.Fatalf("got %d revisions, want at least 2", len(page.Revisions))
+	}
+	revertPath := path + "/revisions/" + strconv.FormatInt(page.Revisions[len(page.Revisions)-1].ID, 10) + "/revert"
+	chat := map[string]string{"message": "こんにちは"}
+
+	mustStatus(t, ta.request(t, ownerUser, "POST", path+"/chat", chat, "If-Match", stale), http.StatusPreconditionFailed, nil)
+	mustStatus(t, ta.request(t, ownerUser, "POST", path+"/chat/stream", chat, "If-Match", stale), http.StatusPreconditionFailed, nil)
+	mustStatus(t, ta.request(t, ownerUser, "POST", revertPath, nil, "If-Match", stale), http.StatusPreconditionFailed, nil)
+
+	var messages int
+	if err := ta.DB.QueryRow(`SELECT COUNT(*) FROM conversation_messages WHERE plushie_id = ?`, id).Scan(&messages); err != nil {
+		t.Fatal(err)
+	}
+	var p Plushie
+	mustStatus(t, ta.request(t, ownerUser, "GET", path, nil), http.StatusOK, &p)
+	if messages != 0 || p.Name != "しろくま" {
+		t.Fatalf("rejected requests changed the plushie: %d messages, name %q", messages, p.Name)
+	}
+
+	current := ta.request(t, ownerUser, "GET", path, nil).Header().Get("ETag")
+	w := ta.request(t, ownerUser, "POST", path+"/chat", chat, "If-Match", current)
+	mustStatus(t, w, http.StatusOK, nil)
+	w = ta.request(t, ownerUser, "POST", revertPath, nil, "If-Match", w.Header().Get("ETag"))
+	mustStatus(t, w, http.StatusOK, &p)
+	if p.Name != "くま" || w.Header().Get("ETag") == "" {
+		t.Errorf("after revert: name %q, ETag %q", p.Name, w.Header().Get("ETag"))
+	}
+}
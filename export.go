@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Export archive format. An archive is a ZIP holding manifest.json and the
+// original of every image under images/. Bump ExportVersion when the manifest
+// changes incompatibly; import accepts every version up to it.
+const (
+	ExportFormat       = "poppo-export"
+	ExportVersion      = 1
+	exportManifestName = "manifest.json"
+	exportImageDir     = "images/"
+)
+
+// exportManifest is manifest.json. IDs are only used to refer to plushies
+// within the archive; import assigns new ones.
+type exportManifest struct {
+	Format      string             `json:"format"`
+	Version     int                `json:"version"`
+	ExportedAt  time.Time          `json:"exported_at"`
+	Tags        []string           `json:"tags"`
+	Plushies    []exportPlushie    `json:"plushies"`
+	Collections []exportCollection `json:"collections"`
+}
+
+type exportPlushie struct {
+	ID        int64           `json:"id"`
+	Name      string          `json:"name"`
+	Kind      string          `json:"kind"`
+	AdoptedAt string          `json:"adopted_at,omitempty"`
+	Notes     string          `json:"notes"`
+	Tags      []string        `json:"tags"`
+	Photos    []exportPhoto   `json:"photos"`
+	Messages  []exportMessage `json:"messages"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// exportPhoto lists a plushie's photos in gallery order
+type exportPhoto struct {
+	File    string `json:"file"` // path within the archive
+	Caption string `json:"caption,omitempty"`
+	TakenAt string `json:"taken_at,omitempty"`
+	Cover   bool   `json:"cover,omitempty"`
+}
+
+type exportMessage struct {
+	Speaker   string    `json:"speaker,omitempty"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type exportCollection struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Cover       string    `json:"cover,omitempty"` // path within the archive
+	Plushies    []int64   `json:"plushies"`        // plushie IDs in collection order
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// HandleExport streams a ZIP of the plushies of the user's households with
+// their conversations, tags, photos, and the user's own tags and collections.
+// Plushies in the trash and revision history are not exported.
+func (a *App) HandleExport(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	m, err := a.buildExportManifest(r.Context(), userID)
+	if err != nil {
+		log.Printf("API Error [export]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToExport)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="poppo-export-%s.zip"`, m.ExportedAt.Format("20060102")))
+	zw := zip.NewWriter(w)
+
+	// Images go first so that any whose blob is gone can be left out of the manifest
+	missing := map[string]bool{}
+	for _, file := range m.files() {
+		err := a.writeExportImage(r.Context(), zw, file)
+		if errors.Is(err, ErrBlobNotFound) {
+			log.Printf("Warning: export: image %s is missing, leaving it out", file)
+			missing[file] = true
+			continue
+		}
+		if err != nil {
+			// The response has started, so the client can only see a truncated archive
+			log.Printf("API Error [export]: %v", err)
+			return
+		}
+	}
+	m.dropFiles(missing)
+
+	mw, err := zw.CreateHeader(&zip.FileHeader{Name: exportManifestName, Method: zip.Deflate, Modified: m.ExportedAt})
+	if err == nil {
+		enc := json.NewEncoder(mw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(m)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("API Error [export]: %v", err)
+	}
+}
+
+func (a *App) writeExportImage(ctx context.Context, zw *zip.Writer, file string) error {
+	blob, err := a.Blobs.Get(ctx, file[len(exportImageDir):])
+	if err != nil {
+		return err
+	}
+	defer blob.Body.Close()
+	// Images are already compressed
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Store, Modified: blob.ModTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, blob.Body)
+	return err
+}
+
+// files returns the archive paths of every image the manifest refers to
+func (m *exportManifest) files() []string {
+	var files []string
+	for _, p := range m.Plushies {
+		for _, ph := range p.Photos {
+			files = append(files, ph.File)
+		}
+	}
+	for _, c := range m.Collections {
+		if c.Cover != "" {
+			files = append(files, c.Cover)
+		}
+	}
+	return files
+}
+
+// dropFiles removes references to images that couldn't be exported
+func (m *exportManifest) dropFiles(missing map[string]bool) {
+	if len(missing) == 0 {
+		return
+	}
+	for i := range m.Plushies {
+		photos := []exportPhoto{}
+		for _, ph := range m.Plushies[i].Photos {
+			if !missing[ph.File] {
+				photos = append(photos, ph)
+			}
+		}
+		m.Plushies[i].Photos = photos
+	}
+	for i := range m.Collections {
+		if missing[m.Collections[i].Cover] {
+			m.Collections[i].Cover = ""
+		}
+	}
+}
+
+// buildExportManifest reads everything to export in one transaction, so the
+// manifest is consistent
+func (a *App) buildExportManifest(ctx context.Context, userID string) (*exportManifest, error) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m := &exportManifest{
+		Format:      ExportFormat,
+		Version:     ExportVersion,
+		ExportedAt:  time.Now().UTC(),
+		Tags:        []string{},
+		Plushies:    []exportPlushie{},
+		Collections: []exportCollection{},
+	}
+
+	err = queryEach(tx, `SELECT name FROM tags WHERE user_id = ? ORDER BY name COLLATE NOCASE`, []any{userID},
+		func(rows *sql.Rows) error {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			m.Tags = append(m.Tags, name)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[int64]int{} // plushie ID -> index in m.Plushies
+	covers := map[int64]int64{}
+	err = queryEach(tx, `
+		SELECT id, name, kind, COALESCE(adopted_at, ''), notes, `+plushieTagsExpr+`, COALESCE(cover_photo_id, 0), created_at, updated_at
+		FROM plushies WHERE `+householdAccess("household_id", permView)+` AND deleted_at IS NULL ORDER BY id
+	`, []any{userID, userID}, func(rows *sql.Rows) error {
+		p := exportPlushie{Photos: []exportPhoto{}, Messages: []exportMessage{}}
+		var tags sql.NullString
+		var cover int64
+		if err := rows.Scan(&p.ID, &p.Name, &p.Kind, &p.AdoptedAt, &p.Notes, &tags, &cover, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return err
+		}
+		var err error
+		if p.Tags, err = parsePlushieTags(tags); err != nil {
+			return err
+		}
+		index[p.ID] = len(m.Plushies)
+		covers[p.ID] = cover
+		m.Plushies = append(m.Plushies, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(tx, `
+		SELECT ph.id, ph.plushie_id, ph.image_path, ph.caption, COALESCE(ph.taken_at, '')
+		FROM plushie_photos ph JOIN plushies p ON p.id = ph.plushie_id
+		WHERE `+householdAccess("p.household_id", permView)+` AND p.deleted_at IS NULL
+		ORDER BY ph.plushie_id, ph.position, ph.id
+	`, []any{userID}, func(rows *sql.Rows) error {
+		var id, plushieID int64
+		var ph exportPhoto
+		if err := rows.Scan(&id, &plushieID, &ph.File, &ph.Caption, &ph.TakenAt); err != nil {
+			return err
+		}
+		ph.File = exportImageDir + ph.File
+		ph.Cover = covers[plushieID] == id
+		p := &m.Plushies[index[plushieID]]
+		p.Photos = append(p.Photos, ph)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(tx, `
+		SELECT m.plushie_id, m.speaker, m.role, m.content, m.timestamp
+		FROM conversation_messages m JOIN plushies p ON p.id = m.plushie_id
+		WHERE `+householdAccess("p.household_id", permView)+` AND p.deleted_at IS NULL
+		ORDER BY m.plushie_id, m.id
+	`, []any{userID}, func(rows *sql.Rows) error {
+		var plushieID int64
+		var msg exportMessage
+		if err := rows.Scan(&plushieID, &msg.Speaker, &msg.Role, &msg.Content, &msg.Timestamp); err != nil {
+			return err
+		}
+		p := &m.Plushies[index[plushieID]]
+		p.Messages = append(p.Messages, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	collections := map[int64]int{}
+	err = queryEach(tx, `
+		SELECT id, name, description, COALESCE(cover_image_path, ''), created_at
+		FROM collections WHERE user_id = ? ORDER BY name COLLATE NOCASE
+	`, []any{userID}, func(rows *sql.Rows) error {
+		var id int64
+		c := exportCollection{Plushies: []int64{}}
+		if err := rows.Scan(&id, &c.Name, &c.Description, &c.Cover, &c.CreatedAt); err != nil {
+			return err
+		}
+		if c.Cover != "" {
+			c.Cover = exportImageDir + c.Cover
+		}
+		collections[id] = len(m.Collections)
+		m.Collections = append(m.Collections, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(tx, `
+		SELECT cp.collection_id, cp.plushie_id
+		FROM collection_plushies cp
+		JOIN collections c ON c.id = cp.collection_id
+		JOIN plushies p ON p.id = cp.plushie_id
+		WHERE c.user_id = ? AND p.deleted_at IS NULL AND `+householdAccess("p.household_id", permView)+`
+		ORDER BY cp.collection_id, cp.position
+	`, []any{userID, userID}, func(rows *sql.Rows) error {
+		var collectionID, plushieID int64
+		if err := rows.Scan(&collectionID, &plushieID); err != nil {
+			return err
+		}
+		c := &m.Collections[collections[collectionID]]
+		c.Plushies = append(c.Plushies, plushieID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// queryEach runs a query in tx and calls fn for every row
+func queryEach(tx *sql.Tx, query string, args []any, fn func(rows *sql.Rows) error) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
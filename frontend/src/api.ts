@@ -10,9 +10,15 @@ export type Plushie = {
   name: string;
   kind: string;
   adopted_at?: string;
+  notes?: string;
+  tags?: string[];
   image_url?: string;
+  medium_image_url?: string;
+  thumbnail_url?: string;
   conversation_history?: string;
   created_at?: string;
+  // ETag of the GET response, sent back as If-Match when saving
+  etag?: string;
 };
 
 const API_BASE = "http://localhost:8080/api";
@@ -66,6 +72,17 @@ async function handleResponse<T>(res: Response): Promise<T> {
   return (await res.json()) as T;
 }
 
+// Image URLs from the API are relative to the backend origin
+function withAbsoluteImageURLs(p: Plushie): Plushie {
+  const abs = (url?: string) => (url ? `${API_ORIGIN}${url}` : url);
+  return {
+    ...p,
+    image_url: abs(p.image_url),
+    medium_image_url: abs(p.medium_image_url),
+    thumbnail_url: abs(p.thumbnail_url),
+  };
+}
+
 // Supabase Auth functions
 export async function apiRegister(email: string, password: string): Promise<User> {
   const { data, error } = await supabase.auth.signUp({
@@ -116,7 +133,8 @@ export async function apiListPlushies(): Promise<Plushie[]> {
   const headers: HeadersInit = {
     "Authorization": `Bearer ${token}`,
   };
-  const res = await fetch(`${API_BASE}/plushies`, {
+  // The list view doesn't show conversations, so skip loading them
+  const res = await fetch(`${API_BASE}/plushies?fields=-conversation_history`, {
     method: "GET",
     headers,
   });
@@ -124,14 +142,7 @@ export async function apiListPlushies(): Promise<Plushie[]> {
   if (!list || !Array.isArray(list)) {
     return [];
   }
-  return list.map((p) =>
-    p.image_url
-      ? {
-          ...p,
-          image_url: `${API_ORIGIN}${p.image_url}`
-        }
-      : p
-  );
+  return list.map(withAbsoluteImageURLs);
 }
 
 export async function apiCreatePlushie(params: {
@@ -170,11 +181,35 @@ export async function apiUpdatePlushie(
     imageFile?: File | null;
   }
 ): Promise<void> {
+  const token = await getAuthToken();
+  if (!token) {
+    throw new Error("Not authenticated. Please log in.");
+  }
+  const headers: HeadersInit = {
+    "Content-Type": "application/merge-patch+json",
+    "Authorization": `Bearer ${token}`,
+  };
+  // Only the edited fields are sent; notes and the other photos stay as they are
+  const res = await fetch(`${API_BASE}/plushies/${id}`, {
+    method: "PATCH",
+    headers,
+    body: JSON.stringify({
+      name: params.name,
+      kind: params.kind,
+      adopted_at: params.adoptedAt || null,
+    }),
+  });
+  await handleResponse<unknown>(res);
+
+  if (params.imageFile) {
+    await apiAddPhoto(id, params.imageFile, { cover: true });
+  }
+}
+
+export async function apiAddPhoto(id: number, imageFile: File, options: { cover?: boolean } = {}): Promise<void> {
   const form = new FormData();
-  form.set("name", params.name);
-  form.set("kind", params.kind);
-  if (params.adoptedAt) form.set("adopted_at", params.adoptedAt);
-  if (params.imageFile) form.set("image", params.imageFile);
+  form.set("image", imageFile);
+  if (options.cover) form.set("cover", "true");
 
   const token = await getAuthToken();
   if (!token) {
@@ -183,8 +218,8 @@ export async function apiUpdatePlushie(
   const headers: HeadersInit = {
     "Authorization": `Bearer ${token}`,
   };
-  const res = await fetch(`${API_BASE}/plushies/${id}`, {
-    method: "PUT",
+  const res = await fetch(`${API_BASE}/plushies/${id}/photos`, {
+    method: "POST",
     headers,
     body: form,
   });
@@ -204,21 +239,21 @@ export async function apiGetPlushie(id: number): Promise<Plushie> {
     headers,
   });
   const plushie = await handleResponse<Plushie>(res);
-  if (plushie.image_url) {
-    plushie.image_url = `${API_ORIGIN}${plushie.image_url}`;
-  }
-  return plushie;
+  plushie.etag = res.headers.get("ETag") ?? undefined;
+  return withAbsoluteImageURLs(plushie);
 }
 
-export async function apiUpdateConversation(id: number, conversationHistory: string): Promise<void> {
+// Pass the plushie's etag so the save fails (412) if someone else changed it in the meantime
+export async function apiUpdateConversation(id: number, conversationHistory: string, etag?: string): Promise<void> {
   const token = await getAuthToken();
   if (!token) {
     throw new Error("Not authenticated. Please log in.");
   }
-  const headers: HeadersInit = {
+  const headers: Record<string, string> = {
     "Content-Type": "application/json",
     "Authorization": `Bearer ${token}`,
   };
+  if (etag) headers["If-Match"] = etag;
   const res = await fetch(`${API_BASE}/plushies/${id}/conversation`, {
     method: "PUT",
     headers,
@@ -227,17 +262,19 @@ export async function apiUpdateConversation(id: number, conversationHistory: str
   await handleResponse<unknown>(res);
 }
 
-export async function apiChat(id: number): Promise<{ message: string }> {
+export async function apiChat(id: number, message?: string): Promise<{ message: string }> {
   const token = await getAuthToken();
   if (!token) {
     throw new Error("Not authenticated. Please log in.");
   }
   const headers: HeadersInit = {
+    "Content-Type": "application/json",
     "Authorization": `Bearer ${token}`,
   };
   const res = await fetch(`${API_BASE}/plushies/${id}/chat`, {
     method: "POST",
     headers,
+    body: JSON.stringify({ message: message ?? "" }),
   });
   return handleResponse<{ message: string }>(res);
 }
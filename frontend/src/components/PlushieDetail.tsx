@@ -45,7 +45,7 @@ export function PlushieDetail() {
     setSavingHistory(true);
     setError(null);
     try {
-      await apiUpdateConversation(Number(id), conversationHistory);
+      await apiUpdateConversation(Number(id), conversationHistory, plushie?.etag);
       // reload to get updated data
       await load();
     } catch (err) {
@@ -119,7 +119,7 @@ export function PlushieDetail() {
           {plushie.image_url && (
             <div style={{ marginBottom: "1rem" }}>
               <img
-                src={plushie.image_url}
+                src={plushie.medium_image_url || plushie.image_url}
                 alt={plushie.name}
                 style={{ maxWidth: "100%", borderRadius: "8px" }}
               />
@@ -82,7 +82,7 @@ export function PlushiesPage() {
   }
 
   async function handleDelete(id: number) {
-    if (!window.confirm("このぬいぐるみを削除しますか？")) return;
+    if (!window.confirm("このぬいぐるみをゴミ箱に移動しますか？")) return;
     try {
       await apiDeletePlushie(id);
       await load();
@@ -182,7 +182,7 @@ export function PlushiesPage() {
                 {(items ?? []).map((p) => (
                   <article key={p.id} className="plush-card">
                     {p.image_url ? (
-                      <img src={p.image_url} alt={p.name} className="plush-image" />
+                      <img src={p.thumbnail_url || p.image_url} alt={p.name} className="plush-image" />
                     ) : (
                       <div className="plush-image" />
                     )}
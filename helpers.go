@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt/v5"
 )
 
 var (
@@ -24,9 +25,31 @@ func getUserIDFromRequest(r *http.Request) (string, error) {
 	return userID, nil
 }
 
+// routeTimeout overrides the server-wide read/write timeouts for a route and
+// cancels the request context once the timeout has passed
+func routeTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deadline := time.Now().Add(d)
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(deadline)
+			_ = rc.SetWriteDeadline(deadline)
+
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 // parsePlushieID parses plushie ID from URL parameter
 func parsePlushieID(r *http.Request) (int64, error) {
-	idStr := chi.URLParam(r, "id")
+	return parseURLInt64(r, "id")
+}
+
+// parseURLInt64 parses a numeric ID from the named URL parameter
+func parseURLInt64(r *http.Request, param string) (int64, error) {
+	idStr := chi.URLParam(r, param)
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
 		return 0, errors.New(ErrInvalidID)
@@ -52,8 +75,7 @@ func (a *App) ensureUserExists(userID, email string) error {
 }
 
 // getEmailFromJWT extracts email from JWT token in Authorization header
-func getEmailFromJWT(r *http.Request) (string, error) {
-	supabaseAuth := NewSupabaseAuth()
+func (a *App) getEmailFromJWT(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return "", nil
@@ -64,23 +86,16 @@ func getEmailFromJWT(r *http.Request) (string, error) {
 		return "", nil
 	}
 
-	token, err := jwt.ParseWithClaims(parts[1], &SupabaseClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(supabaseAuth.JWTSecret), nil
-	})
+	claims, err := a.SupabaseAuth.ParseToken(parts[1])
 	if err != nil {
 		return "", err
 	}
-
-	if claims, ok := token.Claims.(*SupabaseClaims); ok && token.Valid {
-		return claims.Email, nil
-	}
-
-	return "", nil
+	return claims.Email, nil
 }
 
 // ensureUserExistsFromRequest ensures user exists by extracting email from JWT
 func (a *App) ensureUserExistsFromRequest(r *http.Request, userID string) error {
-	email, err := getEmailFromJWT(r)
+	email, err := a.getEmailFromJWT(r)
 	if err != nil || email == "" {
 		// If we can't get email, still try to ensure user exists with empty email
 		_, _ = a.DB.Exec(`
@@ -92,16 +107,24 @@ func (a *App) ensureUserExistsFromRequest(r *http.Request, userID string) error
 	return a.ensureUserExists(userID, email)
 }
 
-// scanPlushieFromRow scans a plushie from database row
-func scanPlushieFromRow(rows *sql.Rows) (*Plushie, error) {
+// plushieColumns is the column list expected by scanPlushieFromRow. Its one
+// placeholder (in plushieTagsExpr) is the viewing user's ID.
+const plushieColumns = `id, user_id, COALESCE(household_id, 0), name, kind, adopted_at, notes, ` + plushieTagsExpr + ` AS tags, ` +
+	`image_path, image_medium_path, image_thumb_path, ` +
+	conversationHistoryExpr + ` AS conversation_history, created_at, updated_at`
+
+// scanPlushieFromRow scans a plushie selected with plushieColumns and fills in
+// signed image URLs. Pass rows.Scan or row.Scan.
+func (a *App) scanPlushieFromRow(scan func(dest ...any) error) (*Plushie, error) {
 	var p Plushie
 	var adoptedAt sql.NullString
-	var imagePath sql.NullString
+	var imagePath, mediumPath, thumbPath sql.NullString
 	var conversationHistory sql.NullString
+	var tags sql.NullString
 
-	err := rows.Scan(
-		&p.ID, &p.UserID, &p.Name, &p.Kind,
-		&adoptedAt, &imagePath, &conversationHistory,
+	err := scan(
+		&p.ID, &p.UserID, &p.HouseholdID, &p.Name, &p.Kind,
+		&adoptedAt, &p.Notes, &tags, &imagePath, &mediumPath, &thumbPath, &conversationHistory,
 		&p.CreatedAt, &p.ModifiedAt,
 	)
 	if err != nil {
@@ -111,8 +134,20 @@ func scanPlushieFromRow(rows *sql.Rows) (*Plushie, error) {
 	if adoptedAt.Valid {
 		p.AdoptedAt = adoptedAt.String
 	}
+	if p.Tags, err = parsePlushieTags(tags); err != nil {
+		return nil, err
+	}
 	if imagePath.Valid {
-		p.ImageURL = "/uploads/" + imagePath.String
+		p.ImageURL = a.imageURL(imagePath.String)
+		// Images uploaded before variants existed only have the original
+		p.MediumImageURL = p.ImageURL
+		p.ThumbnailURL = p.ImageURL
+	}
+	if mediumPath.Valid {
+		p.MediumImageURL = a.imageURL(mediumPath.String)
+	}
+	if thumbPath.Valid {
+		p.ThumbnailURL = a.imageURL(thumbPath.String)
 	}
 	if conversationHistory.Valid {
 		p.ConversationHistory = conversationHistory.String
@@ -121,19 +156,3 @@ func scanPlushieFromRow(rows *sql.Rows) (*Plushie, error) {
 	return &p, nil
 }
 
-// checkPlushieOwnership checks if a plushie belongs to a user
-func (a *App) checkPlushieOwnership(plushieID int64, userID string) error {
-	var exists int
-	err := a.DB.QueryRow(
-		`SELECT 1 FROM plushies WHERE id = ? AND user_id = ?`,
-		plushieID, userID,
-	).Scan(&exists)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return errors.New(ErrPlushieNotFound)
-		}
-		return errors.New(ErrFailedToGetPlushie)
-	}
-	return nil
-}
-
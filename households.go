@@ -0,0 +1,869 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Household member roles
+const (
+	HouseholdOwner  = "owner"  // also manages the household and its members, and purges plushies
+	HouseholdEditor = "editor" // adds, edits and deletes plushies
+	HouseholdViewer = "viewer" // only reads
+)
+
+// HouseholdInvitationTTL is how long an invitation can be accepted
+const HouseholdInvitationTTL = 7 * 24 * time.Hour
+
+// permission is what a request does with a household or its plushies. Each
+// role has every permission up to its own.
+type permission int
+
+const (
+	permView permission = iota
+	permEdit
+	permManage
+)
+
+var householdRoles = []string{HouseholdOwner, HouseholdEditor, HouseholdViewer}
+
+var rolePermission = map[string]permission{
+	HouseholdViewer: permView,
+	HouseholdEditor: permEdit,
+	HouseholdOwner:  permManage,
+}
+
+var errPermissionDenied = errors.New(ErrPermissionDenied)
+
+func isValidHouseholdRole(role string) bool {
+	_, ok := rolePermission[role]
+	return ok
+}
+
+func roleAllows(role string, perm permission) bool {
+	p, ok := rolePermission[role]
+	return ok && p >= perm
+}
+
+// householdAccess returns an SQL condition that holds when column is a
+// household in which the user bound to its one placeholder has perm
+func householdAccess(column string, perm permission) string {
+	return householdAccessOf(column, "?", perm)
+}
+
+// householdAccessOf is householdAccess for the user ID in userExpr, such as
+// another column of the query
+func householdAccessOf(column, userExpr string, perm permission) string {
+	var roles []string
+	for _, role := range householdRoles {
+		if roleAllows(role, perm) {
+			roles = append(roles, "'"+role+"'")
+		}
+	}
+	return column + ` IN (SELECT household_id FROM household_members WHERE user_id = ` + userExpr + ` AND role IN (` +
+		strings.Join(roles, ", ") + `))`
+}
+
+// checkPlushieAccess checks that a plushie is in one of the user's households
+// and that their role there allows perm. Plushies in the trash are only found
+// with trashed set, and only those.
+func (a *App) checkPlushieAccess(plushieID int64, userID string, perm permission, trashed bool) error {
+	trash := `p.deleted_at IS NULL`
+	if trashed {
+		trash = `p.deleted_at IS NOT NULL`
+	}
+	var role string
+	err := a.DB.QueryRow(`
+		SELECT m.role FROM plushies p
+		JOIN household_members m ON m.household_id = p.household_id AND m.user_id = ?
+		WHERE p.id = ? AND `+trash, userID, plushieID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New(ErrPlushieNotFound)
+	}
+	if err != nil {
+		return errors.New(ErrFailedToGetPlushie)
+	}
+	if !roleAllows(role, perm) {
+		return errPermissionDenied
+	}
+	return nil
+}
+
+// plushieAccessOrError checks access to a plushie outside the trash and writes
+// the matching error response: 404 to non-members, 403 to members whose role
+// doesn't allow perm
+func (a *App) plushieAccessOrError(w http.ResponseWriter, plushieID int64, userID string, perm permission) bool {
+	return respondAccessError(w, a.checkPlushieAccess(plushieID, userID, perm, false))
+}
+
+func respondAccessError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errPermissionDenied):
+		respondError(w, http.StatusForbidden, ErrPermissionDenied)
+	case err.Error() == ErrPlushieNotFound || err.Error() == ErrHouseholdNotFound:
+		respondError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("API Error [plushie access]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToGetPlushie)
+	}
+	return false
+}
+
+// personalHouseholdID returns the user's personal household, creating it on
+// first use. The user must be in the users table.
+func personalHouseholdID(tx *sql.Tx, userID string) (int64, error) {
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`
+		INSERT INTO households (name, personal_user_id, created_at, updated_at) VALUES ('', ?, ?, ?)
+		ON CONFLICT (personal_user_id) DO NOTHING
+	`, userID, now, now); err != nil {
+		return 0, err
+	}
+	var id int64
+	if err := tx.QueryRow(`SELECT id FROM households WHERE personal_user_id = ?`, userID).Scan(&id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO household_members (household_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, id, userID, HouseholdOwner, now); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// targetHousehold returns the household new plushies go to: householdID if
+// the user may edit there, or their personal household for 0
+func targetHousehold(tx *sql.Tx, userID string, householdID int64) (int64, error) {
+	if householdID == 0 {
+		return personalHouseholdID(tx, userID)
+	}
+	var role string
+	err := tx.QueryRow(`SELECT role FROM household_members WHERE household_id = ? AND user_id = ?`,
+		householdID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errors.New(ErrHouseholdNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !roleAllows(role, permEdit) {
+		return 0, errPermissionDenied
+	}
+	return householdID, nil
+}
+
+// parseHouseholdIDValue parses an optional household_id form or query value;
+// empty means the personal household
+func parseHouseholdIDValue(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New(ErrInvalidID)
+	}
+	return id, nil
+}
+
+// Household is a household as one of its members sees it
+type Household struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Personal     bool      `json:"personal"` // the member's personal household
+	Role         string    `json:"role"`     // the member's role
+	MemberCount  int       `json:"member_count"`
+	PlushieCount int       `json:"plushie_count"` // not counting plushies in the trash
+	CreatedAt    time.Time `json:"created_at"`
+	ModifiedAt   time.Time `json:"modified_at"`
+}
+
+type HouseholdMember struct {
+	UserID   string    `json:"user_id"`
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// householdDetail is a household with its members
+type householdDetail struct {
+	Household
+	Members []HouseholdMember `json:"members"`
+}
+
+// HouseholdInvitation is a pending invitation. The token is only returned
+// when the invitation is created.
+type HouseholdInvitation struct {
+	ID        int64     `json:"id"`
+	Token     string    `json:"token,omitempty"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// householdColumns is the column list expected by scanHousehold; its one
+// placeholder is the user whose role is returned
+const householdColumns = `h.id, h.name, h.personal_user_id IS NOT NULL, m.role,
+	(SELECT COUNT(*) FROM household_members WHERE household_id = h.id),
+	(SELECT COUNT(*) FROM plushies WHERE household_id = h.id AND deleted_at IS NULL),
+	h.created_at, h.updated_at
+	FROM households h JOIN household_members m ON m.household_id = h.id AND m.user_id = ?`
+
+func scanHousehold(scan func(dest ...any) error) (*Household, error) {
+	var h Household
+	err := scan(&h.ID, &h.Name, &h.Personal, &h.Role, &h.MemberCount, &h.PlushieCount, &h.CreatedAt, &h.ModifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (a *App) getHousehold(r *http.Request, id int64, userID string) (*Household, error) {
+	return scanHousehold(a.DB.QueryRowContext(r.Context(),
+		`SELECT `+householdColumns+` WHERE h.id = ?`, userID, id).Scan)
+}
+
+// householdOrError loads a household of the user and checks that their role
+// allows perm, writing the error response otherwise
+func (a *App) householdOrError(w http.ResponseWriter, r *http.Request, id int64, userID string, perm permission) (*Household, bool) {
+	h, err := a.getHousehold(r, id, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, ErrHouseholdNotFound)
+		return nil, false
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return nil, false
+	}
+	if !roleAllows(h.Role, perm) {
+		respondError(w, http.StatusForbidden, ErrPermissionDenied)
+		return nil, false
+	}
+	return h, true
+}
+
+func parseHouseholdID(r *http.Request) (int64, error) {
+	return parseURLInt64(r, "householdID")
+}
+
+// HandleListHouseholds lists the user's households, personal one first
+func (a *App) HandleListHouseholds(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	if err := a.ensurePersonalHousehold(r, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	rows, err := a.DB.QueryContext(r.Context(),
+		`SELECT `+householdColumns+` ORDER BY h.personal_user_id IS NULL, h.name COLLATE NOCASE, h.id`, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	defer rows.Close()
+
+	households := []Household{}
+	for rows.Next() {
+		h, err := scanHousehold(rows.Scan)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+			return
+		}
+		households = append(households, *h)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	respondJSON(w, http.StatusOK, households)
+}
+
+// ensurePersonalHousehold creates the user's personal household if it doesn't exist yet
+func (a *App) ensurePersonalHousehold(r *http.Request, userID string) error {
+	if err := a.ensureUserExistsFromRequest(r, userID); err != nil {
+		return err
+	}
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := personalHouseholdID(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type householdRequest struct {
+	Name string `json:"name"`
+}
+
+// HandleCreateHousehold creates a household with the user as its owner
+func (a *App) HandleCreateHousehold(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	var req householdRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		respondError(w, http.StatusBadRequest, ErrNameRequired)
+		return
+	}
+
+	if err := a.ensureUserExistsFromRequest(r, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveHousehold)
+		return
+	}
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveHousehold)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	res, err := tx.Exec(`INSERT INTO households (name, created_at, updated_at) VALUES (?, ?, ?)`, name, now, now)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveHousehold)
+		return
+	}
+	id, err := res.LastInsertId()
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO household_members (household_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)`,
+			id, userID, HouseholdOwner, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveHousehold)
+		return
+	}
+
+	h, err := a.getHousehold(r, id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	respondJSON(w, http.StatusCreated, h)
+}
+
+// HandleGetHousehold returns a household with its members
+func (a *App) HandleGetHousehold(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h, ok := a.householdOrError(w, r, id, userID, permView)
+	if !ok {
+		return
+	}
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT m.user_id, COALESCE(u.email, ''), m.role, m.joined_at
+		FROM household_members m LEFT JOIN users u ON u.supabase_user_id = m.user_id
+		WHERE m.household_id = ?
+		ORDER BY m.joined_at, m.user_id
+	`, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	defer rows.Close()
+
+	d := householdDetail{Household: *h, Members: []HouseholdMember{}}
+	for rows.Next() {
+		var m HouseholdMember
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.JoinedAt); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+			return
+		}
+		d.Members = append(d.Members, m)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	respondJSON(w, http.StatusOK, d)
+}
+
+// HandleUpdateHousehold renames a household. Owners only.
+func (a *App) HandleUpdateHousehold(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req householdRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		respondError(w, http.StatusBadRequest, ErrNameRequired)
+		return
+	}
+
+	if _, ok := a.householdOrError(w, r, id, userID, permManage); !ok {
+		return
+	}
+	if _, err := a.DB.ExecContext(r.Context(), `UPDATE households SET name = ?, updated_at = ? WHERE id = ?`,
+		name, time.Now().UTC(), id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveHousehold)
+		return
+	}
+	h, err := a.getHousehold(r, id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	respondJSON(w, http.StatusOK, h)
+}
+
+// HandleDeleteHousehold deletes a household that holds no plushies, not even
+// in the trash. Owners only; personal households can't be deleted.
+func (a *App) HandleDeleteHousehold(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h, ok := a.householdOrError(w, r, id, userID, permManage)
+	if !ok {
+		return
+	}
+	if h.Personal {
+		respondError(w, http.StatusConflict, ErrPersonalHousehold)
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteHousehold)
+		return
+	}
+	defer tx.Rollback()
+	var plushies int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM plushies WHERE household_id = ?`, id).Scan(&plushies); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteHousehold)
+		return
+	}
+	if plushies > 0 {
+		respondError(w, http.StatusConflict, ErrHouseholdNotEmpty)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM households WHERE id = ?`, id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteHousehold)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteHousehold)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListHouseholdInvitations lists the pending invitations of a household. Owners only.
+func (a *App) HandleListHouseholdInvitations(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := a.householdOrError(w, r, id, userID, permManage); !ok {
+		return
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT id, role, invited_by, created_at, expires_at FROM household_invitations
+		WHERE household_id = ? AND expires_at > ? ORDER BY id DESC
+	`, id, time.Now().UTC())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	defer rows.Close()
+	invitations := []HouseholdInvitation{}
+	for rows.Next() {
+		var inv HouseholdInvitation
+		if err := rows.Scan(&inv.ID, &inv.Role, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+			return
+		}
+		invitations = append(invitations, inv)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	respondJSON(w, http.StatusOK, invitations)
+}
+
+// HandleCreateHouseholdInvitation invites a new member with {"role": "editor"}.
+// Anyone who gets the returned token can accept it once, within
+// HouseholdInvitationTTL. Owners only; personal households take no members.
+func (a *App) HandleCreateHouseholdInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if !isValidHouseholdRole(req.Role) {
+		respondError(w, http.StatusBadRequest, ErrInvalidHouseholdRole)
+		return
+	}
+
+	h, ok := a.householdOrError(w, r, id, userID, permManage)
+	if !ok {
+		return
+	}
+	if h.Personal {
+		respondError(w, http.StatusConflict, ErrPersonalHousehold)
+		return
+	}
+
+	token, hash, err := randomToken()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToInvite)
+		return
+	}
+	now := time.Now().UTC()
+	inv := HouseholdInvitation{Token: token, Role: req.Role, InvitedBy: userID, CreatedAt: now, ExpiresAt: now.Add(HouseholdInvitationTTL)}
+	res, err := a.DB.ExecContext(r.Context(), `
+		INSERT INTO household_invitations (household_id, token_hash, role, invited_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, id, hash, inv.Role, userID, inv.CreatedAt, inv.ExpiresAt)
+	if err == nil {
+		inv.ID, err = res.LastInsertId()
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToInvite)
+		return
+	}
+	respondJSON(w, http.StatusCreated, inv)
+}
+
+// HandleRevokeHouseholdInvitation withdraws an invitation. Owners only.
+func (a *App) HandleRevokeHouseholdInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	invitationID, err := parseURLInt64(r, "invitationID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := a.householdOrError(w, r, id, userID, permManage); !ok {
+		return
+	}
+
+	res, err := a.DB.ExecContext(r.Context(),
+		`DELETE FROM household_invitations WHERE id = ? AND household_id = ?`, invitationID, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToInvite)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrInvitationNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAcceptHouseholdInvitation makes the user a member of the household an
+// invitation is for, with its role, and uses the invitation up
+func (a *App) HandleAcceptHouseholdInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	hash := hashToken(chi.URLParam(r, "token"))
+
+	if err := a.ensureUserExistsFromRequest(r, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToAcceptInvitation)
+		return
+	}
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToAcceptInvitation)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var invitationID, householdID int64
+	var role string
+	err = tx.QueryRow(`SELECT id, household_id, role FROM household_invitations WHERE token_hash = ? AND expires_at > ?`,
+		hash, now).Scan(&invitationID, &householdID, &role)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, ErrInvitationNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToAcceptInvitation)
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO household_members (household_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)`,
+		householdID, userID, role, now)
+	if isUniqueConstraintError(err) {
+		respondError(w, http.StatusConflict, ErrAlreadyHouseholdMember)
+		return
+	}
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM household_invitations WHERE id = ?`, invitationID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("API Error [accept invitation]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToAcceptInvitation)
+		return
+	}
+
+	h, err := a.getHousehold(r, householdID, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListHouseholds)
+		return
+	}
+	respondJSON(w, http.StatusOK, h)
+}
+
+// HandleUpdateHouseholdMember changes a member's role with {"role": "viewer"}.
+// Owners only; the last owner can't be demoted.
+func (a *App) HandleUpdateHouseholdMember(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	memberID := chi.URLParam(r, "memberID")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if !isValidHouseholdRole(req.Role) {
+		respondError(w, http.StatusBadRequest, ErrInvalidHouseholdRole)
+		return
+	}
+	if _, ok := a.householdOrError(w, r, id, userID, permManage); !ok {
+		return
+	}
+
+	a.changeHouseholdMember(w, r, id, memberID, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE household_members SET role = ? WHERE household_id = ? AND user_id = ?`, req.Role, id, memberID)
+		return err
+	})
+}
+
+// HandleRemoveHouseholdMember removes a member. Owners may remove anyone and
+// every member may leave; the last owner can't, and nobody leaves their
+// personal household.
+func (a *App) HandleRemoveHouseholdMember(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parseHouseholdID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	memberID := chi.URLParam(r, "memberID")
+
+	perm := permManage
+	if memberID == userID {
+		perm = permView
+	}
+	h, ok := a.householdOrError(w, r, id, userID, perm)
+	if !ok {
+		return
+	}
+	if h.Personal {
+		respondError(w, http.StatusConflict, ErrPersonalHousehold)
+		return
+	}
+
+	a.changeHouseholdMember(w, r, id, memberID, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM household_members WHERE household_id = ? AND user_id = ?`, id, memberID)
+		return err
+	})
+}
+
+// changeHouseholdMember applies change to a member and answers 204, unless
+// the household would be left without an owner
+func (a *App) changeHouseholdMember(w http.ResponseWriter, r *http.Request, householdID int64, memberID string, change func(tx *sql.Tx) error) {
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToUpdateMember)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM household_members WHERE household_id = ? AND user_id = ?`, householdID, memberID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, ErrMemberNotFound)
+		return
+	}
+	if err == nil {
+		err = change(tx)
+	}
+	var owners int
+	if err == nil {
+		err = tx.QueryRow(`SELECT COUNT(*) FROM household_members WHERE household_id = ? AND role = ?`,
+			householdID, HouseholdOwner).Scan(&owners)
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToUpdateMember)
+		return
+	}
+	if owners == 0 {
+		respondError(w, http.StatusConflict, ErrLastHouseholdOwner)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToUpdateMember)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMovePlushie moves a plushie to another household with
+// {"household_id": 3}. Moving takes the plushie away from the other members,
+// so the user must own the household it is in and be able to edit in the new one.
+func (a *App) HandleMovePlushie(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req struct {
+		HouseholdID int64 `json:"household_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if req.HouseholdID <= 0 {
+		respondError(w, http.StatusBadRequest, ErrInvalidID)
+		return
+	}
+	if !a.plushieAccessOrError(w, id, userID, permManage) {
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToMovePlushie)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := targetHousehold(tx, userID, req.HouseholdID); err != nil {
+		respondAccessError(w, err)
+		return
+	}
+	if err := checkPlushieIfMatch(tx, r, id); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToMovePlushie)
+		}
+		return
+	}
+	_, err = tx.Exec(`UPDATE plushies SET household_id = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL AND `+
+		householdAccess("household_id", permManage), req.HouseholdID, time.Now().UTC(), id, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToMovePlushie)
+		return
+	}
+	a.setPlushieETag(w, id)
+	w.WriteHeader(http.StatusNoContent)
+}
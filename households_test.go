@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Users of householdFixture
+const (
+	ownerUser    = "owner"
+	editorUser   = "editor"
+	viewerUser   = "viewer"
+	outsiderUser = "outsider"
+)
+
+// testApp is an App on an in-memory database, served through its real routes
+type testApp struct {
+	*App
+	handler http.Handler
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+	// Handlers log every error response
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	db, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.UploadsDir = t.TempDir()
+	blobs, err := NewBlobStore(cfg.Storage, cfg.UploadsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageURLs, err := NewImageURLSigner("test-image-url-secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{
+		Config:       cfg,
+		DB:           db,
+		SessionStore: NewSessionStore(db),
+		Blobs:        blobs,
+		ImageURLs:    imageURLs,
+		SupabaseAuth: NewSupabaseAuth(testJWTSecret),
+	}
+	return &testApp{App: a, handler: a.routes()}
+}
+
+// request sends a request as user. A string body is sent as is; anything else
+// is sent as JSON.
+func (ta *testApp) request(t *testing.T, user, method, path string, body any, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	req := httptest.NewRequest(method, path, r)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", testClaims(user)))
+	w := httptest.NewRecorder()
+	ta.handler.ServeHTTP(w, req)
+	return w
+}
+
+// form sends a multipart form as user
+func (ta *testApp) form(t *testing.T, user, method, path string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ta.request(t, user, method, path, buf.String(), "Content-Type", mw.FormDataContentType())
+}
+
+// mustStatus fails the test unless w has the wanted status and decodes its
+// JSON body into out, if given
+func mustStatus(t *testing.T, w *httptest.ResponseRecorder, want int, out any) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d: %s", w.Code, want, w.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("decode %s: %v", w.Body.String(), err)
+		}
+	}
+}
+
+func (ta *testApp) createHousehold(t *testing.T, owner, name string) int64 {
+	t.Helper()
+	var h Household
+	mustStatus(t, ta.request(t, owner, "POST", "/api/households", map[string]string{"name": name}), http.StatusCreated, &h)
+	return h.ID
+}
+
+func (ta *testApp) personalHousehold(t *testing.T, user string) int64 {
+	t.Helper()
+	var households []Household
+	mustStatus(t, ta.request(t, user, "GET", "/api/households", nil), http.StatusOK, &households)
+	for _, h := range households {
+		if h.Personal {
+			return h.ID
+		}
+	}
+	t.Fatalf("%s has no personal household", user)
+	return 0
+}
+
+// join invites user into a household as role and accepts the invitation
+func (ta *testApp) join(t *testing.T, owner string, householdID int64, user, role string) {
+	t.Helper()
+	var inv HouseholdInvitation
+	mustStatus(t, ta.request(t, owner, "POST", householdPath(householdID)+"/invitations", map[string]string{"role": role}),
+		http.StatusCreated, &inv)
+	mustStatus(t, ta.request(t, user, "POST", "/api/invitations/"+inv.Token+"/accept", nil), http.StatusOK, nil)
+}
+
+func (ta *testApp) createPlushie(t *testing.T, user string, householdID int64, name string) int64 {
+	t.Helper()
+	fields := map[string]string{"name": name}
+	if householdID != 0 {
+		fields["household_id"] = strconv.FormatInt(householdID, 10)
+	}
+	var p Plushie
+	mustStatus(t, ta.form(t, user, "POST", "/api/plushies", fields), http.StatusCreated, &p)
+	return p.ID
+}
+
+func householdPath(id int64) string { return "/api/households/" + strconv.FormatInt(id, 10) }
+func plushiePath(id int64) string   { return "/api/plushies/" + strconv.FormatInt(id, 10) }
+
+// householdFixture is a shared household with an owner, an editor and a
+// viewer, plus an outsider who only has a personal household
+type householdFixture struct {
+	*testApp
+	household int64
+	shared    int64 // a plushie in the shared household
+	private   int64 // a plushie in the outsider's personal household
+}
+
+func newHouseholdFixture(t *testing.T) *householdFixture {
+	t.Helper()
+	ta := newTestApp(t)
+	f := &householdFixture{testApp: ta}
+	f.household = ta.createHousehold(t, ownerUser, "うちの子たち")
+	ta.join(t, ownerUser, f.household, editorUser, HouseholdEditor)
+	ta.join(t, ownerUser, f.household, viewerUser, HouseholdViewer)
+	f.shared = ta.createPlushie(t, ownerUser, f.household, "共有のくま")
+	f.private = ta.createPlushie(t, outsiderUser, 0, "ひみつのうさぎ")
+	return f
+}
+
+func TestHouseholdNonMemberGetsNotFound(t *testing.T) {
+	f := newHouseholdFixture(t)
+	path := plushiePath(f.shared)
+
+	tests := []struct {
+		name string
+		w    *httptest.ResponseRecorder
+	}{
+		{"GET", f.request(t, outsiderUser, "GET", path, nil)},
+		{"PATCH", f.request(t, outsiderUser, "PATCH", path, `{"name": "とられた"}`, "Content-Type", "application/merge-patch+json")},
+		{"PUT", f.form(t, outsiderUser, "PUT", path, map[string]string{"name": "とられた"})},
+		{"DELETE", f.request(t, outsiderUser, "DELETE", path, nil)},
+		{"messages", f.request(t, outsiderUser, "GET", path+"/messages", nil)},
+		{"photos", f.request(t, outsiderUser, "GET", path+"/photos", nil)},
+		{"revisions", f.request(t, outsiderUser, "GET", path+"/revisions", nil)},
+		{"household", f.request(t, outsiderUser, "GET", householdPath(f.household), nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mustStatus(t, tt.w, http.StatusNotFound, nil)
+		})
+	}
+
+	// Nothing was changed
+	var p Plushie
+	mustStatus(t, f.request(t, ownerUser, "GET", path, nil), http.StatusOK, &p)
+	if p.Name != "共有のくま" {
+		t.Errorf("name = %q after writes by a non-member", p.Name)
+	}
+}
+
+func TestHouseholdViewerCannotEdit(t *testing.T) {
+	f := newHouseholdFixture(t)
+	path := plushiePath(f.shared)
+
+	var msg ConversationMessage
+	mustStatus(t, f.request(t, ownerUser, "POST", path+"/messages",
+		map[string]string{"speaker": "わたし", "role": "user", "content": "こんにちは"}), http.StatusCreated, &msg)
+	var share struct {
+		ID int64 `json:"id"`
+	}
+	mustStatus(t, f.request(t, ownerUser, "POST", path+"/shares", map[string]any{}), http.StatusCreated, &share)
+	msgPath := path + "/messages/" + strconv.FormatInt(msg.ID, 10)
+
+	mustStatus(t, f.request(t, viewerUser, "GET", path, nil), http.StatusOK, nil)
+	mustStatus(t, f.request(t, viewerUser, "GET", path+"/messages", nil), http.StatusOK, nil)
+
+	tests := []struct {
+		name string
+		w    *httptest.ResponseRecorder
+	}{
+		{"PUT", f.form(t, viewerUser, "PUT", path, map[string]string{"name": "かえた"})},
+		{"PATCH", f.request(t, viewerUser, "PATCH", path, `{"name": "かえた"}`, "Content-Type", "application/merge-patch+json")},
+		{"DELETE", f.request(t, viewerUser, "DELETE", path, nil)},
+		{"tags", f.request(t, viewerUser, "PUT", path+"/tags", map[string]any{"tags": []string{"くま"}})},
+		{"append message", f.request(t, viewerUser, "POST", path+"/messages",
+			map[string]string{"speaker": "わたし", "role": "user", "content": "やあ"})},
+		{"edit message", f.request(t, viewerUser, "PUT", msgPath,
+			map[string]string{"speaker": "わたし", "role": "user", "content": "やあ"})},
+		{"delete message", f.request(t, viewerUser, "DELETE", msgPath, nil)},
+		{"chat", f.request(t, viewerUser, "POST", path+"/chat", map[string]string{"message": "やあ"})},
+		{"list shares", f.request(t, viewerUser, "GET", path+"/shares", nil)},
+		{"create share", f.request(t, viewerUser, "POST", path+"/shares", map[string]any{})},
+		{"revoke share", f.request(t, viewerUser, "DELETE", path+"/shares/"+strconv.FormatInt(share.ID, 10), nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mustStatus(t, tt.w, http.StatusForbidden, nil)
+		})
+	}
+}
+
+func TestHouseholdEditorCannotPurge(t *testing.T) {
+	f := newHouseholdFixture(t)
+	path := "/api/trash/" + strconv.FormatInt(f.shared, 10)
+
+	mustStatus(t, f.request(t, editorUser, "DELETE", plushiePath(f.shared), nil), http.StatusNoContent, nil)
+	mustStatus(t, f.request(t, editorUser, "DELETE", path, nil), http.StatusForbidden, nil)
+	mustStatus(t, f.request(t, viewerUser, "DELETE", path, nil), http.StatusForbidden, nil)
+	mustStatus(t, f.request(t, outsiderUser, "DELETE", path, nil), http.StatusNotFound, nil)
+
+	// Emptying the trash skips plushies the editor may not purge
+	mustStatus(t, f.request(t, editorUser, "DELETE", "/api/trash", nil), http.StatusNoContent, nil)
+	var trash []TrashedPlushie
+	mustStatus(t, f.request(t, ownerUser, "GET", "/api/trash", nil), http.StatusOK, &trash)
+	if len(trash) != 1 || trash[0].ID != f.shared {
+		t.Fatalf("trash after the editor emptied it = %+v", trash)
+	}
+
+	mustStatus(t, f.request(t, ownerUser, "DELETE", path, nil), http.StatusNoContent, nil)
+}
+
+func TestHouseholdListingsExcludeOtherHouseholds(t *testing.T) {
+	f := newHouseholdFixture(t)
+
+	// The member sees the shared plushie, the outsider only their own
+	for _, tt := range []struct {
+		user       string
+		want, hide string
+	}{
+		{viewerUser, "共有のくま", "ひみつのうさぎ"},
+		{outsiderUser, "ひみつのうさぎ", "共有のくま"},
+	} {
+		t.Run(tt.user, func(t *testing.T) {
+			var list []Plushie
+			mustStatus(t, f.request(t, tt.user, "GET", "/api/plushies", nil), http.StatusOK, &list)
+			if len(list) != 1 || list[0].Name != tt.want {
+				t.Errorf("/plushies = %+v, want only %s", list, tt.want)
+			}
+
+			var search struct {
+				Results []SearchResult `json:"results"`
+			}
+			mustStatus(t, f.request(t, tt.user, "GET", "/api/search?q=の", nil), http.StatusOK, &search)
+			if len(search.Results) != 1 || search.Results[0].Plushie.Name != tt.want {
+				t.Errorf("/search = %+v, want only %s", search.Results, tt.want)
+			}
+
+			w := f.request(t, tt.user, "GET", "/api/plushies.csv", nil)
+			mustStatus(t, w, http.StatusOK, nil)
+			if csv := w.Body.String(); !strings.Contains(csv, tt.want) || strings.Contains(csv, tt.hide) {
+				t.Errorf("/plushies.csv = %q, want %s without %s", csv, tt.want, tt.hide)
+			}
+
+			w = f.request(t, tt.user, "GET", "/api/export", nil)
+			mustStatus(t, w, http.StatusOK, nil)
+			m := readExportManifest(t, w.Body.Bytes())
+			if len(m.Plushies) != 1 || m.Plushies[0].Name != tt.want {
+				t.Errorf("/export plushies = %+v, want only %s", m.Plushies, tt.want)
+			}
+		})
+	}
+}
+
+func readExportManifest(t *testing.T, data []byte) exportManifest {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var m exportManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestHouseholdAccessEndsWhenMemberLeaves(t *testing.T) {
+	f := newHouseholdFixture(t)
+	path := plushiePath(f.shared)
+
+	// Removed by the owner
+	mustStatus(t, f.request(t, viewerUser, "GET", path, nil), http.StatusOK, nil)
+	mustStatus(t, f.request(t, ownerUser, "DELETE", householdPath(f.household)+"/members/"+viewerUser, nil), http.StatusNoContent, nil)
+	mustStatus(t, f.request(t, viewerUser, "GET", path, nil), http.StatusNotFound, nil)
+	mustStatus(t, f.request(t, viewerUser, "GET", householdPath(f.household), nil), http.StatusNotFound, nil)
+
+	// Leaving on their own
+	mustStatus(t, f.request(t, editorUser, "DELETE", householdPath(f.household)+"/members/"+editorUser, nil), http.StatusNoContent, nil)
+	mustStatus(t, f.request(t, editorUser, "GET", path, nil), http.StatusNotFound, nil)
+	mustStatus(t, f.request(t, editorUser, "PATCH", path, `{"name": "かえた"}`, "Content-Type", "application/merge-patch+json"),
+		http.StatusNotFound, nil)
+
+	for _, user := range []string{viewerUser, editorUser} {
+		var list []Plushie
+		mustStatus(t, f.request(t, user, "GET", "/api/plushies", nil), http.StatusOK, &list)
+		if len(list) != 0 {
+			t.Errorf("%s still lists %+v", user, list)
+		}
+	}
+}
+
+func TestMovePlushieNeedsOwnerAndEditRights(t *testing.T) {
+	f := newHouseholdFixture(t)
+	path := plushiePath(f.shared) + "/household"
+	move := func(user string, householdID int64) *httptest.ResponseRecorder {
+		return f.request(t, user, "PUT", path, map[string]int64{"household_id": householdID})
+	}
+
+	// The viewer may edit in the destination, the owner may only view in theirs
+	other := f.createHousehold(t, ownerUser, "実家")
+	f.join(t, ownerUser, other, editorUser, HouseholdEditor)
+	f.join(t, ownerUser, other, viewerUser, HouseholdEditor)
+	editors := f.createHousehold(t, editorUser, "editor の家")
+	f.join(t, editorUser, editors, ownerUser, HouseholdViewer)
+
+	// Only the owner of the source household may take the plushie out of it
+	mustStatus(t, move(editorUser, f.personalHousehold(t, editorUser)), http.StatusForbidden, nil)
+	mustStatus(t, move(editorUser, other), http.StatusForbidden, nil)
+	mustStatus(t, move(viewerUser, other), http.StatusForbidden, nil)
+	mustStatus(t, move(outsiderUser, f.personalHousehold(t, outsiderUser)), http.StatusNotFound, nil)
+	// and only into a household where they may edit
+	mustStatus(t, move(ownerUser, editors), http.StatusForbidden, nil)
+	mustStatus(t, move(ownerUser, f.personalHousehold(t, outsiderUser)), http.StatusNotFound, nil)
+
+	var p Plushie
+	mustStatus(t, f.request(t, ownerUser, "GET", plushiePath(f.shared), nil), http.StatusOK, &p)
+	if p.HouseholdID != f.household {
+		t.Fatalf("household_id = %d after refused moves, want %d", p.HouseholdID, f.household)
+	}
+
+	mustStatus(t, move(ownerUser, other), http.StatusNoContent, nil)
+	mustStatus(t, f.request(t, viewerUser, "GET", plushiePath(f.shared), nil), http.StatusOK, &p)
+	if p.HouseholdID != other {
+		t.Errorf("household_id = %d, want %d", p.HouseholdID, other)
+	}
+}
+
+func TestHouseholdTagsArePersonal(t *testing.T) {
+	f := newHouseholdFixture(t)
+	path := plushiePath(f.shared)
+
+	mustStatus(t, f.request(t, ownerUser, "PUT", path+"/tags", map[string]any{"tags": []string{"くま", "ふわふわ"}}), http.StatusOK, nil)
+	mustStatus(t, f.request(t, editorUser, "PUT", path+"/tags", map[string]any{"tags": []string{"くま"}}), http.StatusOK, nil)
+	// Replacing the editor's tags leaves the owner's alone
+	mustStatus(t, f.request(t, editorUser, "PUT", path+"/tags", map[string]any{"tags": []string{"クマ"}}), http.StatusOK, nil)
+
+	for _, tt := range []struct {
+		user string
+		want []string
+	}{
+		{ownerUser, []string{"くま", "ふわふわ"}},
+		{editorUser, []string{"クマ"}},
+		{viewerUser, []string{}},
+	} {
+		var p Plushie
+		mustStatus(t, f.request(t, tt.user, "GET", path, nil), http.StatusOK, &p)
+		if strings.Join(p.Tags, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s sees tags %q, want %q", tt.user, p.Tags, tt.want)
+		}
+	}
+
+	var list []Plushie
+	mustStatus(t, f.request(t, editorUser, "GET", "/api/plushies?tag=ふわふわ", nil), http.StatusOK, &list)
+	if len(list) != 0 {
+		t.Errorf("?tag= matched another member's tag: %+v", list)
+	}
+}
+
+func TestCollectionsStayPersonal(t *testing.T) {
+	f := newHouseholdFixture(t)
+
+	var c Collection
+	mustStatus(t, f.form(t, editorUser, "POST", "/api/collections", map[string]string{"name": "お気に入り"}), http.StatusCreated, &c)
+	path := "/api/collections/" + strconv.FormatInt(c.ID, 10)
+	mustStatus(t, f.request(t, editorUser, "POST", path+"/plushies", map[string]any{"plushie_ids": []int64{f.shared}}), http.StatusOK, nil)
+	mustStatus(t, f.request(t, editorUser, "POST", path+"/plushies", map[string]any{"plushie_ids": []int64{f.private}}), http.StatusNotFound, nil)
+
+	// Other members of the household don't see it
+	mustStatus(t, f.request(t, ownerUser, "GET", path, nil), http.StatusNotFound, nil)
+	mustStatus(t, f.request(t, ownerUser, "POST", path+"/plushies", map[string]any{"plushie_ids": []int64{f.shared}}), http.StatusNotFound, nil)
+	var owned []Collection
+	mustStatus(t, f.request(t, ownerUser, "GET", "/api/collections", nil), http.StatusOK, &owned)
+	if len(owned) != 0 {
+		t.Errorf("owner lists the editor's collections: %+v", owned)
+	}
+	var list []Plushie
+	mustStatus(t, f.request(t, ownerUser, "GET", "/api/plushies?collection="+strconv.FormatInt(c.ID, 10), nil), http.StatusOK, &list)
+	if len(list) != 0 {
+		t.Errorf("owner can filter by the editor's collection: %+v", list)
+	}
+
+	// Plushies the editor can no longer see drop out of it
+	mustStatus(t, f.request(t, editorUser, "DELETE", householdPath(f.household)+"/members/"+editorUser, nil), http.StatusNoContent, nil)
+	var d collectionDetail
+	mustStatus(t, f.request(t, editorUser, "GET", path, nil), http.StatusOK, &d)
+	if len(d.Plushies) != 0 || d.PlushieCount != 0 {
+		t.Errorf("collection after leaving: %d plushies, plushie_count %d", len(d.Plushies), d.PlushieCount)
+	}
+}
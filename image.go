@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Image processing settings
+const (
+	MaxImageDimension  = 2048             // longest side of the stored original
+	MediumImageSize    = 800              // longest side of the medium variant
+	ThumbnailImageSize = 256              // longest side of the thumbnail variant
+	MaxImagePixels     = 50 * 1000 * 1000 // refuse to decode anything larger (decompression bombs)
+	ImageJPEGQuality   = 85
+)
+
+// Formats accepted for upload, as reported by image.DecodeConfig
+const (
+	imageFormatJPEG = "jpeg"
+	imageFormatPNG  = "png"
+	imageFormatGIF  = "gif"
+	imageFormatWebP = "webp"
+)
+
+var ErrUnsupportedImage = errors.New("unsupported image format")
+
+// processedImage is an upload decoded, normalised and re-encoded in all sizes.
+// Re-encoding drops every metadata block (EXIF, GPS, ICC, comments).
+type processedImage struct {
+	Ext      string // file extension including the dot
+	Original []byte
+	Medium   []byte
+	Thumb    []byte
+}
+
+// checkImage verifies from its header that data is a JPEG, PNG, GIF or WebP
+// image small enough to decode, and returns its format
+func checkImage(data []byte) (string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrUnsupportedImage
+	}
+	switch format {
+	case imageFormatJPEG, imageFormatPNG, imageFormatGIF, imageFormatWebP:
+	default:
+		return "", ErrUnsupportedImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxImagePixels {
+		return "", fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	return format, nil
+}
+
+// processImage verifies that data is a JPEG, PNG, GIF or WebP image, applies
+// the EXIF orientation, caps its size and produces the medium and thumbnail variants.
+func processImage(data []byte) (*processedImage, error) {
+	format, err := checkImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if format == imageFormatJPEG {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	// Formats that may carry transparency are stored as PNG, everything else as JPEG
+	encode, ext := encodeJPEG, ".jpg"
+	if format == imageFormatPNG || format == imageFormatGIF {
+		encode, ext = png.Encode, ".png"
+	}
+	if format == imageFormatWebP && !isOpaque(img) {
+		encode, ext = png.Encode, ".png"
+	}
+
+	out := &processedImage{Ext: ext}
+	for _, v := range []struct {
+		size int
+		dst  *[]byte
+	}{
+		{MaxImageDimension, &out.Original},
+		{MediumImageSize, &out.Medium},
+		{ThumbnailImageSize, &out.Thumb},
+	} {
+		var buf bytes.Buffer
+		if err := encode(&buf, resizeToFit(img, v.size)); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+		*v.dst = buf.Bytes()
+	}
+	return out, nil
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: ImageJPEGQuality})
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// resizeToFit scales img down so its longest side is at most maxSize
+func resizeToFit(img image.Image, maxSize int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSize && h <= maxSize {
+		return img
+	}
+	if w >= h {
+		h = max(1, h*maxSize/w)
+		w = maxSize
+	} else {
+		w = max(1, w*maxSize/h)
+		h = maxSize
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// applyOrientation rotates/flips img according to an EXIF orientation value (1-8)
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	// Orientations 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // mirror horizontal and rotate 270 CW
+				dx, dy = y, x
+			case 6: // rotate 90 CW
+				dx, dy = h-1-y, x
+			case 7: // mirror horizontal and rotate 90 CW
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 270 CW
+				dx, dy = y, w-1-x
+			}
+			dst.SetNRGBA(dx, dy, src.NRGBAAt(x, y))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation tag of a JPEG, or 1 if absent
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan / end of image
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 from the first IFD of a TIFF-structured EXIF block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const DefaultImageURLTTL = time.Hour
+
+// ImageURLSigner produces short-lived HMAC-signed /uploads URLs, so <img> tags
+// can load private images without sending an Authorization header.
+//
+// Expiry times are rounded up to a multiple of the TTL, so the same image gets
+// the same URL for a whole TTL window and browsers can cache it. A signed URL
+// is therefore valid for between one and two TTLs.
+type ImageURLSigner struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewImageURLSigner creates a signer. With an empty secret a random one is
+// generated, which invalidates all issued URLs when the server restarts.
+func NewImageURLSigner(secret string, ttl time.Duration) (*ImageURLSigner, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate image URL secret: %w", err)
+		}
+	}
+	return &ImageURLSigner{secret: key, ttl: ttl, now: time.Now}, nil
+}
+
+// URL returns the signed URL of a blob key
+func (s *ImageURLSigner) URL(key string) string {
+	exp := s.expiry()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", s.sign(key, exp))
+	return "/uploads/" + key + "?" + q.Encode()
+}
+
+// expiry returns the exp of URLs signed now; it changes once per TTL
+func (s *ImageURLSigner) expiry() int64 {
+	window := int64(s.ttl / time.Second)
+	return (s.now().Unix()/window + 2) * window
+}
+
+// Verify checks the exp and sig query parameters of a signed URL and returns its expiry time
+func (s *ImageURLSigner) Verify(key, exp, sig string) (time.Time, bool) {
+	if exp == "" || sig == "" {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.sign(key, n))) {
+		return time.Time{}, false
+	}
+	expires := time.Unix(n, 0)
+	if !s.now().Before(expires) {
+		return time.Time{}, false
+	}
+	return expires, true
+}
+
+func (s *ImageURLSigner) sign(key string, exp int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%d", key, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// imageURL returns the URL clients use to load a blob
+func (a *App) imageURL(key string) string {
+	return a.ImageURLs.URL(key)
+}
+
+// userCanViewBlob reports whether key is an image or gallery photo of a plushie
+// in one of the user's households, or a cover of one of their collections.
+// Collections are personal, so other household members can't load their covers.
+func (a *App) userCanViewBlob(ctx context.Context, userID, key string) (bool, error) {
+	var exists int
+	err := a.DB.QueryRowContext(ctx, `
+		SELECT 1 FROM plushies
+		WHERE `+householdAccess("household_id", permView)+` AND (image_path = ? OR image_medium_path = ? OR image_thumb_path = ?)
+		UNION ALL
+		SELECT 1 FROM plushie_photos ph JOIN plushies p ON p.id = ph.plushie_id
+		WHERE `+householdAccess("p.household_id", permView)+` AND (ph.image_path = ? OR ph.image_medium_path = ? OR ph.image_thumb_path = ?)
+		UNION ALL
+		SELECT 1 FROM collections
+		WHERE user_id = ? AND (cover_image_path = ? OR cover_image_medium_path = ? OR cover_image_thumb_path = ?)
+		LIMIT 1
+	`, userID, key, key, key, userID, key, key, key, userID, key, key, key).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// HandleServeImage serves an uploaded image from the blob store at /uploads/{key}.
+//
+// Access requires either a valid signature from ImageURLSigner (the URLs the API
+// returns) or a Supabase token of the plushie's owner. Local blobs are served with
+// Range/conditional request support; S3 blobs are either proxied or, with
+// storage.s3.presign_reads, redirected to a presigned URL.
+func (a *App) HandleServeImage(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	if !validBlobKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// How long the response may be cached by the browser
+	var maxAge time.Duration
+	q := r.URL.Query()
+	if expires, ok := a.ImageURLs.Verify(key, q.Get("exp"), q.Get("sig")); ok {
+		maxAge = time.Until(expires)
+	} else {
+		userID, err := a.SupabaseAuth.GetUserIDFromRequest(r)
+		if err != nil {
+			if q.Get("sig") != "" {
+				respondError(w, http.StatusForbidden, ErrImageURLExpired)
+			} else {
+				respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+			}
+			return
+		}
+		allowed, err := a.userCanViewBlob(r.Context(), userID, key)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToLoadImage)
+			return
+		}
+		if !allowed {
+			// Same answer as a missing image, so keys can't be probed
+			http.NotFound(w, r)
+			return
+		}
+	}
+	w.Header().Add("Vary", "Authorization, Cookie")
+
+	if p, ok := a.Blobs.(BlobPresigner); ok && a.Config.Storage.S3.PresignReads {
+		url, err := p.PresignGet(key, a.Config.Storage.S3.PresignTTL)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToLoadImage)
+			return
+		}
+		// Keep the redirect cacheable for less time than the signature is valid
+		w.Header().Set("Cache-Control", cacheControlPrivate(min(maxAge, a.Config.Storage.S3.PresignTTL/2)))
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	blob, err := a.Blobs.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("API Error [image]: %s: %v", ErrFailedToLoadImage, err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToLoadImage)
+		return
+	}
+	defer blob.Body.Close()
+
+	w.Header().Set("Cache-Control", cacheControlPrivate(maxAge))
+	serveBlob(w, r, key, blob)
+}
+
+// cacheControlPrivate allows the browser, but no shared cache, to keep a response for d
+func cacheControlPrivate(d time.Duration) string {
+	if d <= 0 {
+		return "private, no-cache"
+	}
+	return fmt.Sprintf("private, max-age=%d", int(d.Seconds()))
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxImportManifestSize caps manifest.json in an imported archive
+const MaxImportManifestSize = 64 << 20
+
+// ImportReport describes what an import creates. A dry run returns it
+// without changing anything.
+type ImportReport struct {
+	DryRun       bool                 `json:"dry_run"`
+	Plushies     int                  `json:"plushies"`
+	Messages     int                  `json:"messages"`
+	Photos       int                  `json:"photos"`
+	TagsCreated  []string             `json:"tags_created"`
+	TagsExisting []string             `json:"tags_existing"` // already there, reused
+	Collections  []ImportedCollection `json:"collections"`
+	// PlushieIDs maps the IDs in the archive to the new IDs, after a real import
+	PlushieIDs map[int64]int64 `json:"plushie_ids,omitempty"`
+}
+
+// ImportedCollection is a collection an import creates. Names taken by an
+// existing collection get a number appended.
+type ImportedCollection struct {
+	ID           int64  `json:"id,omitempty"`
+	Name         string `json:"name"`
+	OriginalName string `json:"original_name,omitempty"` // set when renamed
+	Plushies     int    `json:"plushies"`
+}
+
+// importArchive is a validated archive
+type importArchive struct {
+	manifest *exportManifest
+	files    map[string]*zip.File
+}
+
+// HandleImport restores an archive made by HandleExport into the current
+// account. The archive is sent as the multipart field "file"; with
+// ?dry_run=true only the report of what would be created is returned.
+// Everything is created in one transaction, so a failed import leaves nothing behind.
+func (a *App) HandleImport(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	r.Body = http.MaxBytesReader(w, r.Body, a.Config.MaxImportSize)
+	if err := r.ParseMultipartForm(a.Config.MaxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge, ErrImportTooLarge)
+		} else {
+			respondError(w, http.StatusBadRequest, ErrFailedToParseForm)
+		}
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrImportFileRequired)
+		return
+	}
+	defer file.Close()
+	zr, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrInvalidImport)
+		return
+	}
+	archive, err := readImportArchive(zr, a.Config.MaxUploadSize)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrInvalidImport+": "+err.Error())
+		return
+	}
+
+	if err := a.ensureUserExistsFromRequest(r, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToImport)
+		return
+	}
+	report, err := a.planImport(r.Context(), userID, archive.manifest)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToImport)
+		return
+	}
+	if dryRun {
+		report.DryRun = true
+		respondJSON(w, http.StatusOK, report)
+		return
+	}
+
+	if err := a.runImport(r.Context(), userID, archive, report); err != nil {
+		log.Printf("API Error [import]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToImport)
+		return
+	}
+	respondJSON(w, http.StatusCreated, report)
+}
+
+// readImportArchive reads and validates the manifest and checks that every
+// image it refers to is present and is an image we accept
+func readImportArchive(zr *zip.Reader, maxImageSize int64) (*importArchive, error) {
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	mf, ok := files[exportManifestName]
+	if !ok {
+		return nil, errors.New(exportManifestName + " がありません")
+	}
+	data, err := readZipFile(mf, MaxImportManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	var m exportManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.New(exportManifestName + " を読み込めません")
+	}
+	if m.Format != ExportFormat || m.Version < 1 {
+		return nil, errors.New("ぬいぐるみレジストリのエクスポートではありません")
+	}
+	if m.Version > ExportVersion {
+		return nil, fmt.Errorf("新しいバージョン (%d) のエクスポートです。サーバーを更新してください", m.Version)
+	}
+	if err := validateImportManifest(&m, files); err != nil {
+		return nil, err
+	}
+
+	checked := map[string]bool{}
+	for _, name := range m.files() {
+		if checked[name] {
+			continue
+		}
+		checked[name] = true
+		data, err := readZipFile(files[name], maxImageSize)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if _, err := checkImage(data); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, ErrUnsupportedImageFormat)
+		}
+	}
+	return &importArchive{manifest: &m, files: files}, nil
+}
+
+// validateImportManifest applies the rules of the regular endpoints to the
+// manifest and normalises names the way they would
+func validateImportManifest(m *exportManifest, files map[string]*zip.File) error {
+	for i, name := range m.Tags {
+		n, msg := normalizeTagName(name)
+		if msg != "" {
+			return fmt.Errorf("tags[%d]: %s", i, msg)
+		}
+		m.Tags[i] = n
+	}
+
+	ids := map[int64]bool{}
+	for i := range m.Plushies {
+		p := &m.Plushies[i]
+		where := fmt.Sprintf("plushies[%d]", i)
+		if ids[p.ID] {
+			return fmt.Errorf("%s: ID %d が重複しています", where, p.ID)
+		}
+		ids[p.ID] = true
+		if strings.TrimSpace(p.Name) == "" {
+			return fmt.Errorf("%s: %s", where, ErrNameRequired)
+		}
+		if p.AdoptedAt != "" {
+			if _, err := time.Parse("2006-01-02", p.AdoptedAt); err != nil {
+				return fmt.Errorf("%s: %s", where, ErrInvalidAdoptedAt)
+			}
+		}
+
+		seen := map[string]bool{}
+		var tags []string
+		for _, name := range p.Tags {
+			n, msg := normalizeTagName(name)
+			if msg != "" {
+				return fmt.Errorf("%s: %s", where, msg)
+			}
+			if key := strings.ToLower(n); !seen[key] {
+				seen[key] = true
+				tags = append(tags, n)
+			}
+		}
+		if len(tags) > MaxTagsPerPlushie {
+			return fmt.Errorf("%s: %s", where, ErrTooManyTags)
+		}
+		p.Tags = tags
+
+		if len(p.Photos) > MaxPhotosPerPlushie {
+			return fmt.Errorf("%s: %s", where, ErrTooManyPhotos)
+		}
+		for _, ph := range p.Photos {
+			if msg := validatePhotoFields(ph.Caption, ph.TakenAt); msg != "" {
+				return fmt.Errorf("%s: %s", where, msg)
+			}
+			if err := checkImportFile(files, ph.File); err != nil {
+				return fmt.Errorf("%s: %w", where, err)
+			}
+		}
+
+		for j := range p.Messages {
+			msg := &p.Messages[j]
+			if !isValidRole(msg.Role) {
+				return fmt.Errorf("%s.messages[%d]: %s", where, j, ErrInvalidMessageRole)
+			}
+			if strings.TrimSpace(msg.Content) == "" {
+				return fmt.Errorf("%s.messages[%d]: %s", where, j, ErrMessageContentRequired)
+			}
+		}
+	}
+
+	for i := range m.Collections {
+		c := &m.Collections[i]
+		where := fmt.Sprintf("collections[%d]", i)
+		c.Name = strings.TrimSpace(c.Name)
+		if c.Name == "" {
+			return fmt.Errorf("%s: %s", where, ErrNameRequired)
+		}
+		if c.Cover != "" {
+			if err := checkImportFile(files, c.Cover); err != nil {
+				return fmt.Errorf("%s: %w", where, err)
+			}
+		}
+		inCollection := map[int64]bool{}
+		for _, id := range c.Plushies {
+			if !ids[id] {
+				return fmt.Errorf("%s: ぬいぐるみ %d がありません", where, id)
+			}
+			if inCollection[id] {
+				return fmt.Errorf("%s: ぬいぐるみ %d が重複しています", where, id)
+			}
+			inCollection[id] = true
+		}
+	}
+	return nil
+}
+
+func checkImportFile(files map[string]*zip.File, name string) error {
+	if !strings.HasPrefix(name, exportImageDir) || files[name] == nil {
+		return fmt.Errorf("画像 %q がありません", name)
+	}
+	return nil
+}
+
+// readZipFile reads a file from the archive, refusing anything larger than max
+func readZipFile(f *zip.File, max int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errors.New("ファイルが大きすぎます")
+	}
+	return data, nil
+}
+
+// planImport works out which tags exist already and which names the
+// collections get, and counts what will be created
+func (a *App) planImport(ctx context.Context, userID string, m *exportManifest) (*ImportReport, error) {
+	report := &ImportReport{
+		Plushies:     len(m.Plushies),
+		TagsCreated:  []string{},
+		TagsExisting: []string{},
+		Collections:  []ImportedCollection{},
+	}
+	for _, p := range m.Plushies {
+		report.Messages += len(p.Messages)
+		report.Photos += len(p.Photos)
+	}
+
+	existingTags := map[string]bool{}
+	if err := a.collectNames(ctx, `SELECT name FROM tags WHERE user_id = ?`, userID, existingTags); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	names := append([]string{}, m.Tags...)
+	for _, p := range m.Plushies {
+		names = append(names, p.Tags...)
+	}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if existingTags[key] {
+			report.TagsExisting = append(report.TagsExisting, name)
+		} else {
+			report.TagsCreated = append(report.TagsCreated, name)
+		}
+	}
+
+	taken := map[string]bool{}
+	if err := a.collectNames(ctx, `SELECT name FROM collections WHERE user_id = ?`, userID, taken); err != nil {
+		return nil, err
+	}
+	for _, c := range m.Collections {
+		ic := ImportedCollection{Name: c.Name, Plushies: len(c.Plushies)}
+		for n := 2; taken[strings.ToLower(ic.Name)]; n++ {
+			ic.Name = fmt.Sprintf("%s (%d)", c.Name, n)
+			ic.OriginalName = c.Name
+		}
+		taken[strings.ToLower(ic.Name)] = true
+		report.Collections = append(report.Collections, ic)
+	}
+	return report, nil
+}
+
+// collectNames adds the lower-cased names returned by query to names
+func (a *App) collectNames(ctx context.Context, query, userID string, names map[string]bool) error {
+	rows, err := a.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		names[strings.ToLower(name)] = true
+	}
+	return rows.Err()
+}
+
+// runImport stores the images and then creates everything planned in report,
+// filling in the new IDs
+func (a *App) runImport(ctx context.Context, userID string, archive *importArchive, report *ImportReport) error {
+	m := archive.manifest
+
+	images := map[string]*savedImage{}
+	discard := func() {
+		for _, img := range images {
+			a.discardSavedImage(img)
+		}
+	}
+	for _, name := range m.files() {
+		if images[name] != nil {
+			continue
+		}
+		data, err := readZipFile(archive.files[name], a.Config.MaxUploadSize)
+		if err == nil {
+			images[name], err = a.saveImageData(ctx, data)
+		}
+		if err != nil {
+			discard()
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if err := a.importRecords(ctx, userID, m, images, report); err != nil {
+		discard()
+		return err
+	}
+	return nil
+}
+
+func (a *App) importRecords(ctx context.Context, userID string, m *exportManifest, images map[string]*savedImage, report *ImportReport) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Imported plushies go to the personal household; members can move them later
+	householdID, err := personalHouseholdID(tx, userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	tagIDs := map[string]int64{}
+	for _, name := range append(append([]string{}, report.TagsCreated...), report.TagsExisting...) {
+		if _, err := tx.Exec(`INSERT INTO tags (user_id, name, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+			userID, name, now); err != nil {
+			return err
+		}
+		var id int64
+		if err := tx.QueryRow(`SELECT id FROM tags WHERE user_id = ? AND name = ? COLLATE NOCASE`, userID, name).Scan(&id); err != nil {
+			return err
+		}
+		tagIDs[strings.ToLower(name)] = id
+	}
+
+	report.PlushieIDs = map[int64]int64{}
+	for _, p := range m.Plushies {
+		createdAt, updatedAt := orNow(p.CreatedAt, now), orNow(p.UpdatedAt, now)
+		res, err := tx.Exec(`
+			INSERT INTO plushies (user_id, household_id, name, kind, adopted_at, notes, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, householdID, p.Name, p.Kind, nullIfEmpty(p.AdoptedAt), p.Notes, createdAt, updatedAt)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		report.PlushieIDs[p.ID] = id
+
+		msgs := make([]ConversationMessage, len(p.Messages))
+		for i, msg := range p.Messages {
+			msgs[i] = ConversationMessage{Speaker: msg.Speaker, Role: msg.Role, Content: msg.Content, Timestamp: orNow(msg.Timestamp, now)}
+		}
+		if err := insertConversationMessages(tx, id, msgs); err != nil {
+			return err
+		}
+
+		var coverID int64
+		for _, ph := range p.Photos {
+			photoID, err := insertPlushiePhoto(tx, id, images[ph.File], ph.Caption, ph.TakenAt, now)
+			if err != nil {
+				return err
+			}
+			if ph.Cover {
+				coverID = photoID
+			}
+		}
+		if len(p.Photos) > 0 {
+			if err := syncPlushieCover(tx, id, coverID); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range p.Tags {
+			if _, err := tx.Exec(`INSERT INTO plushie_tags (plushie_id, tag_id) VALUES (?, ?)`,
+				id, tagIDs[strings.ToLower(name)]); err != nil {
+				return err
+			}
+		}
+		if err := recordRevision(tx, id, userID, RevisionImport, emptyPlushieSnapshot(), nil); err != nil {
+			return err
+		}
+	}
+
+	for i, c := range m.Collections {
+		img := images[c.Cover]
+		if img == nil {
+			img = &savedImage{}
+		}
+		res, err := tx.Exec(`
+			INSERT INTO collections (user_id, name, description, cover_image_path, cover_image_medium_path, cover_image_thumb_path, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, report.Collections[i].Name, c.Description,
+			nullIfEmpty(img.Path), nullIfEmpty(img.MediumPath), nullIfEmpty(img.ThumbPath), orNow(c.CreatedAt, now), now)
+		if err != nil {
+			return err
+		}
+		collectionID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		report.Collections[i].ID = collectionID
+		for pos, plushieID := range c.Plushies {
+			if _, err := tx.Exec(`INSERT INTO collection_plushies (collection_id, plushie_id, position, added_at) VALUES (?, ?, ?, ?)`,
+				collectionID, report.PlushieIDs[plushieID], pos, now); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func orNow(t, now time.Time) time.Time {
+	if t.IsZero() {
+		return now
+	}
+	return t.UTC()
+}
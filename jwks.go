@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// JWKS cache settings
+const (
+	JWKSRefreshInterval    = 10 * time.Minute // keys are re-fetched at most this often in normal operation
+	JWKSMinRefreshInterval = 30 * time.Second // an unknown kid triggers a re-fetch at most this often
+	JWKSFetchTimeout       = 10 * time.Second
+	jwksMaxSize            = 1 << 20
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+// JWKSCache holds the public keys of a JSON Web Key Set loaded from a URL
+// (e.g. https://<project>.supabase.co/auth/v1/.well-known/jwks.json) or a local file.
+//
+// Keys are refreshed every JWKSRefreshInterval, and immediately when a token
+// names a kid that isn't in the set, so key rotation is picked up without a
+// restart. If a refresh fails the previously loaded keys stay in use.
+// Keys are fetched without holding mu, so a slow JWKS endpoint only holds up
+// the requests that need a key the cache doesn't have yet.
+type JWKSCache struct {
+	url    string
+	file   string
+	client *http.Client
+
+	fetchMu sync.Mutex // one fetch at a time
+
+	mu          sync.Mutex
+	keys        map[string]jwk // by kid
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+// jwk is a parsed public key with the parameters that restrict its use
+type jwk struct {
+	Key any    // *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+	Alg string // empty if the JWK doesn't restrict the algorithm
+}
+
+// NewJWKSCacheFromURL loads keys from an HTTP(S) URL. client may be nil.
+func NewJWKSCacheFromURL(url string, client *http.Client) *JWKSCache {
+	if client == nil {
+		client = &http.Client{Timeout: JWKSFetchTimeout}
+	}
+	return &JWKSCache{url: url, client: client}
+}
+
+// NewJWKSCacheFromFile loads keys from a JWKS file on disk
+func NewJWKSCacheFromFile(path string) *JWKSCache {
+	return &JWKSCache{file: path}
+}
+
+// Source describes where keys are loaded from, for log messages
+func (c *JWKSCache) Source() string {
+	if c.file != "" {
+		return c.file
+	}
+	return c.url
+}
+
+// Key returns the public key for kid that may verify tokens signed with alg.
+// An empty kid is accepted only if the set contains a single key.
+func (c *JWKSCache) Key(ctx context.Context, kid, alg string) (any, error) {
+	k, ok, due := c.lookup(kid)
+	if due {
+		if ok {
+			// The key is usable as it is; one caller refreshes the set while
+			// the others carry on
+			if c.fetchMu.TryLock() {
+				c.refreshIfDue(ctx, kid)
+				c.fetchMu.Unlock()
+			}
+		} else {
+			// The signing key may have been rotated since the last fetch
+			c.fetchMu.Lock()
+			c.refreshIfDue(ctx, kid)
+			c.fetchMu.Unlock()
+			k, ok, _ = c.lookup(kid)
+		}
+	}
+
+	if !ok {
+		c.mu.Lock()
+		loaded := c.keys != nil
+		c.mu.Unlock()
+		if !loaded {
+			return nil, fmt.Errorf("no signing keys loaded from %s", c.Source())
+		}
+		return nil, fmt.Errorf("%w: kid %q", ErrUnknownSigningKey, kid)
+	}
+	if k.Alg != "" && k.Alg != alg {
+		return nil, fmt.Errorf("key %q is for %s, token is signed with %s", kid, k.Alg, alg)
+	}
+	return k.Key, nil
+}
+
+// Refresh reloads the key set now
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	return c.refresh(ctx)
+}
+
+// lookup returns the key for kid and whether the set should be re-fetched,
+// because it is stale or doesn't have kid
+func (c *JWKSCache) lookup(kid string) (k jwk, ok, due bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok = c.lookupLocked(kid)
+	return k, ok, c.dueLocked(ok, time.Now())
+}
+
+func (c *JWKSCache) lookupLocked(kid string) (jwk, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, k := range c.keys {
+			return k, true
+		}
+	}
+	k, ok := c.keys[kid]
+	return k, ok
+}
+
+func (c *JWKSCache) dueLocked(found bool, now time.Time) bool {
+	stale := c.keys == nil || now.Sub(c.fetchedAt) > JWKSRefreshInterval
+	return (stale || !found) && now.Sub(c.lastAttempt) > JWKSMinRefreshInterval
+}
+
+// refreshIfDue re-fetches the set unless another caller did so while this
+// one waited for fetchMu. The caller must hold fetchMu.
+func (c *JWKSCache) refreshIfDue(ctx context.Context, kid string) {
+	c.mu.Lock()
+	_, found := c.lookupLocked(kid)
+	due := c.dueLocked(found, time.Now())
+	c.mu.Unlock()
+	if due {
+		_ = c.refresh(ctx)
+	}
+}
+
+// refresh fetches the set and swaps it in. The caller must hold fetchMu.
+func (c *JWKSCache) refresh(ctx context.Context) error {
+	now := time.Now()
+	c.mu.Lock()
+	c.lastAttempt = now
+	c.mu.Unlock()
+
+	data, err := c.load(ctx)
+	if err == nil {
+		var keys map[string]jwk
+		if keys, err = parseJWKS(data); err == nil {
+			c.mu.Lock()
+			c.keys = keys
+			c.fetchedAt = now
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	log.Printf("Warning: failed to load JWKS from %s: %v", c.Source(), err)
+	return err
+}
+
+func (c *JWKSCache) load(ctx context.Context) ([]byte, error) {
+	if c.file != "" {
+		return os.ReadFile(c.file)
+	}
+	ctx, cancel := context.WithTimeout(ctx, JWKSFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+}
+
+// parseJWKS parses a JWK Set document. Keys of unsupported types or meant for
+// encryption are skipped; a set without any usable key is an error.
+func parseJWKS(data []byte) (map[string]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]jwk{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key any
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			key, err = parseECJWK(k.Crv, k.X, k.Y)
+		case "OKP":
+			key, err = parseOKPJWK(k.Crv, k.X)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = jwk{Key: key, Alg: k.Alg}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no signing keys")
+	}
+	return keys, nil
+}
+
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("modulus: %w", err)
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("exponent: %w", err)
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if len(nb) < 2048/8 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported RSA key size or exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func parseECJWK(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("x: %w", err)
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, fmt.Errorf("y: %w", err)
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if _, err := key.ECDH(); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return key, nil
+}
+
+func parseOKPJWK(crv, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil || len(xb) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	return ed25519.PublicKey(xb), nil
+}
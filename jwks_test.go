@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJWKSServer serves a JWK Set that tests can swap out, and counts fetches
+type testJWKSServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches int
+	block   chan struct{} // if set, fetches wait until it is closed
+	started chan struct{} // if set, receives once per blocked fetch
+}
+
+func newTestJWKSServer(t *testing.T, keys ...map[string]string) *testJWKSServer {
+	t.Helper()
+	s := &testJWKSServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.fetches++
+		block, started := s.block, s.started
+		set := map[string]any{"keys": s.keys}
+		s.mu.Unlock()
+		if block != nil {
+			started <- struct{}{}
+			<-block
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testJWKSServer) setKeys(keys ...map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *testJWKSServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC", "kid": kid, "use": "sig", "alg": "ES256", "crv": "P-256",
+		"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// expireLastAttempt lets the next lookup of an unknown kid re-fetch the set
+// without waiting for JWKSMinRefreshInterval
+func expireLastAttempt(c *JWKSCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastAttempt = time.Now().Add(-2 * JWKSMinRefreshInterval)
+}
+
+func TestJWKSCacheKeyRotation(t *testing.T) {
+	oldKey, newKey := newRSAKey(t), newRSAKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("old", oldKey))
+	cache := NewJWKSCacheFromURL(srv.URL, nil)
+	ctx := context.Background()
+
+	if _, err := cache.Key(ctx, "old", "RS256"); err != nil {
+		t.Fatalf("Key(old): %v", err)
+	}
+	srv.setKeys(rsaJWK("new", newKey))
+
+	// Right after a fetch an unknown kid doesn't hit the endpoint again
+	if _, err := cache.Key(ctx, "new", "RS256"); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Fatalf("Key(new) before JWKSMinRefreshInterval: got %v, want ErrUnknownSigningKey", err)
+	}
+	if n := srv.fetchCount(); n != 1 {
+		t.Fatalf("fetches = %d, want 1", n)
+	}
+
+	expireLastAttempt(cache)
+	got, err := cache.Key(ctx, "new", "RS256")
+	if err != nil {
+		t.Fatalf("Key(new) after rotation: %v", err)
+	}
+	if pub, ok := got.(*rsa.PublicKey); !ok || pub.N.Cmp(newKey.N) != 0 {
+		t.Fatalf("Key(new) returned the wrong key")
+	}
+	if n := srv.fetchCount(); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+	if _, err := cache.Key(ctx, "new", "ES256"); err == nil {
+		t.Fatalf("Key(new) accepted a key for another algorithm")
+	}
+}
+
+func TestJWKSCacheKeyDoesNotWaitForFetch(t *testing.T) {
+	key := newRSAKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("known", key))
+	cache := NewJWKSCacheFromURL(srv.URL, nil)
+	ctx := context.Background()
+	if _, err := cache.Key(ctx, "known", "RS256"); err != nil {
+		t.Fatalf("Key(known): %v", err)
+	}
+
+	block, started := make(chan struct{}), make(chan struct{}, 1)
+	srv.mu.Lock()
+	srv.block, srv.started = block, started
+	srv.mu.Unlock()
+	expireLastAttempt(cache)
+
+	// An unknown kid starts a fetch that hangs until block is closed
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := cache.Key(ctx, "unknown", "RS256")
+		fetched <- err
+	}()
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.Key(ctx, "known", "RS256")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Key(known) during a fetch: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Key(known) waited for the fetch of another kid")
+	}
+
+	close(block)
+	if err := <-fetched; !errors.Is(err, ErrUnknownSigningKey) {
+		t.Fatalf("Key(unknown): got %v, want ErrUnknownSigningKey", err)
+	}
+}
+
+func TestJWKSCacheKeepsKeysWhenRefreshFails(t *testing.T) {
+	key := newRSAKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("k", key))
+	cache := NewJWKSCacheFromURL(srv.URL, nil)
+	ctx := context.Background()
+	if _, err := cache.Key(ctx, "k", "RS256"); err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+
+	srv.setKeys()
+	if err := cache.Refresh(ctx); err == nil {
+		t.Fatal("Refresh accepted a set without keys")
+	}
+	if _, err := cache.Key(ctx, "k", "RS256"); err != nil {
+		t.Fatalf("Key after a failed refresh: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// LLMProvider generates a plushie's reply from a chat transcript.
+// The first message is the system prompt, followed by alternating user/assistant turns.
+type LLMProvider interface {
+	// Chat returns the full reply once the model has finished
+	Chat(ctx context.Context, messages []ChatMessage) (string, error)
+	// ChatStream calls onDelta for each fragment of the reply as it is generated
+	// and returns the full reply at the end. Cancelling ctx aborts the upstream request.
+	ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(string) error) (string, error)
+}
+
+// Supported values for LLM_PROVIDER
+const (
+	LLMProviderOpenAI           = "openai"
+	LLMProviderOpenAICompatible = "openai-compatible"
+	LLMProviderAnthropic        = "anthropic"
+	LLMProviderFake             = "fake"
+)
+
+// LLM defaults
+const (
+	DefaultLLMMaxTokens     = 100
+	DefaultLLMTimeout       = 30 * time.Second
+	DefaultOpenAIBaseURL    = "https://api.openai.com/v1"
+	DefaultOpenAIModel      = "gpt-4o-mini"
+	DefaultAnthropicBaseURL = "https://api.anthropic.com"
+	DefaultAnthropicModel   = "claude-3-5-haiku-latest"
+)
+
+// LLMConfig selects and configures an LLM provider; see Config for how it is loaded
+type LLMConfig struct {
+	Provider  string `yaml:"provider"`   // openai, openai-compatible, anthropic or fake
+	BaseURL   string `yaml:"base_url"`   // required for openai-compatible, e.g. http://localhost:11434/v1
+	APIKey    string `yaml:"api_key"`    // not needed by most local servers
+	Model     string `yaml:"model"`      // required for openai-compatible
+	MaxTokens int    `yaml:"max_tokens"` // maximum reply length
+}
+
+// NewLLMProvider builds the provider described by cfg
+func NewLLMProvider(cfg LLMConfig) (LLMProvider, error) {
+	switch cfg.Provider {
+	case LLMProviderOpenAI:
+		if cfg.APIKey == "" {
+			return nil, fmt.Errorf("%s: API key not configured (set OPENAI_API_KEY or LLM_API_KEY)", cfg.Provider)
+		}
+		return newOpenAIProvider(orDefault(cfg.BaseURL, DefaultOpenAIBaseURL), cfg.APIKey, orDefault(cfg.Model, DefaultOpenAIModel), cfg.MaxTokens), nil
+	case LLMProviderOpenAICompatible:
+		// Local servers such as llama.cpp or Ollama usually don't need an API key
+		if cfg.BaseURL == "" || cfg.Model == "" {
+			return nil, fmt.Errorf("%s: LLM_BASE_URL and LLM_MODEL are required", cfg.Provider)
+		}
+		return newOpenAIProvider(cfg.BaseURL, cfg.APIKey, cfg.Model, cfg.MaxTokens), nil
+	case LLMProviderAnthropic:
+		if cfg.APIKey == "" {
+			return nil, fmt.Errorf("%s: API key not configured (set ANTHROPIC_API_KEY or LLM_API_KEY)", cfg.Provider)
+		}
+		return newAnthropicProvider(orDefault(cfg.BaseURL, DefaultAnthropicBaseURL), cfg.APIKey, orDefault(cfg.Model, DefaultAnthropicModel), cfg.MaxTokens), nil
+	case LLMProviderFake:
+		return FakeLLMProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", cfg.Provider)
+	}
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// FakeLLMProvider returns canned, deterministic replies without calling any API.
+// Useful for tests and offline demos.
+type FakeLLMProvider struct{}
+
+func (FakeLLMProvider) reply(messages []ChatMessage) string {
+	last := ""
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == RoleUser {
+			last = messages[i].Content
+			break
+		}
+	}
+	return fmt.Sprintf("「%s」だね。お話ししてくれてうれしいな！", last)
+}
+
+func (f FakeLLMProvider) Chat(ctx context.Context, messages []ChatMessage) (string, error) {
+	return f.reply(messages), ctx.Err()
+}
+
+func (f FakeLLMProvider) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(string) error) (string, error) {
+	reply := []rune(f.reply(messages))
+	const chunkSize = 4
+	for i := 0; i < len(reply); i += chunkSize {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if err := onDelta(string(reply[i:min(i+chunkSize, len(reply))])); err != nil {
+			return "", err
+		}
+	}
+	return string(reply), nil
+}
+
+// readSSE reads a text/event-stream body and calls onEvent for each event.
+// Returning done=true from onEvent stops reading.
+func readSSE(body io.Reader, onEvent func(event, data string) (done bool, err error)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				done, err := onEvent(event, strings.Join(data, "\n"))
+				if err != nil || done {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const anthropicAPIVersion = "2023-06-01"
+
+// anthropicProvider talks to the Anthropic Messages API
+type anthropicProvider struct {
+	BaseURL   string
+	APIKey    string
+	Model     string
+	MaxTokens int
+	client    *http.Client
+}
+
+func newAnthropicProvider(baseURL, apiKey, model string, maxTokens int) *anthropicProvider {
+	return &anthropicProvider{
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		APIKey:    apiKey,
+		Model:     model,
+		MaxTokens: maxTokens,
+		client:    &http.Client{},
+	}
+}
+
+// toAnthropicMessages moves system messages into the separate system field and
+// merges consecutive turns from the same role, since the Messages API expects
+// the conversation to start with a user turn and alternate from there.
+func toAnthropicMessages(messages []ChatMessage) (string, []ChatMessage) {
+	var system []string
+	var out []ChatMessage
+	for _, m := range messages {
+		if m.Role == RoleSystem {
+			system = append(system, m.Content)
+			continue
+		}
+		if len(out) == 0 && m.Role != RoleUser {
+			out = append(out, ChatMessage{Role: RoleUser, Content: "…"})
+		}
+		if len(out) > 0 && out[len(out)-1].Role == m.Role {
+			out[len(out)-1].Content += "\n\n" + m.Content
+			continue
+		}
+		out = append(out, m)
+	}
+	return strings.Join(system, "\n\n"), out
+}
+
+func (p *anthropicProvider) newRequest(ctx context.Context, messages []ChatMessage, stream bool) (*http.Request, error) {
+	type Request struct {
+		Model     string        `json:"model"`
+		System    string        `json:"system,omitempty"`
+		Messages  []ChatMessage `json:"messages"`
+		MaxTokens int           `json:"max_tokens"`
+		Stream    bool          `json:"stream,omitempty"`
+	}
+
+	system, turns := toAnthropicMessages(messages)
+	jsonData, err := json.Marshal(Request{
+		Model:     p.Model,
+		System:    system,
+		Messages:  turns,
+		MaxTokens: p.MaxTokens,
+		Stream:    stream,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.BaseURL+"/v1/messages", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", p.APIKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+	return req, nil
+}
+
+func (p *anthropicProvider) Chat(ctx context.Context, messages []ChatMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultLLMTimeout)
+	defer cancel()
+
+	req, err := p.newRequest(ctx, messages, false)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call Anthropic API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("Anthropic API error: %d - %s", resp.StatusCode, string(body))
+	}
+
+	type Response struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+
+	var apiResp Response
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	var reply strings.Builder
+	for _, c := range apiResp.Content {
+		if c.Type == "text" {
+			reply.WriteString(c.Text)
+		}
+	}
+	if reply.Len() == 0 {
+		return "", fmt.Errorf("no text in response")
+	}
+	return reply.String(), nil
+}
+
+func (p *anthropicProvider) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(string) error) (string, error) {
+	req, err := p.newRequest(ctx, messages, true)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call Anthropic API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("Anthropic API error: %d - %s", resp.StatusCode, string(body))
+	}
+
+	type Event struct {
+		Delta struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"delta"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	var reply strings.Builder
+	err = readSSE(resp.Body, func(event, data string) (bool, error) {
+		switch event {
+		case "message_stop":
+			return true, nil
+		case "error":
+			var ev Event
+			_ = json.Unmarshal([]byte(data), &ev)
+			return false, fmt.Errorf("Anthropic API stream error: %s", ev.Error.Message)
+		case "content_block_delta":
+			var ev Event
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				return false, fmt.Errorf("failed to decode stream event: %w", err)
+			}
+			if ev.Delta.Type != "text_delta" || ev.Delta.Text == "" {
+				return false, nil
+			}
+			reply.WriteString(ev.Delta.Text)
+			return false, onDelta(ev.Delta.Text)
+		}
+		return false, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	return reply.String(), nil
+}
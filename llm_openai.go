@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// openAIProvider talks to the OpenAI chat completions API or any server that
+// implements it (llama.cpp, Ollama, vLLM, ...)
+type openAIProvider struct {
+	BaseURL   string
+	APIKey    string
+	Model     string
+	MaxTokens int
+	client    *http.Client
+}
+
+func newOpenAIProvider(baseURL, apiKey, model string, maxTokens int) *openAIProvider {
+	return &openAIProvider{
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		APIKey:    apiKey,
+		Model:     model,
+		MaxTokens: maxTokens,
+		client:    &http.Client{},
+	}
+}
+
+func (p *openAIProvider) newRequest(ctx context.Context, messages []ChatMessage, stream bool) (*http.Request, error) {
+	type Request struct {
+		Model     string        `json:"model"`
+		Messages  []ChatMessage `json:"messages"`
+		MaxTokens int           `json:"max_tokens"`
+		Stream    bool          `json:"stream,omitempty"`
+	}
+
+	jsonData, err := json.Marshal(Request{
+		Model:     p.Model,
+		Messages:  messages,
+		MaxTokens: p.MaxTokens,
+		Stream:    stream,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.BaseURL+"/chat/completions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+	return req, nil
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, messages []ChatMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultLLMTimeout)
+	defer cancel()
+
+	req, err := p.newRequest(ctx, messages, false)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call OpenAI API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("OpenAI API error: %d - %s", resp.StatusCode, string(body))
+	}
+
+	type Choice struct {
+		Message ChatMessage `json:"message"`
+	}
+	type Response struct {
+		Choices []Choice `json:"choices"`
+	}
+
+	var apiResp Response
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(apiResp.Choices) == 0 {
+		return "", fmt.Errorf("no choices in response")
+	}
+
+	return apiResp.Choices[0].Message.Content, nil
+}
+
+func (p *openAIProvider) ChatStream(ctx context.Context, messages []ChatMessage, onDelta func(string) error) (string, error) {
+	req, err := p.newRequest(ctx, messages, true)
+	if err != nil {
+		return "", err
+	}
+
+	// No client timeout: the stream is bounded by the request context instead
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call OpenAI API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("OpenAI API error: %d - %s", resp.StatusCode, string(body))
+	}
+
+	type Chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+
+	var reply strings.Builder
+	err = readSSE(resp.Body, func(_, data string) (bool, error) {
+		if data == "[DONE]" {
+			return true, nil
+		}
+		var chunk Chunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return false, fmt.Errorf("failed to decode stream chunk: %w", err)
+		}
+		for _, c := range chunk.Choices {
+			if c.Delta.Content == "" {
+				continue
+			}
+			reply.WriteString(c.Delta.Content)
+			if err := onDelta(c.Delta.Content); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	return reply.String(), nil
+}
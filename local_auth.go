@@ -0,0 +1,671 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported values for AUTH_MODE
+const (
+	AuthModeSupabase = "supabase" // tokens are issued by a Supabase project
+	AuthModeLocal    = "local"    // tokens are issued by this server, see LocalAuth
+)
+
+// Local identity provider settings
+const (
+	DefaultAccessTokenTTL     = time.Hour
+	DefaultRefreshTokenTTL    = 30 * 24 * time.Hour // sessions expire after this long without a refresh
+	PasswordResetTokenTTL     = time.Hour
+	RefreshTokenReuseInterval = 10 * time.Second // a refresh token may be reused this long, e.g. by two tabs refreshing at once
+	MinPasswordLength         = 8
+	MinLocalAuthSecretLength  = 32
+	LocalAuthIssuer           = "poppo"
+)
+
+// LocalAuthConfig configures the built-in identity provider; see Config for how it is loaded
+type LocalAuthConfig struct {
+	JWTSecret       string        `yaml:"jwt_secret"` // signs access tokens, at least 32 bytes
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	LogResetCodes   bool          `yaml:"log_reset_codes"` // writes password reset codes to the log; development only
+}
+
+// ResetCodeSender delivers a password reset code to the user, e.g. by mail
+type ResetCodeSender func(ctx context.Context, email, code string, expiresAt time.Time) error
+
+// LocalAuth is a built-in identity provider for running without Supabase.
+//
+// It implements the subset of the Supabase Auth (GoTrue) API that supabase-js
+// uses under /auth/v1, so the frontend only needs VITE_SUPABASE_URL pointed at
+// this server. Access tokens are HS256 JWTs with the same claims as Supabase's
+// (sub is the user's UUID), so the rest of the API can't tell the difference.
+// Refresh tokens are opaque, rotate on every use and are stored hashed.
+type LocalAuth struct {
+	DB       *sql.DB
+	Config   LocalAuthConfig
+	MaxUsers int
+
+	// SendResetCode delivers password reset codes. If nil, codes are issued
+	// but can't reach the user.
+	SendResetCode ResetCodeSender
+}
+
+func NewLocalAuth(db *sql.DB, cfg *Config) *LocalAuth {
+	l := &LocalAuth{DB: db, Config: cfg.LocalAuth, MaxUsers: cfg.MaxUsers}
+	if cfg.LocalAuth.LogResetCodes {
+		l.SendResetCode = logResetCode
+	}
+	return l
+}
+
+// logResetCode is the ResetCodeSender for local_auth.log_reset_codes.
+// Anyone who can read the log can take over the account, so it is only for
+// development.
+func logResetCode(ctx context.Context, email, code string, expiresAt time.Time) error {
+	log.Printf("Password reset code for %s (valid until %s): %s", email, expiresAt.Format(time.RFC3339), code)
+	return nil
+}
+
+// Verifier returns a SupabaseAuth that accepts the access tokens issued by l
+// and rejects them once their session has been revoked
+func (l *LocalAuth) Verifier() *SupabaseAuth {
+	return &SupabaseAuth{
+		JWTSecret:     l.Config.JWTSecret,
+		Issuer:        LocalAuthIssuer,
+		Audience:      DefaultSupabaseJWTAudience,
+		SessionActive: l.sessionActive,
+	}
+}
+
+func (l *LocalAuth) sessionActive(sessionID string) (bool, error) {
+	var exists int
+	err := l.DB.QueryRow(`
+		SELECT 1 FROM auth_sessions
+		WHERE id = ? AND revoked_at IS NULL AND expires_at > ?
+	`, sessionID, time.Now().UTC()).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// authUser is a user in the shape Supabase Auth returns it
+type authUser struct {
+	ID               string         `json:"id"`
+	Aud              string         `json:"aud"`
+	Role             string         `json:"role"`
+	Email            string         `json:"email"`
+	EmailConfirmedAt time.Time      `json:"email_confirmed_at"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+	AppMetadata      map[string]any `json:"app_metadata"`
+	UserMetadata     map[string]any `json:"user_metadata"`
+}
+
+// authSession is a token response in the shape Supabase Auth returns it
+type authSession struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresIn    int       `json:"expires_in"`
+	ExpiresAt    int64     `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	User         *authUser `json:"user"`
+}
+
+func newAuthUser(id, email string, createdAt time.Time) *authUser {
+	return &authUser{
+		ID:               id,
+		Aud:              DefaultSupabaseJWTAudience,
+		Role:             DefaultSupabaseJWTAudience,
+		Email:            email,
+		EmailConfirmedAt: createdAt,
+		CreatedAt:        createdAt,
+		UpdatedAt:        createdAt,
+		AppMetadata:      map[string]any{"provider": "email", "providers": []string{"email"}},
+		UserMetadata:     map[string]any{},
+	}
+}
+
+// loadAuthUser loads a user by UUID
+func (l *LocalAuth) loadAuthUser(ctx context.Context, userID string) (*authUser, error) {
+	var email string
+	var createdAt time.Time
+	err := l.DB.QueryRowContext(ctx, `SELECT email, created_at FROM users WHERE supabase_user_id = ?`, userID).Scan(&email, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return newAuthUser(userID, email, createdAt), nil
+}
+
+// randomToken returns a URL-safe random token and the hash to store for it
+func randomToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// accessToken signs an access token for a user's session
+func (l *LocalAuth) accessToken(user *authUser, sessionID string, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(l.Config.AccessTokenTTL)
+	claims := &SupabaseClaims{
+		Email:     user.Email,
+		Role:      user.Role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    LocalAuthIssuer,
+			Subject:   user.ID,
+			Audience:  jwt.ClaimStrings{DefaultSupabaseJWTAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(l.Config.JWTSecret))
+	return token, expiresAt, err
+}
+
+// issueTokens stores a new refresh token for the session and returns it with a fresh access token
+func (l *LocalAuth) issueTokens(tx *sql.Tx, user *authUser, sessionID string, now time.Time) (*authSession, error) {
+	refresh, refreshHash, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO auth_refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)
+	`, refreshHash, sessionID, now); err != nil {
+		return nil, err
+	}
+	access, expiresAt, err := l.accessToken(user, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+	return &authSession{
+		AccessToken:  access,
+		TokenType:    "bearer",
+		ExpiresIn:    int(l.Config.AccessTokenTTL.Seconds()),
+		ExpiresAt:    expiresAt.Unix(),
+		RefreshToken: refresh,
+		User:         user,
+	}, nil
+}
+
+// startSession signs a user in, creating a new session
+func (l *LocalAuth) startSession(tx *sql.Tx, user *authUser) (*authSession, error) {
+	now := time.Now().UTC()
+	sessionID := uuid.NewString()
+	if _, err := tx.Exec(`
+		INSERT INTO auth_sessions (id, user_id, created_at, refreshed_at, expires_at) VALUES (?, ?, ?, ?, ?)
+	`, sessionID, user.ID, now, now, now.Add(l.Config.RefreshTokenTTL)); err != nil {
+		return nil, err
+	}
+	return l.issueTokens(tx, user, sessionID, now)
+}
+
+// errInvalidRefreshToken is returned by refresh for unknown, expired, revoked or replayed tokens
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// refresh exchanges a refresh token for a new token pair.
+// Reusing an already rotated token after RefreshTokenReuseInterval is treated as
+// theft and revokes the whole session.
+func (l *LocalAuth) refresh(ctx context.Context, token string) (*authSession, error) {
+	tx, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sessionID, userID string
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+		SELECT s.id, s.user_id, rt.used_at, s.revoked_at, s.expires_at
+		FROM auth_refresh_tokens rt
+		JOIN auth_sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = ?
+	`, hashToken(token)).Scan(&sessionID, &userID, &usedAt, &revokedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if revokedAt.Valid || !now.Before(expiresAt) {
+		return nil, errInvalidRefreshToken
+	}
+	if usedAt.Valid && now.Sub(usedAt.Time) > RefreshTokenReuseInterval {
+		log.Printf("Warning: refresh token of session %s was reused; revoking the session", sessionID)
+		if _, err := tx.Exec(`UPDATE auth_sessions SET revoked_at = ? WHERE id = ?`, now, sessionID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidRefreshToken
+	}
+
+	if !usedAt.Valid {
+		if _, err := tx.Exec(`UPDATE auth_refresh_tokens SET used_at = ? WHERE token_hash = ?`, now, hashToken(token)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(`
+		UPDATE auth_sessions SET refreshed_at = ?, expires_at = ? WHERE id = ?
+	`, now, now.Add(l.Config.RefreshTokenTTL), sessionID); err != nil {
+		return nil, err
+	}
+
+	user, err := l.loadAuthUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	session, err := l.issueTokens(tx, user, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+	return session, tx.Commit()
+}
+
+// localAuthClaims verifies the access token in the Authorization header
+func (a *App) localAuthClaims(r *http.Request) (*SupabaseClaims, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, errors.New("no valid token found")
+	}
+	return a.SupabaseAuth.ParseToken(token)
+}
+
+type credentialsRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (c *credentialsRequest) normalize() {
+	c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+}
+
+func validatePassword(password string) string {
+	if len(password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	return ""
+}
+
+// HandleAuthSignup registers a user and signs them in (POST /auth/v1/signup).
+// Registration is closed once MAX_USERS users exist.
+func (a *App) HandleAuthSignup(w http.ResponseWriter, r *http.Request) {
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	req.normalize()
+	if req.Email == "" || req.Password == "" {
+		respondError(w, http.StatusBadRequest, ErrEmailPasswordRequired)
+		return
+	}
+	if !strings.Contains(req.Email, "@") {
+		respondError(w, http.StatusBadRequest, ErrInvalidEmail)
+		return
+	}
+	if msg := validatePassword(req.Password); msg != "" {
+		respondError(w, http.StatusUnprocessableEntity, msg)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSignUp)
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSignUp)
+		return
+	}
+	defer tx.Rollback()
+
+	// Count and insert in one statement so concurrent sign-ups can't exceed the limit
+	user := newAuthUser(uuid.NewString(), req.Email, time.Now().UTC())
+	res, err := tx.Exec(`
+		INSERT INTO users (email, password_hash, supabase_user_id, created_at)
+		SELECT ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM users) < ?
+	`, user.Email, string(hashed), user.ID, user.CreatedAt, a.LocalAuth.MaxUsers)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			respondError(w, http.StatusUnprocessableEntity, ErrEmailAlreadyRegistered)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSignUp)
+		}
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(w, http.StatusForbidden, fmt.Sprintf(ErrMaxUsersReached, a.LocalAuth.MaxUsers))
+		return
+	}
+
+	session, err := a.LocalAuth.startSession(tx, user)
+	if err != nil || tx.Commit() != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSignUp)
+		return
+	}
+	respondJSON(w, http.StatusOK, session)
+}
+
+// dummyPasswordHash is compared against when the email is unknown, so the
+// response time doesn't reveal which addresses are registered
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// HandleAuthToken signs in with a password or exchanges a refresh token
+// (POST /auth/v1/token?grant_type=password|refresh_token)
+func (a *App) HandleAuthToken(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("grant_type") {
+	case "password":
+		a.handlePasswordGrant(w, r)
+	case "refresh_token":
+		a.handleRefreshGrant(w, r)
+	default:
+		respondError(w, http.StatusBadRequest, ErrUnsupportedGrantType)
+	}
+}
+
+func (a *App) handlePasswordGrant(w http.ResponseWriter, r *http.Request) {
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	req.normalize()
+
+	var userID, hashed string
+	var createdAt time.Time
+	err := a.DB.QueryRowContext(r.Context(), `
+		SELECT supabase_user_id, password_hash, created_at FROM users WHERE lower(email) = ?
+	`, req.Email).Scan(&userID, &hashed, &createdAt)
+	if err != nil {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		respondError(w, http.StatusBadRequest, ErrInvalidCredentials)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(req.Password)) != nil {
+		respondError(w, http.StatusBadRequest, ErrInvalidCredentials)
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrAuthFailed)
+		return
+	}
+	defer tx.Rollback()
+	session, err := a.LocalAuth.startSession(tx, newAuthUser(userID, req.Email, createdAt))
+	if err != nil || tx.Commit() != nil {
+		respondError(w, http.StatusInternalServerError, ErrAuthFailed)
+		return
+	}
+	respondJSON(w, http.StatusOK, session)
+}
+
+func (a *App) handleRefreshGrant(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	session, err := a.LocalAuth.refresh(r.Context(), req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) {
+			respondError(w, http.StatusBadRequest, ErrInvalidRefreshToken)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrAuthFailed)
+		}
+		return
+	}
+	respondJSON(w, http.StatusOK, session)
+}
+
+// HandleAuthUser returns the signed-in user (GET /auth/v1/user)
+func (a *App) HandleAuthUser(w http.ResponseWriter, r *http.Request) {
+	claims, err := a.localAuthClaims(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	user, err := a.LocalAuth.loadAuthUser(r.Context(), claims.Subject)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrUserNotFound)
+		return
+	}
+	respondJSON(w, http.StatusOK, user)
+}
+
+// HandleAuthUpdateUser changes the signed-in user's password (PUT /auth/v1/user).
+// All of the user's other sessions are signed out.
+func (a *App) HandleAuthUpdateUser(w http.ResponseWriter, r *http.Request) {
+	claims, err := a.localAuthClaims(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if req.Password != "" {
+		if msg := validatePassword(req.Password); msg != "" {
+			respondError(w, http.StatusUnprocessableEntity, msg)
+			return
+		}
+		hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePassword)
+			return
+		}
+		tx, err := a.DB.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePassword)
+			return
+		}
+		defer tx.Rollback()
+		now := time.Now().UTC()
+		if _, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE supabase_user_id = ?`, string(hashed), claims.Subject); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePassword)
+			return
+		}
+		if _, err := tx.Exec(`
+			UPDATE auth_sessions SET revoked_at = ?
+			WHERE user_id = ? AND id != ? AND revoked_at IS NULL
+		`, now, claims.Subject, claims.SessionID); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePassword)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePassword)
+			return
+		}
+	}
+	a.HandleAuthUser(w, r)
+}
+
+// HandleAuthLogout revokes sessions (POST /auth/v1/logout?scope=global|local|others).
+// global (the default) signs the user out everywhere, local only this session,
+// others every session but this one.
+func (a *App) HandleAuthLogout(w http.ResponseWriter, r *http.Request) {
+	claims, err := a.localAuthClaims(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	query := `UPDATE auth_sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`
+	args := []any{time.Now().UTC(), claims.Subject}
+	switch r.URL.Query().Get("scope") {
+	case "", "global":
+	case "local":
+		query += ` AND id = ?`
+		args = append(args, claims.SessionID)
+	case "others":
+		query += ` AND id != ?`
+		args = append(args, claims.SessionID)
+	default:
+		respondError(w, http.StatusBadRequest, ErrInvalidLogoutScope)
+		return
+	}
+	if _, err := a.DB.ExecContext(r.Context(), query, args...); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToLogout)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAuthRecover starts a password reset (POST /auth/v1/recover).
+// The one-time code goes to LocalAuth.SendResetCode; only the fact that a
+// code was issued is logged. The response is the same whether or not the
+// address is registered.
+func (a *App) HandleAuthRecover(w http.ResponseWriter, r *http.Request) {
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	req.normalize()
+
+	var userID string
+	err := a.DB.QueryRowContext(r.Context(), `SELECT supabase_user_id FROM users WHERE lower(email) = ?`, req.Email).Scan(&userID)
+	if err == nil {
+		if err := a.createPasswordResetToken(r.Context(), userID, req.Email); err != nil {
+			log.Printf("API Error [recover]: %v", err)
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]any{})
+}
+
+func (a *App) createPasswordResetToken(ctx context.Context, userID, email string) error {
+	token, hash, err := randomToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(PasswordResetTokenTTL)
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Only the most recent code is valid
+	if _, err := tx.Exec(`DELETE FROM password_reset_tokens WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO password_reset_tokens (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)
+	`, hash, userID, now, expiresAt); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	send := a.LocalAuth.SendResetCode
+	if send == nil {
+		log.Printf("Password reset code issued for user %s, but no way to deliver it is configured (see local_auth.log_reset_codes)", userID)
+		return nil
+	}
+	log.Printf("Password reset code issued for user %s (valid until %s)", userID, expiresAt.Format(time.RFC3339))
+	return send(ctx, email, token, expiresAt)
+}
+
+// HandleAuthVerify redeems a password reset code and signs the user in
+// (POST /auth/v1/verify with {"type": "recovery", "email": ..., "token": ...}).
+// The client then sets a new password with PUT /auth/v1/user.
+func (a *App) HandleAuthVerify(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type  string `json:"type"`
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if req.Type != "recovery" {
+		respondError(w, http.StatusBadRequest, ErrInvalidResetToken)
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrAuthFailed)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var userID string
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		SELECT u.supabase_user_id, u.created_at
+		FROM password_reset_tokens t
+		JOIN users u ON u.supabase_user_id = t.user_id
+		WHERE t.token_hash = ? AND lower(u.email) = ? AND t.used_at IS NULL AND t.expires_at > ?
+	`, hashToken(req.Token), email, now).Scan(&userID, &createdAt)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrInvalidResetToken)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE password_reset_tokens SET used_at = ? WHERE token_hash = ?`, now, hashToken(req.Token)); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrAuthFailed)
+		return
+	}
+	session, err := a.LocalAuth.startSession(tx, newAuthUser(userID, email, createdAt))
+	if err != nil || tx.Commit() != nil {
+		respondError(w, http.StatusInternalServerError, ErrAuthFailed)
+		return
+	}
+	respondJSON(w, http.StatusOK, session)
+}
+
+// Sweep deletes expired and signed-out sessions and spent or expired reset codes
+func (l *LocalAuth) Sweep(ctx context.Context) error {
+	now := time.Now().UTC()
+	if _, err := l.DB.ExecContext(ctx, `
+		DELETE FROM auth_sessions WHERE expires_at <= ? OR revoked_at IS NOT NULL
+	`, now); err != nil {
+		return err
+	}
+	_, err := l.DB.ExecContext(ctx, `
+		DELETE FROM password_reset_tokens WHERE expires_at <= ? OR used_at IS NOT NULL
+	`, now)
+	return err
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/cors"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -17,68 +18,107 @@ func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Warning: Error loading .env file: %v", err)
 	}
-	if err := os.MkdirAll(UploadsDir, 0o755); err != nil {
-		log.Fatalf("failed to create uploads dir: %v", err)
+
+	cfg, opts, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("failed to print config: %v", err)
+		}
+		return
+	}
+	if cfg.AuthMode == AuthModeSupabase && cfg.SupabaseJWTSecret == "" && cfg.SupabaseJWKSURL == "" && cfg.SupabaseJWKSFile == "" {
+		log.Printf("Warning: none of SUPABASE_JWT_SECRET, SUPABASE_URL or SUPABASE_JWKS_URL is set; authenticated requests will fail")
 	}
 
-	db, err := sql.Open("sqlite3", DBPath+"?_foreign_keys=on")
+	db, err := sql.Open("sqlite3", cfg.DBPath+"?_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
 		log.Fatalf("failed to open database: %v", err)
 	}
 	defer db.Close()
 
+	if opts.MigrateTo >= 0 {
+		if err := migrateTo(db, opts.MigrateTo); err != nil {
+			log.Fatalf("failed to migrate database: %v", err)
+		}
+		log.Printf("Database schema migrated to version %d", opts.MigrateTo)
+		return
+	}
+
 	if err := migrate(db); err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
+	if err := ensureSearchIndex(db); err != nil {
+		log.Fatalf("failed to set up search: %v", err)
+	}
 
-	sessionStore := NewSessionStore()
-	app := &App{
-		DB:           db,
-		SessionStore: sessionStore,
+	blobs, err := NewBlobStore(cfg.Storage, cfg.UploadsDir)
+	if err != nil {
+		log.Fatalf("failed to set up image storage: %v", err)
 	}
 
-	r := chi.NewRouter()
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173", "http://127.0.0.1:5173"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	if opts.GCImages {
+		report, err := gcBlobs(context.Background(), db, blobs, opts.GCDelete, os.Stdout)
+		if err != nil {
+			log.Fatalf("image garbage collection failed: %v", err)
+		}
+		log.Printf("Scanned %d images: %d unreferenced (%d bytes), %d deleted, %d skipped as too recent",
+			report.Scanned, report.Orphaned, report.OrphanedSize, report.Deleted, report.Skipped)
+		if !opts.GCDelete && report.Orphaned > 0 {
+			log.Printf("Run again with -gc-delete to delete them")
+		}
+		return
+	}
 
-	r.Route("/api", func(r chi.Router) {
-		r.Post("/register", app.HandleRegister)
-		r.Post("/login", app.HandleLogin)
-		r.Post("/logout", app.HandleLogout)
+	llm, err := NewLLMProvider(cfg.LLM)
+	if err != nil {
+		log.Printf("Warning: chat is disabled: %v", err)
+	}
 
-		r.Group(func(r chi.Router) {
-			r.Use(app.AuthMiddleware)
-			r.Get("/me", app.HandleMe)
+	if cfg.ImageURLSecret == "" {
+		log.Printf("Warning: IMAGE_URL_SECRET is not set; image URLs will stop working when the server restarts")
+	}
+	imageURLs, err := NewImageURLSigner(cfg.ImageURLSecret, cfg.ImageURLTTL)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-			r.Get("/plushies", app.HandleListPlushies)
-			r.Post("/plushies", app.HandleCreatePlushie)
-			r.Get("/plushies/{id}", app.HandleGetPlushie)
-			r.Put("/plushies/{id}", app.HandleUpdatePlushie)
-			r.Put("/plushies/{id}/conversation", app.HandleUpdateConversation)
-			r.Post("/plushies/{id}/chat", app.HandleChat)
-			r.Delete("/plushies/{id}", app.HandleDeletePlushie)
-		})
-	})
+	sessionStore := NewSessionStore(db)
+	app := &App{
+		Config:       cfg,
+		DB:           db,
+		SessionStore: sessionStore,
+		LLM:          llm,
+		Blobs:        blobs,
+		ImageURLs:    imageURLs,
+		SupabaseAuth: NewSupabaseAuthFromConfig(cfg),
+	}
+	if cfg.AuthMode == AuthModeLocal {
+		app.LocalAuth = NewLocalAuth(db, cfg)
+		app.SupabaseAuth = app.LocalAuth.Verifier()
+		log.Printf("Using the built-in identity provider at /auth/v1")
+		if cfg.LocalAuth.LogResetCodes {
+			log.Printf("Warning: LOCAL_AUTH_LOG_RESET_CODES is set; password reset codes are written to the log. Do not use this in production")
+		}
+	}
 
-	// serve uploaded images
-	fileServer := http.StripPrefix("/uploads/", http.FileServer(http.Dir(UploadsDir)))
-	r.Handle("/uploads/*", fileServer)
+	go app.RunBlobDeletionWorker(context.Background(), BlobDeletionInterval)
+	go app.RunSessionSweeper(context.Background(), SessionSweepInterval)
+	go app.RunTrashPurger(context.Background(), TrashPurgeInterval)
 
-	addr := DefaultPort
 	srv := &http.Server{
-		Addr:         addr,
-		Handler:      r,
-		ReadTimeout:  DefaultReadTimeout,
-		WriteTimeout: DefaultWriteTimeout,
+		Addr:         cfg.Addr,
+		Handler:      app.routes(),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
 	}
 
-	log.Printf("Server listening on %s", addr)
+	log.Printf("Server listening on %s", cfg.Addr)
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("server error: %v", err)
 	}
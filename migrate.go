@@ -2,131 +2,277 @@ package main
 
 import (
 	"database/sql"
-	"strings"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Migration lock settings. A process waits at least until the lock goes
+// stale, so a lock left by a crashed process is taken over instead of
+// failing startup.
+const (
+	migrationLockTimeout   = 60 * time.Second
+	migrationLockStaleAge  = 10 * time.Minute
+	migrationLockRetryWait = 250 * time.Millisecond
 )
 
-func contains(s, substr string) bool {
-	return strings.Contains(s, substr)
+// migration is a single numbered schema change.
+// Up and Down are each run inside their own transaction.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
 }
 
+var migrations []migration
+
+// registerMigration adds a migration to the registry.
+// Each migration lives in its own migration_NNNN_*.go file and registers itself from init().
+func registerMigration(m migration) {
+	for _, existing := range migrations {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("duplicate migration version %d (%s, %s)", m.Version, existing.Name, m.Name))
+		}
+	}
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+}
+
+// execStatements returns a migration step that executes the given statements in order
+func execStatements(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrate applies all pending migrations
 func migrate(db *sql.DB) error {
-	// users table
-	_, err := db.Exec(`
-CREATE TABLE IF NOT EXISTS users (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	email TEXT NOT NULL UNIQUE,
-	password_hash TEXT NOT NULL,
-	supabase_user_id TEXT UNIQUE,
-	created_at TIMESTAMP NOT NULL
-);
-`)
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	return migrateTo(db, latest)
+}
+
+// migrateTo brings the schema to the target version, applying Up or Down migrations as needed
+func migrateTo(db *sql.DB, target int) error {
+	if err := ensureMigrationTables(db); err != nil {
+		return err
+	}
+
+	release, err := acquireMigrationLock(db)
 	if err != nil {
 		return err
 	}
+	defer release()
 
-	// Add supabase_user_id column if it doesn't exist (for existing databases)
-	// Check if column exists by querying table info
-	var columnExists bool
-	rows, err := db.Query(`PRAGMA table_info(users)`)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var cid int
-			var name, dataType string
-			var notNull, pk int
-			var defaultValue interface{}
-			if err := rows.Scan(&cid, &name, &dataType, &notNull, &defaultValue, &pk); err == nil {
-				if name == "supabase_user_id" {
-					columnExists = true
-					break
-				}
-			}
+	// Re-read applied versions after acquiring the lock; another process may have migrated meanwhile
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version > target || applied[m.Version] {
+			continue
+		}
+		log.Printf("Applying migration %04d_%s", m.Version, m.Name)
+		if err := runMigration(db, m, m.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				m.Version, m.Name, time.Now().UTC(),
+			)
+			return err
+		}); err != nil {
+			return err
 		}
 	}
-	
-	// Add column if it doesn't exist
-	// Note: SQLite doesn't allow adding UNIQUE constraint directly to existing table
-	// So we add the column first, then create a unique index
-	if !columnExists {
-		_, err = db.Exec(`ALTER TABLE users ADD COLUMN supabase_user_id TEXT`)
-		if err != nil {
-			// Log but don't fail - column might have been added concurrently
-			_ = err
-		} else {
-			// Create unique index on supabase_user_id
-			// Ignore error if index already exists
-			_, _ = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_supabase_user_id ON users(supabase_user_id)`)
-		}
-	}
-
-	// plushies table with TEXT user_id referencing users.supabase_user_id
-	// SQLite doesn't support ALTER COLUMN, so we need to recreate the table
-	// First, check if plushies table exists and has INTEGER user_id
-	var tableInfo string
-	err = db.QueryRow(`
-		SELECT sql FROM sqlite_master 
-		WHERE type='table' AND name='plushies'
-	`).Scan(&tableInfo)
-
-	if err == nil && tableInfo != "" {
-		// Table exists, check if user_id is INTEGER
-		if contains(tableInfo, "user_id INTEGER") {
-			// Create new table with TEXT user_id
-			_, err = db.Exec(`
-CREATE TABLE IF NOT EXISTS plushies_new (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	user_id TEXT NOT NULL,
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target || !applied[m.Version] {
+			continue
+		}
+		if m.Down == nil {
+			return fmt.Errorf("migration %04d_%s cannot be reverted", m.Version, m.Name)
+		}
+		log.Printf("Reverting migration %04d_%s", m.Version, m.Name)
+		if err := runMigration(db, m, m.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runMigration runs one migration step and its bookkeeping in a single transaction
+func runMigration(db *sql.DB, m migration, step, record func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	defer tx.Rollback()
+
+	if err := step(tx); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	if err := record(tx); err != nil {
+		return fmt.Errorf("migration %04d_%s: failed to record version: %w", m.Version, m.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	return nil
+}
+
+func ensureMigrationTables(db *sql.DB) error {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
 	name TEXT NOT NULL,
-	kind TEXT NOT NULL,
-	adopted_at TEXT,
-	image_path TEXT,
-	conversation_history TEXT,
-	created_at TIMESTAMP NOT NULL,
-	updated_at TIMESTAMP NOT NULL,
-	FOREIGN KEY (user_id) REFERENCES users(supabase_user_id) ON DELETE CASCADE
+	applied_at TIMESTAMP NOT NULL
 );
 `)
-			if err != nil {
-				return err
-			}
+	if err != nil {
+		return err
+	}
 
-			// Copy data from old table to new table
-			_, _ = db.Exec(`
-INSERT INTO plushies_new (id, user_id, name, kind, adopted_at, image_path, conversation_history, created_at, updated_at)
-SELECT id, CAST(user_id AS TEXT), name, kind, adopted_at, image_path, conversation_history, created_at, updated_at
-FROM plushies;
+	// Single-row table used as a cross-process lock while migrations run
+	_, err = db.Exec(`
+CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	owner TEXT NOT NULL,
+	acquired_at TIMESTAMP NOT NULL
+);
 `)
+	return err
+}
 
-			// Drop old table and rename new table
-			_, err = db.Exec(`DROP TABLE plushies;`)
-			if err != nil {
-				return err
+func appliedMigrations(db *sql.DB) (map[int]bool, error) {
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// acquireMigrationLock blocks until this process holds the migration lock.
+// A lock older than migrationLockStaleAge is assumed to belong to a crashed process and is taken over;
+// the wait only times out if the lock keeps being held by live processes.
+func acquireMigrationLock(db *sql.DB) (func(), error) {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), uuid.NewString())
+	deadline := time.Now().Add(migrationLockTimeout)
+	waiting := false
+
+	for {
+		res, err := db.Exec(`
+			INSERT INTO schema_migrations_lock (id, owner, acquired_at)
+			VALUES (1, ?, ?)
+			ON CONFLICT (id) DO NOTHING
+		`, owner, time.Now().UTC())
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		if affected, _ := res.RowsAffected(); affected == 1 {
+			break
+		}
+
+		var holder string
+		var acquiredAt time.Time
+		err = db.QueryRow(`SELECT owner, acquired_at FROM schema_migrations_lock WHERE id = 1`).Scan(&holder, &acquiredAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to read migration lock: %w", err)
+		}
+		if err == nil && time.Since(acquiredAt) > migrationLockStaleAge {
+			log.Printf("WARNING: Removing stale migration lock held by %s since %s", holder, acquiredAt.Format(time.RFC3339))
+			_, _ = db.Exec(`DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?`, holder)
+			continue
+		}
+		if err == nil {
+			if staleAt := acquiredAt.Add(migrationLockStaleAge + migrationLockRetryWait); staleAt.After(deadline) {
+				deadline = staleAt
 			}
-			_, err = db.Exec(`ALTER TABLE plushies_new RENAME TO plushies;`)
-			if err != nil {
-				return err
+			if !waiting {
+				log.Printf("Waiting for the migration lock held by %s since %s", holder, acquiredAt.Format(time.RFC3339))
+				waiting = true
 			}
 		}
-	} else {
-		// Table doesn't exist or is already migrated, create with TEXT user_id
-		_, err = db.Exec(`
-CREATE TABLE IF NOT EXISTS plushies (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	user_id TEXT NOT NULL,
-	name TEXT NOT NULL,
-	kind TEXT NOT NULL,
-	adopted_at TEXT,
-	image_path TEXT,
-	conversation_history TEXT,
-	created_at TIMESTAMP NOT NULL,
-	updated_at TIMESTAMP NOT NULL,
-	FOREIGN KEY (user_id) REFERENCES users(supabase_user_id) ON DELETE CASCADE
-);
-`)
-		if err != nil {
-			return err
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for migration lock held by %s", holder)
 		}
+		time.Sleep(migrationLockRetryWait)
 	}
 
-	return nil
+	return func() {
+		if _, err := db.Exec(`DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?`, owner); err != nil {
+			log.Printf("WARNING: Failed to release migration lock: %v", err)
+		}
+	}, nil
+}
+
+// rowQuerier is implemented by *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// tableExists reports whether a table, including a virtual table, exists
+func tableExists(q rowQuerier, name string) (bool, error) {
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n)
+	return n > 0, err
+}
+
+// columnInfo describes a column as reported by PRAGMA table_info
+type columnInfo struct {
+	Name string
+	Type string
+}
+
+// tableColumns returns the columns of a table, or nil if the table does not exist
+func tableColumns(tx *sql.Tx, table string) ([]columnInfo, error) {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols []columnInfo
+	for rows.Next() {
+		var cid, notNull, pk int
+		var col columnInfo
+		var defaultValue any
+		if err := rows.Scan(&cid, &col.Name, &col.Type, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+	return cols, rows.Err()
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Baseline schema. Databases created before the migration framework existed
+// may have a users table without supabase_user_id or a plushies table with an
+// INTEGER user_id; both are upgraded here so every later migration can assume
+// the baseline shape.
+func init() {
+	registerMigration(migration{
+		Version: 1,
+		Name:    "baseline",
+		Up:      migrateBaselineUp,
+		Down: execStatements(
+			`DROP TABLE IF EXISTS plushies`,
+			`DROP TABLE IF EXISTS users`,
+		),
+	})
+}
+
+const baselinePlushiesTable = `
+CREATE TABLE %s (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	adopted_at TEXT,
+	image_path TEXT,
+	conversation_history TEXT,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(supabase_user_id) ON DELETE CASCADE
+);
+`
+
+func migrateBaselineUp(tx *sql.Tx) error {
+	// users table
+	_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	supabase_user_id TEXT UNIQUE,
+	created_at TIMESTAMP NOT NULL
+);
+`)
+	if err != nil {
+		return err
+	}
+
+	userCols, err := tableColumns(tx, "users")
+	if err != nil {
+		return err
+	}
+	if !hasColumn(userCols, "supabase_user_id") {
+		// SQLite can't add a UNIQUE column to an existing table, so add a unique index instead
+		if _, err := tx.Exec(`ALTER TABLE users ADD COLUMN supabase_user_id TEXT`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_supabase_user_id ON users(supabase_user_id)`); err != nil {
+			return err
+		}
+	}
+
+	plushieCols, err := tableColumns(tx, "plushies")
+	if err != nil {
+		return err
+	}
+	if plushieCols == nil {
+		_, err = tx.Exec(fmt.Sprintf(baselinePlushiesTable, "plushies"))
+		return err
+	}
+
+	if columnType(plushieCols, "user_id") != "INTEGER" {
+		return nil
+	}
+
+	// Legacy plushies table with INTEGER user_id referencing users.id: rebuild it
+	// with TEXT user_id referencing users.supabase_user_id. Legacy users without a
+	// Supabase ID get a placeholder so their plushies survive the foreign key.
+	// SQLite doesn't support ALTER COLUMN, so copy into a new table and swap.
+	return execStatements(
+		`UPDATE users SET supabase_user_id = 'legacy-' || id WHERE supabase_user_id IS NULL`,
+		fmt.Sprintf(baselinePlushiesTable, "plushies_new"),
+		`INSERT INTO plushies_new (id, user_id, name, kind, adopted_at, image_path, conversation_history, created_at, updated_at)
+		SELECT p.id, u.supabase_user_id, p.name, p.kind, p.adopted_at, p.image_path, p.conversation_history, p.created_at, p.updated_at
+		FROM plushies p
+		JOIN users u ON u.id = p.user_id`,
+		`DROP TABLE plushies`,
+		`ALTER TABLE plushies_new RENAME TO plushies`,
+	)(tx)
+}
+
+func hasColumn(cols []columnInfo, name string) bool {
+	for _, c := range cols {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func columnType(cols []columnInfo, name string) string {
+	for _, c := range cols {
+		if c.Name == name {
+			return c.Type
+		}
+	}
+	return ""
+}
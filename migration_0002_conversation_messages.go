@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Moves plushies.conversation_history into one row per message so
+// individual turns can be appended, edited and deleted.
+func init() {
+	registerMigration(migration{
+		Version: 2,
+		Name:    "conversation_messages",
+		Up:      migrateConversationMessagesUp,
+		Down: execStatements(
+			`ALTER TABLE plushies ADD COLUMN conversation_history TEXT`,
+			`UPDATE plushies SET conversation_history = `+conversationHistoryExpr,
+			`DROP TABLE conversation_messages`,
+		),
+	})
+}
+
+func migrateConversationMessagesUp(tx *sql.Tx) error {
+	err := execStatements(
+		`CREATE TABLE conversation_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			plushie_id INTEGER NOT NULL,
+			speaker TEXT NOT NULL DEFAULT '',
+			role TEXT NOT NULL CHECK (role IN ('user', 'assistant', 'system')),
+			content TEXT NOT NULL,
+			timestamp TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (plushie_id) REFERENCES plushies(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX idx_conversation_messages_plushie_id ON conversation_messages(plushie_id, id)`,
+	)(tx)
+	if err != nil {
+		return err
+	}
+
+	type legacyHistory struct {
+		plushieID int64
+		name      string
+		history   string
+		updatedAt time.Time
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, name, conversation_history, updated_at
+		FROM plushies
+		WHERE conversation_history IS NOT NULL AND conversation_history != ''
+	`)
+	if err != nil {
+		return err
+	}
+	var histories []legacyHistory
+	for rows.Next() {
+		var h legacyHistory
+		var updatedAt any
+		if err := rows.Scan(&h.plushieID, &h.name, &h.history, &updatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		// Legacy rows may hold timestamps the driver can't parse; fall back to now
+		h.updatedAt = time.Now().UTC()
+		if t, ok := updatedAt.(time.Time); ok {
+			h.updatedAt = t.UTC()
+		}
+		histories = append(histories, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range histories {
+		if err := insertConversationMessages(tx, h.plushieID, parseConversationHistory(h.history, h.name, h.updatedAt)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`ALTER TABLE plushies DROP COLUMN conversation_history`)
+	return err
+}
@@ -0,0 +1,19 @@
+package main
+
+// Stores the resized variants generated for each uploaded image.
+// Images uploaded before this migration have no variants; the API falls back
+// to the original for them.
+func init() {
+	registerMigration(migration{
+		Version: 3,
+		Name:    "image_variants",
+		Up: execStatements(
+			`ALTER TABLE plushies ADD COLUMN image_medium_path TEXT`,
+			`ALTER TABLE plushies ADD COLUMN image_thumb_path TEXT`,
+		),
+		Down: execStatements(
+			`ALTER TABLE plushies DROP COLUMN image_thumb_path`,
+			`ALTER TABLE plushies DROP COLUMN image_medium_path`,
+		),
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+// Queues image blobs for deletion when a plushie's image is replaced or the
+// plushie is deleted. The triggers run inside the same transaction as the
+// change, so a blob is queued exactly when its last reference goes away;
+// the files themselves are removed after commit by drainBlobDeletions.
+func init() {
+	registerMigration(migration{
+		Version: 4,
+		Name:    "blob_deletions",
+		Up: execStatements(
+			`CREATE TABLE blob_deletions (
+				key TEXT PRIMARY KEY,
+				queued_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT
+			)`,
+			`CREATE TRIGGER plushies_queue_replaced_images
+			AFTER UPDATE OF image_path, image_medium_path, image_thumb_path ON plushies
+			BEGIN
+				INSERT OR IGNORE INTO blob_deletions (key)
+				SELECT old_key FROM (
+					SELECT OLD.image_path AS old_key, NEW.image_path AS new_key
+					UNION ALL SELECT OLD.image_medium_path, NEW.image_medium_path
+					UNION ALL SELECT OLD.image_thumb_path, NEW.image_thumb_path
+				)
+				WHERE old_key IS NOT NULL AND old_key != '' AND old_key IS NOT new_key;
+			END`,
+			`CREATE TRIGGER plushies_queue_deleted_images
+			AFTER DELETE ON plushies
+			BEGIN
+				INSERT OR IGNORE INTO blob_deletions (key)
+				SELECT old_key FROM (
+					SELECT OLD.image_path AS old_key
+					UNION ALL SELECT OLD.image_medium_path
+					UNION ALL SELECT OLD.image_thumb_path
+				)
+				WHERE old_key IS NOT NULL AND old_key != '';
+			END`,
+		),
+		Down: execStatements(
+			`DROP TRIGGER plushies_queue_deleted_images`,
+			`DROP TRIGGER plushies_queue_replaced_images`,
+			`DROP TABLE blob_deletions`,
+		),
+	})
+}
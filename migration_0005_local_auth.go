@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/google/uuid"
+)
+
+// Tables for the built-in identity provider (AUTH_MODE=local).
+// A session is one login; its refresh tokens rotate on every use and only
+// their SHA-256 hashes are stored. Users without a UUID (registered through
+// the old /api/register) get one so they can sign in.
+func init() {
+	registerMigration(migration{
+		Version: 5,
+		Name:    "local_auth",
+		Up: func(tx *sql.Tx) error {
+			if err := assignMissingUserUUIDs(tx); err != nil {
+				return err
+			}
+			return execStatements(
+				`CREATE TABLE auth_sessions (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL REFERENCES users(supabase_user_id) ON DELETE CASCADE,
+					created_at DATETIME NOT NULL,
+					refreshed_at DATETIME NOT NULL,
+					expires_at DATETIME NOT NULL,
+					revoked_at DATETIME
+				)`,
+				`CREATE INDEX idx_auth_sessions_user_id ON auth_sessions(user_id)`,
+				`CREATE TABLE auth_refresh_tokens (
+					token_hash TEXT PRIMARY KEY,
+					session_id TEXT NOT NULL REFERENCES auth_sessions(id) ON DELETE CASCADE,
+					created_at DATETIME NOT NULL,
+					used_at DATETIME
+				)`,
+				`CREATE INDEX idx_auth_refresh_tokens_session_id ON auth_refresh_tokens(session_id)`,
+				`CREATE TABLE password_reset_tokens (
+					token_hash TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL REFERENCES users(supabase_user_id) ON DELETE CASCADE,
+					created_at DATETIME NOT NULL,
+					expires_at DATETIME NOT NULL,
+					used_at DATETIME
+				)`,
+				`CREATE INDEX idx_password_reset_tokens_user_id ON password_reset_tokens(user_id)`,
+			)(tx)
+		},
+		Down: execStatements(
+			`DROP TABLE password_reset_tokens`,
+			`DROP TABLE auth_refresh_tokens`,
+			`DROP TABLE auth_sessions`,
+		),
+	})
+}
+
+func assignMissingUserUUIDs(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id FROM users WHERE supabase_user_id IS NULL`)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE users SET supabase_user_id = ? WHERE id = ?`, uuid.NewString(), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+// Persists the cookie sessions of /api/login, which were kept in memory.
+// Only the SHA-256 hash of the cookie value is stored; the separate id is what
+// the session list and revoke endpoints refer to.
+func init() {
+	registerMigration(migration{
+		Version: 6,
+		Name:    "sessions",
+		Up: execStatements(
+			`CREATE TABLE sessions (
+				id TEXT PRIMARY KEY,
+				token_hash TEXT NOT NULL UNIQUE,
+				user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				created_at DATETIME NOT NULL,
+				last_seen_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				user_agent TEXT NOT NULL DEFAULT '',
+				ip_address TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX idx_sessions_user_id ON sessions(user_id)`,
+			`CREATE INDEX idx_sessions_expires_at ON sessions(expires_at)`,
+		),
+		Down: execStatements(
+			`DROP TABLE sessions`,
+		),
+	})
+}
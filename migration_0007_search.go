@@ -0,0 +1,96 @@
+package main
+
+import "database/sql"
+
+// Adds free-text notes to plushies and a full-text index for GET /api/search.
+//
+// plushie_search holds one row per plushie (rowid = plushies.id) with its
+// name, kind and notes. message_search is an external-content index over
+// conversation_messages (rowid = message id), so its triggers only touch the
+// message that changed. The trigram tokenizer indexes every three characters,
+// which works for Japanese without word segmentation.
+//
+// The index needs SQLite's FTS5 module (-tags sqlite_fts5). Without it only
+// notes is added and search scans the tables instead; ensureSearchIndex
+// builds the index once the server runs with FTS5.
+func init() {
+	registerMigration(migration{
+		Version: 7,
+		Name:    "search",
+		Up: func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`ALTER TABLE plushies ADD COLUMN notes TEXT NOT NULL DEFAULT ''`); err != nil {
+				return err
+			}
+			fts5, err := sqliteHasFTS5(tx)
+			if err != nil {
+				return err
+			}
+			if !fts5 {
+				return nil
+			}
+			return createSearchIndex(tx)
+		},
+		Down: func(tx *sql.Tx) error {
+			if err := dropSearchIndex(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`ALTER TABLE plushies DROP COLUMN notes`)
+			return err
+		},
+	})
+}
+
+// createSearchIndex creates and fills plushie_search, message_search and
+// their triggers
+func createSearchIndex(tx *sql.Tx) error {
+	return execStatements(
+		`CREATE VIRTUAL TABLE plushie_search USING fts5(name, kind, notes, tokenize = 'trigram')`,
+		`INSERT INTO plushie_search (rowid, name, kind, notes) SELECT id, name, kind, notes FROM plushies`,
+		`CREATE TRIGGER plushies_search_insert AFTER INSERT ON plushies
+		BEGIN
+			INSERT INTO plushie_search (rowid, name, kind, notes) VALUES (NEW.id, NEW.name, NEW.kind, NEW.notes);
+		END`,
+		`CREATE TRIGGER plushies_search_update AFTER UPDATE OF name, kind, notes ON plushies
+		BEGIN
+			UPDATE plushie_search SET name = NEW.name, kind = NEW.kind, notes = NEW.notes
+			WHERE rowid = NEW.id;
+		END`,
+		`CREATE TRIGGER plushies_search_delete AFTER DELETE ON plushies
+		BEGIN
+			DELETE FROM plushie_search WHERE rowid = OLD.id;
+		END`,
+
+		`CREATE VIRTUAL TABLE message_search USING fts5(
+			content, content = 'conversation_messages', content_rowid = 'id', tokenize = 'trigram'
+		)`,
+		`INSERT INTO message_search (message_search) VALUES ('rebuild')`,
+		// An external-content index is told the old text to remove it
+		`CREATE TRIGGER conversation_messages_search_insert AFTER INSERT ON conversation_messages
+		BEGIN
+			INSERT INTO message_search (rowid, content) VALUES (NEW.id, NEW.content);
+		END`,
+		`CREATE TRIGGER conversation_messages_search_update AFTER UPDATE OF content ON conversation_messages
+		BEGIN
+			INSERT INTO message_search (message_search, rowid, content) VALUES ('delete', OLD.id, OLD.content);
+			INSERT INTO message_search (rowid, content) VALUES (NEW.id, NEW.content);
+		END`,
+		`CREATE TRIGGER conversation_messages_search_delete AFTER DELETE ON conversation_messages
+		BEGIN
+			INSERT INTO message_search (message_search, rowid, content) VALUES ('delete', OLD.id, OLD.content);
+		END`,
+	)(tx)
+}
+
+// dropSearchIndex drops what createSearchIndex created, if it exists
+func dropSearchIndex(tx *sql.Tx) error {
+	return execStatements(
+		`DROP TRIGGER IF EXISTS conversation_messages_search_delete`,
+		`DROP TRIGGER IF EXISTS conversation_messages_search_update`,
+		`DROP TRIGGER IF EXISTS conversation_messages_search_insert`,
+		`DROP TABLE IF EXISTS message_search`,
+		`DROP TRIGGER IF EXISTS plushies_search_delete`,
+		`DROP TRIGGER IF EXISTS plushies_search_update`,
+		`DROP TRIGGER IF EXISTS plushies_search_insert`,
+		`DROP TABLE IF EXISTS plushie_search`,
+	)(tx)
+}
@@ -0,0 +1,76 @@
+package main
+
+// Adds per-user tags (many-to-many with plushies) and collections: named,
+// ordered groups of plushies with a description and an optional cover image.
+// Cover images are queued for deletion like plushie images (see 0004).
+func init() {
+	registerMigration(migration{
+		Version: 8,
+		Name:    "tags_collections",
+		Up: execStatements(
+			`CREATE TABLE tags (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT NOT NULL REFERENCES users(supabase_user_id) ON DELETE CASCADE,
+				name TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				UNIQUE (user_id, name COLLATE NOCASE)
+			)`,
+			`CREATE TABLE plushie_tags (
+				plushie_id INTEGER NOT NULL REFERENCES plushies(id) ON DELETE CASCADE,
+				tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+				PRIMARY KEY (plushie_id, tag_id)
+			)`,
+			`CREATE INDEX idx_plushie_tags_tag_id ON plushie_tags(tag_id)`,
+			`CREATE TABLE collections (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT NOT NULL REFERENCES users(supabase_user_id) ON DELETE CASCADE,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				cover_image_path TEXT,
+				cover_image_medium_path TEXT,
+				cover_image_thumb_path TEXT,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				UNIQUE (user_id, name COLLATE NOCASE)
+			)`,
+			`CREATE TABLE collection_plushies (
+				collection_id INTEGER NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+				plushie_id INTEGER NOT NULL REFERENCES plushies(id) ON DELETE CASCADE,
+				position INTEGER NOT NULL,
+				added_at DATETIME NOT NULL,
+				PRIMARY KEY (collection_id, plushie_id)
+			)`,
+			`CREATE INDEX idx_collection_plushies_plushie_id ON collection_plushies(plushie_id)`,
+			`CREATE TRIGGER collections_queue_replaced_images
+			AFTER UPDATE OF cover_image_path, cover_image_medium_path, cover_image_thumb_path ON collections
+			BEGIN
+				INSERT OR IGNORE INTO blob_deletions (key)
+				SELECT old_key FROM (
+					SELECT OLD.cover_image_path AS old_key, NEW.cover_image_path AS new_key
+					UNION ALL SELECT OLD.cover_image_medium_path, NEW.cover_image_medium_path
+					UNION ALL SELECT OLD.cover_image_thumb_path, NEW.cover_image_thumb_path
+				)
+				WHERE old_key IS NOT NULL AND old_key != '' AND old_key IS NOT new_key;
+			END`,
+			`CREATE TRIGGER collections_queue_deleted_images
+			AFTER DELETE ON collections
+			BEGIN
+				INSERT OR IGNORE INTO blob_deletions (key)
+				SELECT old_key FROM (
+					SELECT OLD.cover_image_path AS old_key
+					UNION ALL SELECT OLD.cover_image_medium_path
+					UNION ALL SELECT OLD.cover_image_thumb_path
+				)
+				WHERE old_key IS NOT NULL AND old_key != '';
+			END`,
+		),
+		Down: execStatements(
+			`DROP TRIGGER collections_queue_deleted_images`,
+			`DROP TRIGGER collections_queue_replaced_images`,
+			`DROP TABLE collection_plushies`,
+			`DROP TABLE collections`,
+			`DROP TABLE plushie_tags`,
+			`DROP TABLE tags`,
+		),
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+// Adds a photo gallery to plushies. Existing images become the first photo of
+// their plushie.
+//
+// plushies.cover_photo_id names the cover photo, whose keys are also kept in
+// plushies.image_path and friends so image_url keeps working (see
+// syncPlushieCover). It has no foreign key so the column can be dropped again.
+// Reverting keeps only the cover photos; -gc-images removes the others.
+func init() {
+	registerMigration(migration{
+		Version: 9,
+		Name:    "plushie_photos",
+		Up: execStatements(
+			`CREATE TABLE plushie_photos (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				plushie_id INTEGER NOT NULL REFERENCES plushies(id) ON DELETE CASCADE,
+				image_path TEXT NOT NULL,
+				image_medium_path TEXT,
+				image_thumb_path TEXT,
+				caption TEXT NOT NULL DEFAULT '',
+				taken_at TEXT,
+				position INTEGER NOT NULL,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX idx_plushie_photos_plushie_id ON plushie_photos(plushie_id, position)`,
+			`ALTER TABLE plushies ADD COLUMN cover_photo_id INTEGER`,
+			`INSERT INTO plushie_photos (plushie_id, image_path, image_medium_path, image_thumb_path, position, created_at, updated_at)
+			SELECT id, image_path, image_medium_path, image_thumb_path, 0, updated_at, updated_at
+			FROM plushies WHERE image_path IS NOT NULL AND image_path != ''`,
+			`UPDATE plushies SET cover_photo_id = (SELECT id FROM plushie_photos WHERE plushie_id = plushies.id)`,
+			`CREATE TRIGGER plushie_photos_queue_deleted_images
+			AFTER DELETE ON plushie_photos
+			BEGIN
+				INSERT OR IGNORE INTO blob_deletions (key)
+				SELECT old_key FROM (
+					SELECT OLD.image_path AS old_key
+					UNION ALL SELECT OLD.image_medium_path
+					UNION ALL SELECT OLD.image_thumb_path
+				)
+				WHERE old_key IS NOT NULL AND old_key != '';
+			END`,
+		),
+		Down: execStatements(
+			`DROP TRIGGER plushie_photos_queue_deleted_images`,
+			`ALTER TABLE plushies DROP COLUMN cover_photo_id`,
+			`DROP TABLE plushie_photos`,
+		),
+	})
+}
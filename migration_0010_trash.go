@@ -0,0 +1,19 @@
+package main
+
+// Adds plushies.deleted_at: deleting a plushie moves it to the trash, from
+// which it is restored or purged (see trash.go). Reverting restores every
+// plushie in the trash.
+func init() {
+	registerMigration(migration{
+		Version: 10,
+		Name:    "trash",
+		Up: execStatements(
+			`ALTER TABLE plushies ADD COLUMN deleted_at DATETIME`,
+			`CREATE INDEX idx_plushies_deleted_at ON plushies(deleted_at) WHERE deleted_at IS NOT NULL`,
+		),
+		Down: execStatements(
+			`DROP INDEX idx_plushies_deleted_at`,
+			`ALTER TABLE plushies DROP COLUMN deleted_at`,
+		),
+	})
+}
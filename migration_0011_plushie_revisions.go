@@ -0,0 +1,26 @@
+package main
+
+// Adds plushie_revisions: one row per change to a plushie's profile or
+// conversation, holding what changed (see revisions.go). History starts when
+// the migration is applied.
+func init() {
+	registerMigration(migration{
+		Version: 11,
+		Name:    "plushie_revisions",
+		Up: execStatements(
+			`CREATE TABLE plushie_revisions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				plushie_id INTEGER NOT NULL REFERENCES plushies(id) ON DELETE CASCADE,
+				user_id TEXT NOT NULL,
+				action TEXT NOT NULL,
+				changes TEXT NOT NULL,
+				reverted_to INTEGER,
+				created_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX idx_plushie_revisions_plushie_id ON plushie_revisions(plushie_id, id)`,
+		),
+		Down: execStatements(
+			`DROP TABLE plushie_revisions`,
+		),
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+// Adds plushies.version, the row version behind the plushie ETag (see
+// etag.go). Triggers bump it on every change to the plushie row and whenever
+// its tags change, including renames and deletions of a tag.
+func init() {
+	registerMigration(migration{
+		Version: 12,
+		Name:    "plushie_version",
+		Up: execStatements(
+			`ALTER TABLE plushies ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+			// Statements that set version themselves are left alone
+			`CREATE TRIGGER plushies_bump_version AFTER UPDATE ON plushies
+			WHEN NEW.version = OLD.version
+			BEGIN
+				UPDATE plushies SET version = OLD.version + 1 WHERE id = NEW.id;
+			END`,
+			`CREATE TRIGGER plushie_tags_insert_bump_version AFTER INSERT ON plushie_tags
+			BEGIN
+				UPDATE plushies SET version = version + 1 WHERE id = NEW.plushie_id;
+			END`,
+			`CREATE TRIGGER plushie_tags_delete_bump_version AFTER DELETE ON plushie_tags
+			BEGIN
+				UPDATE plushies SET version = version + 1 WHERE id = OLD.plushie_id;
+			END`,
+			`CREATE TRIGGER tags_rename_bump_version AFTER UPDATE OF name ON tags
+			WHEN NEW.name IS NOT OLD.name
+			BEGIN
+				UPDATE plushies SET version = version + 1
+				WHERE id IN (SELECT plushie_id FROM plushie_tags WHERE tag_id = NEW.id);
+			END`,
+		),
+		Down: execStatements(
+			`DROP TRIGGER tags_rename_bump_version`,
+			`DROP TRIGGER plushie_tags_delete_bump_version`,
+			`DROP TRIGGER plushie_tags_insert_bump_version`,
+			`DROP TRIGGER plushies_bump_version`,
+			`ALTER TABLE plushies DROP COLUMN version`,
+		),
+	})
+}
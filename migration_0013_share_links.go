@@ -0,0 +1,35 @@
+package main
+
+// Adds share links: revocable, optionally expiring tokens that let anyone read
+// a plushie's public profile. Like sessions, only the SHA-256 hash of a token
+// is stored. Quotes refer to messages, so deleting a message takes it off every
+// link too.
+func init() {
+	registerMigration(migration{
+		Version: 13,
+		Name:    "share_links",
+		Up: execStatements(
+			`CREATE TABLE share_links (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				plushie_id INTEGER NOT NULL REFERENCES plushies(id) ON DELETE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME,
+				view_count INTEGER NOT NULL DEFAULT 0,
+				last_viewed_at DATETIME
+			)`,
+			`CREATE INDEX idx_share_links_plushie_id ON share_links(plushie_id)`,
+			`CREATE TABLE share_link_quotes (
+				share_link_id INTEGER NOT NULL REFERENCES share_links(id) ON DELETE CASCADE,
+				message_id INTEGER NOT NULL REFERENCES conversation_messages(id) ON DELETE CASCADE,
+				position INTEGER NOT NULL,
+				PRIMARY KEY (share_link_id, message_id)
+			)`,
+			`CREATE INDEX idx_share_link_quotes_message_id ON share_link_quotes(message_id)`,
+		),
+		Down: execStatements(
+			`DROP TABLE share_link_quotes`,
+			`DROP TABLE share_links`,
+		),
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+// Adds households: groups of users who manage plushies together, each member
+// with a role (see households.go). Every user has a personal household, marked
+// by personal_user_id, that their plushies go to by default; the existing
+// plushies are moved into their owner's. plushies.user_id stays as the user
+// who added the plushie. plushies.household_id has no foreign key so the
+// column can be dropped again; deleting a household that still holds
+// plushies is refused instead.
+func init() {
+	registerMigration(migration{
+		Version: 14,
+		Name:    "households",
+		Up: execStatements(
+			`CREATE TABLE households (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				personal_user_id TEXT UNIQUE REFERENCES users(supabase_user_id) ON DELETE CASCADE,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL
+			)`,
+			`CREATE TABLE household_members (
+				household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+				user_id TEXT NOT NULL REFERENCES users(supabase_user_id) ON DELETE CASCADE,
+				role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+				joined_at DATETIME NOT NULL,
+				PRIMARY KEY (household_id, user_id)
+			)`,
+			`CREATE INDEX idx_household_members_user_id ON household_members(user_id)`,
+			`CREATE TABLE household_invitations (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+				invited_by TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX idx_household_invitations_household_id ON household_invitations(household_id)`,
+			`INSERT INTO households (name, personal_user_id, created_at, updated_at)
+			SELECT '', user_id, MIN(created_at), MIN(created_at) FROM plushies GROUP BY user_id`,
+			`INSERT INTO household_members (household_id, user_id, role, joined_at)
+			SELECT id, personal_user_id, 'owner', created_at FROM households`,
+			`ALTER TABLE plushies ADD COLUMN household_id INTEGER`,
+			`UPDATE plushies SET household_id = (SELECT id FROM households WHERE personal_user_id = plushies.user_id)`,
+			`CREATE INDEX idx_plushies_household_id ON plushies(household_id)`,
+		),
+		Down: execStatements(
+			`DROP INDEX idx_plushies_household_id`,
+			`ALTER TABLE plushies DROP COLUMN household_id`,
+			`DROP TABLE household_invitations`,
+			`DROP TABLE household_members`,
+			`DROP TABLE households`,
+		),
+	})
+}
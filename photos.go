@@ -0,0 +1,506 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Photo gallery limits
+const (
+	MaxPhotosPerPlushie   = 50
+	MaxPhotoCaptionLength = 200 // runes
+)
+
+// Photo is one photo in a plushie's gallery
+type Photo struct {
+	ID             int64     `json:"id"`
+	PlushieID      int64     `json:"plushie_id"`
+	ImageURL       string    `json:"image_url"`
+	MediumImageURL string    `json:"medium_image_url"`
+	ThumbnailURL   string    `json:"thumbnail_url"`
+	Caption        string    `json:"caption"`
+	TakenAt        string    `json:"taken_at"` // yyyy-mm-dd, empty if unknown
+	Position       int       `json:"position"`
+	IsCover        bool      `json:"is_cover"`
+	CreatedAt      time.Time `json:"created_at"`
+	ModifiedAt     time.Time `json:"modified_at"`
+}
+
+const photoColumns = `id, plushie_id, image_path, image_medium_path, image_thumb_path, caption, taken_at, position,
+	id IS (SELECT cover_photo_id FROM plushies WHERE plushies.id = plushie_photos.plushie_id), created_at, updated_at`
+
+// scanPhoto scans a photo selected with photoColumns and fills in signed image URLs
+func (a *App) scanPhoto(scan func(dest ...any) error) (*Photo, error) {
+	var p Photo
+	var imagePath string
+	var mediumPath, thumbPath, takenAt sql.NullString
+	err := scan(&p.ID, &p.PlushieID, &imagePath, &mediumPath, &thumbPath, &p.Caption, &takenAt,
+		&p.Position, &p.IsCover, &p.CreatedAt, &p.ModifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.ImageURL = a.imageURL(imagePath)
+	p.MediumImageURL = p.ImageURL
+	p.ThumbnailURL = p.ImageURL
+	if mediumPath.Valid {
+		p.MediumImageURL = a.imageURL(mediumPath.String)
+	}
+	if thumbPath.Valid {
+		p.ThumbnailURL = a.imageURL(thumbPath.String)
+	}
+	p.TakenAt = takenAt.String
+	return &p, nil
+}
+
+var errTooManyPhotos = errors.New(ErrTooManyPhotos)
+
+// insertPlushiePhoto adds a photo to the end of a plushie's gallery.
+// It returns errTooManyPhotos if the gallery is full.
+func insertPlushiePhoto(tx *sql.Tx, plushieID int64, img *savedImage, caption, takenAt string, now time.Time) (int64, error) {
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM plushie_photos WHERE plushie_id = ?`, plushieID).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count >= MaxPhotosPerPlushie {
+		return 0, errTooManyPhotos
+	}
+	res, err := tx.Exec(`
+		INSERT INTO plushie_photos (plushie_id, image_path, image_medium_path, image_thumb_path, caption, taken_at, position, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM plushie_photos WHERE plushie_id = ?), ?, ?)
+	`, plushieID, img.Path, nullIfEmpty(img.MediumPath), nullIfEmpty(img.ThumbPath), caption, nullIfEmpty(takenAt),
+		plushieID, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// syncPlushieCover makes coverID the plushie's cover photo. With coverID 0 the
+// current cover is kept if it still exists, and otherwise the first photo
+// becomes the cover. The cover's keys are copied to the plushie row, which
+// image_url and the other plushie image fields are read from.
+func syncPlushieCover(tx *sql.Tx, plushieID, coverID int64) error {
+	_, err := tx.Exec(`
+		UPDATE plushies SET cover_photo_id = COALESCE(
+			(SELECT id FROM plushie_photos WHERE id = ? AND plushie_id = plushies.id),
+			(SELECT id FROM plushie_photos WHERE id = plushies.cover_photo_id AND plushie_id = plushies.id),
+			(SELECT id FROM plushie_photos WHERE plushie_id = plushies.id ORDER BY position, id LIMIT 1)
+		)
+		WHERE id = ?
+	`, coverID, plushieID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE plushies SET
+			image_path = (SELECT image_path FROM plushie_photos WHERE id = plushies.cover_photo_id),
+			image_medium_path = (SELECT image_medium_path FROM plushie_photos WHERE id = plushies.cover_photo_id),
+			image_thumb_path = (SELECT image_thumb_path FROM plushie_photos WHERE id = plushies.cover_photo_id)
+		WHERE id = ?
+	`, plushieID)
+	return err
+}
+
+// validatePhotoFields checks a caption and taken-at date and returns the error message to show on failure
+func validatePhotoFields(caption, takenAt string) string {
+	if utf8.RuneCountInString(caption) > MaxPhotoCaptionLength {
+		return ErrPhotoCaptionTooLong
+	}
+	if takenAt != "" {
+		if _, err := time.Parse("2006-01-02", takenAt); err != nil {
+			return ErrInvalidTakenAt
+		}
+	}
+	return ""
+}
+
+func (a *App) listPlushiePhotos(r *http.Request, plushieID int64) ([]Photo, error) {
+	rows, err := a.DB.QueryContext(r.Context(),
+		`SELECT `+photoColumns+` FROM plushie_photos WHERE plushie_id = ? ORDER BY position, id`, plushieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := []Photo{}
+	for rows.Next() {
+		p, err := a.scanPhoto(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, *p)
+	}
+	return photos, rows.Err()
+}
+
+// HandleListPhotos lists a plushie's photos in gallery order
+func (a *App) HandleListPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.plushieAccessOrError(w, id, userID, permView) {
+		return
+	}
+
+	photos, err := a.listPlushiePhotos(r, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListPhotos)
+		return
+	}
+	respondJSON(w, http.StatusOK, photos)
+}
+
+// HandleAddPhoto adds a photo to the end of a plushie's gallery from a
+// multipart form with image, caption, taken_at and cover=true to make it the
+// cover. The first photo of a plushie always becomes its cover.
+func (a *App) HandleAddPhoto(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := r.ParseMultipartForm(a.Config.MaxUploadSize); err != nil {
+		respondError(w, http.StatusBadRequest, ErrFailedToParseForm)
+		return
+	}
+	caption := strings.TrimSpace(r.FormValue("caption"))
+	takenAt := r.FormValue("taken_at")
+	if msg := validatePhotoFields(caption, takenAt); msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	cover := r.FormValue("cover") == "true"
+
+	// Check access before storing the upload
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	img, err := a.saveUploadedFile(r, "image")
+	if err != nil {
+		if errors.Is(err, ErrNoFile) {
+			respondError(w, http.StatusBadRequest, ErrPhotoRequired)
+		} else {
+			respondImageError(w, err)
+		}
+		return
+	}
+
+	photoID, err := a.addPlushiePhoto(r, id, img, caption, takenAt, cover)
+	if err != nil {
+		a.discardSavedImage(img)
+		if errors.Is(err, errTooManyPhotos) {
+			respondError(w, http.StatusBadRequest, ErrTooManyPhotos)
+		} else if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		}
+		return
+	}
+
+	p, err := a.scanPhoto(a.DB.QueryRowContext(r.Context(),
+		`SELECT `+photoColumns+` FROM plushie_photos WHERE id = ?`, photoID).Scan)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	a.setPlushieETag(w, id)
+	respondJSON(w, http.StatusCreated, p)
+}
+
+// addPlushiePhoto stores an uploaded photo in the gallery, optionally as the new cover
+func (a *App) addPlushiePhoto(r *http.Request, plushieID int64, img *savedImage, caption, takenAt string, cover bool) (int64, error) {
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkPlushieIfMatch(tx, r, plushieID); err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	photoID, err := insertPlushiePhoto(tx, plushieID, img, caption, takenAt, now)
+	if err != nil {
+		return 0, err
+	}
+	var coverID int64
+	if cover {
+		coverID = photoID
+	}
+	if err := syncPlushieCover(tx, plushieID, coverID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, now, plushieID); err != nil {
+		return 0, err
+	}
+	return photoID, tx.Commit()
+}
+
+type photoUpdateRequest struct {
+	Caption *string `json:"caption"`
+	TakenAt *string `json:"taken_at"` // "" clears the date
+	Cover   bool    `json:"cover"`    // make this the cover photo
+}
+
+// HandleUpdatePhoto changes a photo's caption or taken-at date, or makes it
+// the cover. Fields left out of the JSON body are kept.
+func (a *App) HandleUpdatePhoto(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	photoID, err := parseURLInt64(r, "photoID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req photoUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	var caption, takenAt any
+	if req.Caption != nil {
+		*req.Caption = strings.TrimSpace(*req.Caption)
+		caption = *req.Caption
+	}
+	if req.TakenAt != nil {
+		takenAt = *req.TakenAt
+	}
+	if msg := validatePhotoFields(deref(req.Caption), deref(req.TakenAt)); msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+	defer tx.Rollback()
+
+	if !plushieIfMatchOrError(w, tx, r, id, ErrFailedToSavePhoto) {
+		return
+	}
+	now := time.Now().UTC()
+	res, err := tx.Exec(`
+		UPDATE plushie_photos
+		SET caption = COALESCE(?, caption),
+			taken_at = CASE WHEN ? THEN NULLIF(?, '') ELSE taken_at END,
+			updated_at = ?
+		WHERE id = ? AND plushie_id = ?
+	`, caption, req.TakenAt != nil, takenAt, now, photoID, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrPhotoNotFound)
+		return
+	}
+	if req.Cover {
+		if err := syncPlushieCover(tx, id, photoID); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+			return
+		}
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, now, id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+
+	p, err := a.scanPhoto(a.DB.QueryRowContext(r.Context(),
+		`SELECT `+photoColumns+` FROM plushie_photos WHERE id = ?`, photoID).Scan)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	a.setPlushieETag(w, id)
+	respondJSON(w, http.StatusOK, p)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// HandleReorderPhotos sets the gallery order from {"photo_ids": [...]}, which
+// must list every photo of the plushie exactly once
+func (a *App) HandleReorderPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req struct {
+		PhotoIDs []int64 `json:"photo_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+	defer tx.Rollback()
+
+	if !plushieIfMatchOrError(w, tx, r, id, ErrFailedToSavePhoto) {
+		return
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM plushie_photos WHERE plushie_id = ?`, id).Scan(&count); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+	seen := map[int64]bool{}
+	for _, photoID := range req.PhotoIDs {
+		seen[photoID] = true
+	}
+	if len(req.PhotoIDs) != count || len(seen) != count {
+		respondError(w, http.StatusBadRequest, ErrInvalidPhotoOrder)
+		return
+	}
+	for i, photoID := range req.PhotoIDs {
+		res, err := tx.Exec(`UPDATE plushie_photos SET position = ? WHERE id = ? AND plushie_id = ?`, i, photoID, id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+			return
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			respondError(w, http.StatusBadRequest, ErrInvalidPhotoOrder)
+			return
+		}
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, time.Now().UTC(), id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSavePhoto)
+		return
+	}
+
+	photos, err := a.listPlushiePhotos(r, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListPhotos)
+		return
+	}
+	a.setPlushieETag(w, id)
+	respondJSON(w, http.StatusOK, photos)
+}
+
+// HandleDeletePhoto removes a photo from the gallery. If it was the cover, the
+// first remaining photo becomes the cover.
+func (a *App) HandleDeletePhoto(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	photoID, err := parseURLInt64(r, "photoID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePhoto)
+		return
+	}
+	defer tx.Rollback()
+
+	if !plushieIfMatchOrError(w, tx, r, id, ErrFailedToDeletePhoto) {
+		return
+	}
+	res, err := tx.Exec(`DELETE FROM plushie_photos WHERE id = ? AND plushie_id = ?`, photoID, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePhoto)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrPhotoNotFound)
+		return
+	}
+	if err := syncPlushieCover(tx, id, 0); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePhoto)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, time.Now().UTC(), id); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePhoto)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePhoto)
+		return
+	}
+	// The photo's images were queued for deletion by a trigger
+	a.cleanupImagesAsync()
+
+	a.setPlushieETag(w, id)
+	w.WriteHeader(http.StatusNoContent)
+}
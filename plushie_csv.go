@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxCSVImportRows caps the data rows of an imported CSV
+const MaxCSVImportRows = 1000
+
+// CSV column targets. A column mapped to csvCustom is kept in the notes as a
+// "header: value" line, since plushies have no free-form fields of their own.
+const (
+	csvCustom = "custom"
+	csvIgnore = "ignore"
+)
+
+// plushieCSVHeader is the header of the exported CSV
+var plushieCSVHeader = []string{"id", "name", "kind", "adopted_at", "notes", "tags", "created_at", "updated_at"}
+
+// csvColumnAliases maps header names, lower-cased, to the column they fill
+// when no mapping is given. Columns written by the export that can't be
+// imported are ignored; any other column is custom.
+var csvColumnAliases = map[string]string{
+	"name": "name", "名前": "name",
+	"kind": "kind", "種類": "kind",
+	"adopted_at": "adopted_at", "お迎え日": "adopted_at",
+	"notes": "notes", "メモ": "notes",
+	"tags": "tags", "タグ": "tags",
+	"id": csvIgnore, "created_at": csvIgnore, "updated_at": csvIgnore,
+}
+
+// csvDateLayouts are the adoption date formats accepted on import. Single
+// digit layouts also accept zero-padded numbers.
+var csvDateLayouts = []string{"2006-1-2", "2006/1/2", "2006.1.2", "2006年1月2日"}
+
+// CSVImportReport is the result of a CSV import, with one entry per data row
+type CSVImportReport struct {
+	Atomic  bool           `json:"atomic"`
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	Rows    []CSVRowResult `json:"rows"`
+}
+
+// CSVRowResult is the outcome of one row. Row is the line number in the file,
+// counting the header as 1.
+type CSVRowResult struct {
+	Row    int           `json:"row"`
+	Name   string        `json:"name"`
+	ID     int64         `json:"id,omitempty"` // set once the plushie is created
+	Errors []CSVRowError `json:"errors,omitempty"`
+}
+
+type CSVRowError struct {
+	Column  string `json:"column,omitempty"` // header of the offending column
+	Message string `json:"message"`
+}
+
+// csvPlushie is a validated row
+type csvPlushie struct {
+	name, kind, adoptedAt, notes string
+	tags                         []string
+}
+
+// HandleExportPlushiesCSV downloads the user's plushies as CSV
+// (GET /api/plushies.csv). It takes the sort and filter parameters of
+// GET /api/plushies; the whole list is always exported.
+func (a *App) HandleExportPlushiesCSV(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	lq, msg := parsePlushieListQuery(r.URL.Query())
+	if msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	sortExpr := plushieSortColumns[strings.TrimPrefix(lq.Sort, "-")]
+	dir := "ASC"
+	if strings.HasPrefix(lq.Sort, "-") {
+		dir = "DESC"
+	}
+	where, args := lq.filterSQL(userID)
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT id, name, kind, COALESCE(adopted_at, ''), notes, `+plushieTagsExpr+`, created_at, updated_at
+		FROM plushies WHERE `+where+fmt.Sprintf(` ORDER BY %s %s, id %s`, sortExpr, dir, dir), append([]any{userID}, args...)...)
+	if err != nil {
+		log.Printf("API Error [csv export]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToExportCSV)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="plushies-%s.csv"`, time.Now().UTC().Format("20060102")))
+	// The BOM makes Excel read the file as UTF-8
+	io.WriteString(w, "\uFEFF")
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	cw.Write(plushieCSVHeader)
+	for rows.Next() {
+		var id int64
+		var name, kind, adoptedAt, notes string
+		var tags sql.NullString
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&id, &name, &kind, &adoptedAt, &notes, &tags, &createdAt, &updatedAt); err != nil {
+			log.Printf("API Error [csv export]: %v", err)
+			return
+		}
+		tagNames, err := parsePlushieTags(tags)
+		if err != nil {
+			log.Printf("API Error [csv export]: %v", err)
+			return
+		}
+		cw.Write([]string{
+			strconv.FormatInt(id, 10), csvEscape(name), csvEscape(kind), adoptedAt, csvEscape(notes),
+			csvEscape(strings.Join(tagNames, ", ")),
+			createdAt.UTC().Format(time.RFC3339), updatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		// The response has started, so the client can only see a truncated file
+		log.Printf("API Error [csv export]: %v", err)
+	}
+	cw.Flush()
+}
+
+// csvEscape keeps spreadsheets from running a value as a formula by prefixing
+// it with an apostrophe. csvUnescape undoes it on import.
+func csvEscape(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvUnescape(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// HandleImportPlushiesCSV creates plushies from a CSV sent as the multipart
+// field "file" (POST /api/plushies.csv). The first row is the header. The
+// optional form field "mapping" is a JSON object from header to name, kind,
+// adopted_at, notes, tags, custom or ignore; headers it leaves out are mapped
+// by csvColumnAliases.
+//
+// Every row is validated and reported. By default the valid rows are created
+// and the others skipped; with ?atomic=true nothing is created unless every
+// row is valid, and the report is returned with 422 otherwise.
+func (a *App) HandleImportPlushiesCSV(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+	atomic := r.URL.Query().Get("atomic") == "true"
+
+	r.Body = http.MaxBytesReader(w, r.Body, a.Config.MaxUploadSize)
+	if err := r.ParseMultipartForm(a.Config.MaxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge, ErrImportTooLarge)
+		} else {
+			respondError(w, http.StatusBadRequest, ErrFailedToParseForm)
+		}
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var mapping map[string]string
+	if s := r.FormValue("mapping"); s != "" {
+		if err := json.Unmarshal([]byte(s), &mapping); err != nil {
+			respondError(w, http.StatusBadRequest, ErrInvalidCSVMapping)
+			return
+		}
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrCSVFileRequired)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, ErrInvalidCSV)
+		return
+	}
+	data = bytes.TrimPrefix(data, []byte("\uFEFF"))
+	if !utf8.Valid(data) {
+		respondError(w, http.StatusBadRequest, ErrCSVNotUTF8)
+		return
+	}
+
+	report, plushies, msg := parsePlushieCSV(data, mapping)
+	if msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	report.Atomic = atomic
+	if atomic && report.Failed > 0 {
+		respondJSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	if err := a.ensureUserExistsFromRequest(r, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToImportCSV)
+		return
+	}
+	if err := a.importCSVPlushies(r, userID, report, plushies); err != nil {
+		log.Printf("API Error [csv import]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToImportCSV)
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
+
+// parsePlushieCSV validates every row. plushies holds the valid rows by their
+// index in report.Rows. A message is returned when the file as a whole can't be
+// imported.
+func parsePlushieCSV(data []byte, mapping map[string]string) (report *CSVImportReport, plushies map[int]*csvPlushie, msg string) {
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, ErrCSVNameColumnRequired
+	}
+	if err != nil {
+		return nil, nil, ErrInvalidCSV
+	}
+	targets, msg := csvColumnTargets(header, mapping)
+	if msg != "" {
+		return nil, nil, msg
+	}
+
+	report = &CSVImportReport{Rows: []CSVRowResult{}}
+	plushies = map[int]*csvPlushie{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, ErrInvalidCSV + ": " + err.Error()
+		}
+		if isBlankCSVRecord(record) {
+			continue
+		}
+		if len(report.Rows) == MaxCSVImportRows {
+			return nil, nil, ErrCSVTooManyRows
+		}
+		line, _ := cr.FieldPos(0)
+		p, errs := parseCSVRecord(header, targets, record)
+		res := CSVRowResult{Row: line, Name: p.name, Errors: errs}
+		if len(errs) > 0 {
+			report.Failed++
+		} else {
+			plushies[len(report.Rows)] = p
+		}
+		report.Rows = append(report.Rows, res)
+	}
+	return report, plushies, ""
+}
+
+// csvColumnTargets resolves what each column fills
+func csvColumnTargets(header []string, mapping map[string]string) ([]string, string) {
+	for h, t := range mapping {
+		switch t {
+		case "name", "kind", "adopted_at", "notes", "tags", csvCustom, csvIgnore:
+		default:
+			return nil, ErrInvalidCSVMapping + ": " + h
+		}
+	}
+	targets := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		t, ok := mapping[h]
+		if !ok {
+			if t, ok = csvColumnAliases[strings.ToLower(h)]; !ok {
+				t = csvCustom
+			}
+		}
+		if t == csvCustom && h == "" {
+			t = csvIgnore
+		}
+		if t != csvCustom && t != csvIgnore {
+			if seen[t] {
+				return nil, ErrCSVDuplicateColumn + ": " + t
+			}
+			seen[t] = true
+		}
+		targets[i] = t
+	}
+	if !seen["name"] {
+		return nil, ErrCSVNameColumnRequired
+	}
+	return targets, ""
+}
+
+func isBlankCSVRecord(record []string) bool {
+	for _, v := range record {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCSVRecord validates a row like the plushie form does
+func parseCSVRecord(header, targets, record []string) (*csvPlushie, []CSVRowError) {
+	p := &csvPlushie{}
+	var errs []CSVRowError
+	if len(record) != len(header) {
+		errs = append(errs, CSVRowError{Message: ErrCSVColumnCount})
+	}
+	var custom []string
+	for i, t := range targets {
+		if i >= len(record) {
+			break
+		}
+		v := csvUnescape(record[i])
+		column := strings.TrimSpace(header[i])
+		switch t {
+		case "name":
+			p.name = strings.TrimSpace(v)
+		case "kind":
+			p.kind = strings.TrimSpace(v)
+		case "notes":
+			p.notes = v
+		case "adopted_at":
+			date, ok := parseCSVDate(v)
+			if !ok {
+				errs = append(errs, CSVRowError{Column: column, Message: ErrInvalidAdoptedAt})
+			}
+			p.adoptedAt = date
+		case "tags":
+			tags, msg := parseCSVTags(v)
+			if msg != "" {
+				errs = append(errs, CSVRowError{Column: column, Message: msg})
+			}
+			p.tags = tags
+		case csvCustom:
+			if v = strings.TrimSpace(v); v != "" {
+				custom = append(custom, column+": "+v)
+			}
+		}
+	}
+	if p.name == "" {
+		errs = append(errs, CSVRowError{Column: csvColumnFor(header, targets, "name"), Message: ErrNameRequired})
+	}
+	if len(custom) > 0 {
+		if p.notes != "" {
+			p.notes += "\n\n"
+		}
+		p.notes += strings.Join(custom, "\n")
+	}
+	return p, errs
+}
+
+func csvColumnFor(header, targets []string, target string) string {
+	for i, t := range targets {
+		if t == target {
+			return strings.TrimSpace(header[i])
+		}
+	}
+	return ""
+}
+
+// parseCSVDate normalizes an adoption date to yyyy-mm-dd. An empty value is
+// no date.
+func parseCSVDate(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", true
+	}
+	for _, layout := range csvDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format("2006-01-02"), true
+		}
+	}
+	return "", false
+}
+
+// parseCSVTags splits a tags cell on commas or semicolons and validates the
+// names like PUT /plushies/{id}/tags
+func parseCSVTags(s string) ([]string, string) {
+	var names []string
+	seen := map[string]bool{}
+	for _, n := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' || r == '、' }) {
+		if strings.TrimSpace(n) == "" {
+			continue
+		}
+		name, msg := normalizeTagName(n)
+		if msg != "" {
+			return nil, msg
+		}
+		if key := strings.ToLower(name); !seen[key] {
+			seen[key] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) > MaxTagsPerPlushie {
+		return nil, ErrTooManyTags
+	}
+	return names, ""
+}
+
+// importCSVPlushies creates the valid rows in one transaction and fills in
+// their IDs
+func (a *App) importCSVPlushies(r *http.Request, userID string, report *CSVImportReport, plushies map[int]*csvPlushie) error {
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	householdID, err := personalHouseholdID(tx, userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	ids := map[int]int64{}
+	for i := range report.Rows {
+		p := plushies[i]
+		if p == nil {
+			continue
+		}
+		res, err := tx.Exec(`
+			INSERT INTO plushies (user_id, household_id, name, kind, adopted_at, notes, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, householdID, p.name, p.kind, nullIfEmpty(p.adoptedAt), p.notes, now, now)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := addPlushieTags(tx, id, userID, p.tags, now); err != nil {
+			return err
+		}
+		if err := recordRevision(tx, id, userID, RevisionImport, emptyPlushieSnapshot(), nil); err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		report.Rows[i].ID = id
+	}
+	report.Created = len(ids)
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Plushie list pagination. Without limit or cursor the whole list is returned,
+// as before pagination existed.
+const (
+	DefaultPlushiePageSize = 50 // used when only cursor is given
+	MaxPlushiePageSize     = 200
+	defaultPlushieSort     = "-created_at"
+)
+
+// plushieSortColumns maps the sort keys of GET /api/plushies to SQL expressions.
+// NULL adoption dates sort as the empty string so they can be compared in cursors.
+var plushieSortColumns = map[string]string{
+	"name":       "name",
+	"kind":       "kind",
+	"adopted_at": "COALESCE(adopted_at, '')",
+	"updated_at": "updated_at",
+	"created_at": "created_at",
+}
+
+// plushieListQuery is the parsed query string of GET /api/plushies
+type plushieListQuery struct {
+	Sort         string // key of plushieSortColumns, "-" prefixed for descending
+	Limit        int    // 0 returns everything
+	Cursor       *plushieCursor
+	Kinds        []string
+	AdoptedFrom  string // yyyy-mm-dd, inclusive
+	AdoptedTo    string // yyyy-mm-dd, inclusive
+	Tags         []string
+	CollectionID int64 // 0 for no collection filter
+	Fields       map[string]bool
+	ExcludeField bool // Fields lists the fields to leave out rather than to include
+}
+
+// plushieCursor marks a position in a sorted plushie list. It is sent to
+// clients as opaque base64url-encoded JSON.
+type plushieCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"` // sort column value of the plushie at the edge of the page
+	ID   int64  `json:"i"`
+	Prev bool   `json:"p,omitempty"` // page backwards from the position
+}
+
+func (c *plushieCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePlushieCursor(s string) (*plushieCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c plushieCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// plushieJSONFields are the fields that may be named in ?fields=
+var plushieJSONFields = map[string]bool{
+	"id": true, "household_id": true, "name": true, "kind": true, "adopted_at": true, "notes": true, "tags": true,
+	"image_url": true, "medium_image_url": true, "thumbnail_url": true,
+	"conversation_history": true, "created_at": true, "modified_at": true,
+}
+
+// parsePlushieListQuery validates the query string and returns the error message to show on failure
+func parsePlushieListQuery(q url.Values) (*plushieListQuery, string) {
+	lq := &plushieListQuery{Sort: defaultPlushieSort}
+
+	if s := q.Get("sort"); s != "" {
+		if _, ok := plushieSortColumns[strings.TrimPrefix(s, "-")]; !ok {
+			return nil, ErrInvalidSort
+		}
+		lq.Sort = s
+	}
+	if s := q.Get("cursor"); s != "" {
+		c, err := decodePlushieCursor(s)
+		if err != nil || c.Sort != lq.Sort {
+			return nil, ErrInvalidPagination
+		}
+		lq.Cursor = c
+		lq.Limit = DefaultPlushiePageSize
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, ErrInvalidPagination
+		}
+		lq.Limit = min(n, MaxPlushiePageSize)
+	}
+
+	for _, kind := range q["kind"] {
+		if kind != "" {
+			lq.Kinds = append(lq.Kinds, kind)
+		}
+	}
+	for _, tag := range q["tag"] {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			lq.Tags = append(lq.Tags, tag)
+		}
+	}
+	if s := q.Get("collection"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, ErrInvalidID
+		}
+		lq.CollectionID = id
+	}
+	for _, p := range []struct {
+		dst   *string
+		param string
+	}{{&lq.AdoptedFrom, "adopted_from"}, {&lq.AdoptedTo, "adopted_to"}} {
+		if s := q.Get(p.param); s != "" {
+			if _, err := time.Parse("2006-01-02", s); err != nil {
+				return nil, ErrInvalidFilter
+			}
+			*p.dst = s
+		}
+	}
+
+	if s := q.Get("fields"); s != "" {
+		lq.Fields = map[string]bool{}
+		for i, f := range strings.Split(s, ",") {
+			f = strings.TrimSpace(f)
+			exclude := strings.HasPrefix(f, "-")
+			if i == 0 {
+				lq.ExcludeField = exclude
+			} else if exclude != lq.ExcludeField {
+				return nil, ErrInvalidFields
+			}
+			f = strings.TrimPrefix(f, "-")
+			if !plushieJSONFields[f] {
+				return nil, ErrInvalidFields
+			}
+			lq.Fields[f] = true
+		}
+	}
+	return lq, ""
+}
+
+// wants reports whether a JSON field is part of the response
+func (lq *plushieListQuery) wants(field string) bool {
+	if lq.Fields == nil {
+		return true
+	}
+	return lq.Fields[field] != lq.ExcludeField
+}
+
+// filterSQL returns the WHERE condition selecting the plushies of the user's
+// households that match the filters, and its arguments
+func (lq *plushieListQuery) filterSQL(userID string) (string, []any) {
+	where := householdAccess("household_id", permView) + ` AND deleted_at IS NULL`
+	args := []any{userID}
+	if len(lq.Kinds) > 0 {
+		where += ` AND kind IN (?` + strings.Repeat(`, ?`, len(lq.Kinds)-1) + `)`
+		for _, k := range lq.Kinds {
+			args = append(args, k)
+		}
+	}
+	for _, tag := range lq.Tags {
+		where += ` AND id IN (
+			SELECT pt.plushie_id FROM plushie_tags pt JOIN tags t ON t.id = pt.tag_id
+			WHERE t.user_id = ? AND t.name = ? COLLATE NOCASE)`
+		args = append(args, userID, tag)
+	}
+	if lq.CollectionID != 0 {
+		where += ` AND id IN (
+			SELECT cp.plushie_id FROM collection_plushies cp JOIN collections c ON c.id = cp.collection_id
+			WHERE c.id = ? AND c.user_id = ?)`
+		args = append(args, lq.CollectionID, userID)
+	}
+	if lq.AdoptedFrom != "" {
+		where += ` AND adopted_at >= ?`
+		args = append(args, lq.AdoptedFrom)
+	}
+	if lq.AdoptedTo != "" {
+		// adopted_at may carry a time after the date
+		where += ` AND substr(adopted_at, 1, 10) <= ?`
+		args = append(args, lq.AdoptedTo)
+	}
+	return where, args
+}
+
+// HandleListPlushies lists the user's plushies (GET /api/plushies).
+//
+// Query parameters:
+//
+//	sort          name, kind, adopted_at, updated_at or created_at; prefix with - for
+//	              descending (default -created_at)
+//	limit, cursor page size and position; next/prev page URLs are sent in the Link header
+//	kind          only plushies of this kind (may be repeated)
+//	tag           only plushies carrying this tag, ignoring case (may be repeated;
+//	              all tags must match)
+//	collection    only plushies in the collection with this ID
+//	adopted_from, adopted_to
+//	              adoption date range (yyyy-mm-dd, inclusive)
+//	fields        comma-separated fields to return, or to omit when prefixed
+//	              with - (e.g. fields=-conversation_history)
+//
+// The response is always a JSON array.
+func (a *App) HandleListPlushies(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	lq, msg := parsePlushieListQuery(r.URL.Query())
+	if msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	sortKey := strings.TrimPrefix(lq.Sort, "-")
+	sortExpr := plushieSortColumns[sortKey]
+	desc := strings.HasPrefix(lq.Sort, "-")
+	// Walking backwards from a cursor flips the order; the page is reversed afterwards
+	backwards := lq.Cursor != nil && lq.Cursor.Prev
+	if backwards {
+		desc = !desc
+	}
+
+	columns := plushieColumns
+	if !lq.wants("conversation_history") {
+		// Skip rebuilding the history from conversation_messages
+		columns = strings.Replace(columns, conversationHistoryExpr, "NULL", 1)
+	}
+	where, args := lq.filterSQL(userID)
+	if lq.wants("tags") {
+		args = append([]any{userID}, args...)
+	} else {
+		columns = strings.Replace(columns, plushieTagsExpr, "NULL", 1)
+	}
+	query := `SELECT ` + columns + `, CAST(` + sortExpr + ` AS TEXT) FROM plushies WHERE ` + where
+	cmp, dir := ">", "ASC"
+	if desc {
+		cmp, dir = "<", "DESC"
+	}
+	if lq.Cursor != nil {
+		query += fmt.Sprintf(` AND (CAST(%s AS TEXT) %s ? OR (CAST(%s AS TEXT) = ? AND id %s ?))`, sortExpr, cmp, sortExpr, cmp)
+		args = append(args, lq.Cursor.Key, lq.Cursor.Key, lq.Cursor.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY CAST(%s AS TEXT) %s, id %s`, sortExpr, dir, dir)
+	if lq.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, lq.Limit+1)
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListPlushies)
+		return
+	}
+	defer rows.Close()
+
+	items := []Plushie{}
+	var keys []string
+	for rows.Next() {
+		var key string
+		p, err := a.scanPlushieFromRow(func(dest ...any) error {
+			return rows.Scan(append(dest, &key)...)
+		})
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		items = append(items, *p)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+
+	hasMore := lq.Limit > 0 && len(items) > lq.Limit
+	if hasMore {
+		items, keys = items[:lq.Limit], keys[:lq.Limit]
+	}
+	if backwards {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	if lq.Limit > 0 && len(items) > 0 {
+		// Coming from a cursor there is always a page on the side we came from
+		hasNext, hasPrev := hasMore, lq.Cursor != nil
+		if backwards {
+			hasNext, hasPrev = true, hasMore
+		}
+		var links []string
+		if hasNext {
+			last := len(items) - 1
+			c := &plushieCursor{Sort: lq.Sort, Key: keys[last], ID: items[last].ID}
+			links = append(links, plushiePageLink(r, lq, c, "next"))
+		}
+		if hasPrev {
+			c := &plushieCursor{Sort: lq.Sort, Key: keys[0], ID: items[0].ID, Prev: true}
+			links = append(links, plushiePageLink(r, lq, c, "prev"))
+		}
+		if len(links) > 0 {
+			w.Header().Set("Link", strings.Join(links, ", "))
+		}
+	}
+
+	if lq.Fields == nil {
+		respondJSON(w, http.StatusOK, items)
+		return
+	}
+	selected := make([]map[string]json.RawMessage, 0, len(items))
+	for _, p := range items {
+		b, err := json.Marshal(p)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		for f := range m {
+			if !lq.wants(f) {
+				delete(m, f)
+			}
+		}
+		selected = append(selected, m)
+	}
+	respondJSON(w, http.StatusOK, selected)
+}
+
+// plushiePageLink formats a Link header entry for another page, keeping the other query parameters
+func plushiePageLink(r *http.Request, lq *plushieListQuery, c *plushieCursor, rel string) string {
+	q := r.URL.Query()
+	q.Set("cursor", c.encode())
+	q.Set("limit", strconv.Itoa(lq.Limit))
+	u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+}
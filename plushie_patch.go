@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MergePatchContentType is the media type accepted by PATCH /api/plushies/{id}
+const MergePatchContentType = "application/merge-patch+json"
+
+// patchablePlushieFields are the plushie columns a merge patch may change
+var patchablePlushieFields = []string{"name", "kind", "adopted_at", "notes"}
+
+// parsePlushiePatch validates a merge patch and returns the new column values,
+// or the error message to show. null clears a field; adopted_at is then
+// stored as NULL and the other text fields as "".
+func parsePlushiePatch(patch map[string]json.RawMessage) (map[string]any, string) {
+	for field := range patch {
+		if !slices.Contains(patchablePlushieFields, field) {
+			return nil, ErrInvalidPatchField
+		}
+	}
+
+	values := map[string]any{}
+	for _, field := range patchablePlushieFields {
+		raw, ok := patch[field]
+		if !ok {
+			continue
+		}
+		var s *string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, ErrInvalidPatchValue
+		}
+		switch field {
+		case "name":
+			if s == nil {
+				return nil, ErrNameRequired
+			}
+			if msg := checkPlushieName(*s); msg != "" {
+				return nil, msg
+			}
+			values[field] = *s
+		case "adopted_at":
+			if s == nil || *s == "" {
+				values[field] = nil
+				continue
+			}
+			if msg := checkAdoptedAt(*s); msg != "" {
+				return nil, msg
+			}
+			values[field] = *s
+		default:
+			values[field] = deref(s)
+		}
+	}
+	return values, ""
+}
+
+// checkPlushieName returns the error message for a blank name
+func checkPlushieName(name string) string {
+	if strings.TrimSpace(name) == "" {
+		return ErrNameRequired
+	}
+	return ""
+}
+
+// checkAdoptedAt returns the error message for an adoption date that isn't
+// YYYY-MM-DD; "" clears the date
+func checkAdoptedAt(date string) string {
+	if date == "" {
+		return ""
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return ErrInvalidAdoptedAt
+	}
+	return ""
+}
+
+// HandlePatchPlushie changes only the fields present in a JSON Merge Patch
+// (RFC 7396) body and returns the updated plushie. Unlike PUT, omitted fields
+// are left as they are.
+func (a *App) HandlePatchPlushie(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != MergePatchContentType {
+		respondError(w, http.StatusUnsupportedMediaType, ErrUnsupportedPatchType)
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	values, msg := parsePlushiePatch(patch)
+	if msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	if err := a.patchPlushie(r, id, userID, values); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToUpdatePlushie)
+		}
+		return
+	}
+
+	var version int64
+	p, err := a.scanPlushieFromRow(scanWithVersion(a.DB.QueryRow(`
+		SELECT `+plushieColumns+`, version
+		FROM plushies
+		WHERE id = ? AND deleted_at IS NULL AND `+householdAccess("household_id", permView),
+		userID, id, userID).Scan, &version))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondError(w, http.StatusNotFound, ErrPlushieNotFound)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToGetPlushie)
+		}
+		return
+	}
+	w.Header().Set("ETag", a.plushieETag(version))
+	respondJSON(w, http.StatusOK, p)
+}
+
+// patchPlushie writes the given column values and records the change as a
+// revision. An empty patch only checks If-Match.
+func (a *App) patchPlushie(r *http.Request, id int64, userID string, values map[string]any) error {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkPlushieIfMatch(tx, r, id); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	before, err := loadPlushieSnapshot(tx, id)
+	if err != nil {
+		return err
+	}
+
+	var sets []string
+	var args []any
+	for _, field := range patchablePlushieFields {
+		if v, ok := values[field]; ok {
+			sets = append(sets, field+" = ?")
+			args = append(args, v)
+		}
+	}
+	sets = append(sets, "updated_at = ?")
+	args = append(args, time.Now().UTC(), id, userID)
+	_, err = tx.Exec(`UPDATE plushies SET `+strings.Join(sets, ", ")+
+		` WHERE id = ? AND deleted_at IS NULL AND `+householdAccess("household_id", permEdit), args...)
+	if err != nil {
+		return err
+	}
+	if err := recordRevision(tx, id, userID, RevisionUpdate, before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Revision actions: what kind of request made the change
+const (
+	RevisionCreate       = "create"
+	RevisionUpdate       = "update"
+	RevisionConversation = "conversation" // PUT /conversation
+	RevisionMessage      = "message"
+	RevisionChat         = "chat"
+	RevisionRevert       = "revert"
+	RevisionImport       = "import" // POST /api/import and /api/plushies.csv
+)
+
+// Revision list pagination
+const (
+	DefaultRevisionPageSize = 50
+	MaxRevisionPageSize     = 200
+)
+
+// revisionFields are the plushie columns tracked by revisions, in display order
+var revisionFields = []string{"name", "kind", "adopted_at", "notes"}
+
+// Revision is one recorded change to a plushie
+type Revision struct {
+	ID         int64        `json:"id"`
+	PlushieID  int64        `json:"plushie_id"`
+	Action     string       `json:"action"`
+	UserID     string       `json:"user_id"`
+	Email      string       `json:"email"`
+	RevertedTo *int64       `json:"reverted_to,omitempty"` // the revision a revert went back to
+	Changes    revisionDiff `json:"changes"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+// revisionDiff holds the old and new values of what a revision changed.
+// Conversations are diffed message by message, so appending a message only
+// stores that message.
+type revisionDiff struct {
+	Fields   []FieldChange   `json:"fields"`
+	Messages *MessageChanges `json:"messages,omitempty"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type MessageChanges struct {
+	Added   []revisionMessage `json:"added,omitempty"`
+	Removed []revisionMessage `json:"removed,omitempty"`
+	Edited  []MessageEdit     `json:"edited,omitempty"`
+}
+
+type MessageEdit struct {
+	Old revisionMessage `json:"old"`
+	New revisionMessage `json:"new"`
+}
+
+type revisionMessage struct {
+	ID        int64     `json:"id"`
+	Speaker   string    `json:"speaker"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (m revisionMessage) equal(o revisionMessage) bool {
+	return m.Speaker == o.Speaker && m.Role == o.Role && m.Content == o.Content && m.Timestamp.Equal(o.Timestamp)
+}
+
+// plushieSnapshot is the revisioned state of a plushie
+type plushieSnapshot struct {
+	Fields   map[string]string
+	Messages map[int64]revisionMessage
+}
+
+func emptyPlushieSnapshot() *plushieSnapshot {
+	s := &plushieSnapshot{Fields: map[string]string{}, Messages: map[int64]revisionMessage{}}
+	for _, f := range revisionFields {
+		s.Fields[f] = ""
+	}
+	return s
+}
+
+// loadPlushieSnapshot reads the revisioned state of a plushie inside tx
+func loadPlushieSnapshot(tx *sql.Tx, plushieID int64) (*plushieSnapshot, error) {
+	s := emptyPlushieSnapshot()
+	var name, kind, adoptedAt, notes string
+	err := tx.QueryRow(`SELECT name, kind, COALESCE(adopted_at, ''), notes FROM plushies WHERE id = ?`,
+		plushieID).Scan(&name, &kind, &adoptedAt, &notes)
+	if err != nil {
+		return nil, err
+	}
+	s.Fields["name"], s.Fields["kind"], s.Fields["adopted_at"], s.Fields["notes"] = name, kind, adoptedAt, notes
+
+	rows, err := tx.Query(`SELECT id, speaker, role, content, timestamp FROM conversation_messages WHERE plushie_id = ?`, plushieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m revisionMessage
+		if err := rows.Scan(&m.ID, &m.Speaker, &m.Role, &m.Content, &m.Timestamp); err != nil {
+			return nil, err
+		}
+		s.Messages[m.ID] = m
+	}
+	return s, rows.Err()
+}
+
+// diffSnapshots lists what changed from before to after. Messages are sorted by ID.
+func diffSnapshots(before, after *plushieSnapshot) revisionDiff {
+	d := revisionDiff{Fields: []FieldChange{}}
+	for _, f := range revisionFields {
+		if before.Fields[f] != after.Fields[f] {
+			d.Fields = append(d.Fields, FieldChange{Field: f, Old: before.Fields[f], New: after.Fields[f]})
+		}
+	}
+
+	mc := &MessageChanges{}
+	for _, id := range sortedMessageIDs(before.Messages, after.Messages) {
+		old, hadOld := before.Messages[id]
+		m, hasNew := after.Messages[id]
+		switch {
+		case !hadOld:
+			mc.Added = append(mc.Added, m)
+		case !hasNew:
+			mc.Removed = append(mc.Removed, old)
+		case !old.equal(m):
+			mc.Edited = append(mc.Edited, MessageEdit{Old: old, New: m})
+		}
+	}
+	if len(mc.Added)+len(mc.Removed)+len(mc.Edited) > 0 {
+		d.Messages = mc
+	}
+	return d
+}
+
+func sortedMessageIDs(a, b map[int64]revisionMessage) []int64 {
+	var ids []int64
+	for id := range a {
+		ids = append(ids, id)
+	}
+	for id := range b {
+		if _, ok := a[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (d revisionDiff) empty() bool {
+	return len(d.Fields) == 0 && d.Messages == nil
+}
+
+// undo turns s from the state after the revision back into the state before it
+func (d revisionDiff) undo(s *plushieSnapshot) {
+	for _, c := range d.Fields {
+		s.Fields[c.Field] = c.Old
+	}
+	if d.Messages == nil {
+		return
+	}
+	for _, m := range d.Messages.Added {
+		delete(s.Messages, m.ID)
+	}
+	for _, m := range d.Messages.Removed {
+		s.Messages[m.ID] = m
+	}
+	for _, e := range d.Messages.Edited {
+		s.Messages[e.Old.ID] = e.Old
+	}
+}
+
+// recordRevision stores the difference between before and the plushie's
+// current state in tx. Nothing is stored if nothing changed.
+func recordRevision(tx *sql.Tx, plushieID int64, userID, action string, before *plushieSnapshot, revertedTo *int64) error {
+	after, err := loadPlushieSnapshot(tx, plushieID)
+	if err != nil {
+		return err
+	}
+	d := diffSnapshots(before, after)
+	if d.empty() {
+		return nil
+	}
+	changes, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO plushie_revisions (plushie_id, user_id, action, changes, reverted_to, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, plushieID, userID, action, string(changes), revertedTo, time.Now().UTC())
+	return err
+}
+
+const revisionColumns = `r.id, r.plushie_id, r.action, r.user_id, COALESCE(u.email, ''), r.reverted_to, r.changes, r.created_at`
+
+func scanRevision(scan func(dest ...any) error) (*Revision, error) {
+	var rev Revision
+	var revertedTo sql.NullInt64
+	var changes string
+	err := scan(&rev.ID, &rev.PlushieID, &rev.Action, &rev.UserID, &rev.Email, &revertedTo, &changes, &rev.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revertedTo.Valid {
+		rev.RevertedTo = &revertedTo.Int64
+	}
+	if err := json.Unmarshal([]byte(changes), &rev.Changes); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// HandleListRevisions returns a page of a plushie's revisions, newest first.
+// Older pages are fetched with the before cursor, as for messages.
+func (a *App) HandleListRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := DefaultRevisionPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			respondError(w, http.StatusBadRequest, ErrInvalidPagination)
+			return
+		}
+		limit = min(n, MaxRevisionPageSize)
+	}
+	var before int64
+	if s := r.URL.Query().Get("before"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			respondError(w, http.StatusBadRequest, ErrInvalidPagination)
+			return
+		}
+		before = n
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permView) {
+		return
+	}
+
+	query := `SELECT ` + revisionColumns + `
+		FROM plushie_revisions r LEFT JOIN users u ON u.supabase_user_id = r.user_id
+		WHERE r.plushie_id = ?`
+	args := []any{id}
+	if before > 0 {
+		query += ` AND r.id < ?`
+		args = append(args, before)
+	}
+	query += ` ORDER BY r.id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := a.DB.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListRevisions)
+		return
+	}
+	defer rows.Close()
+
+	items := []Revision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows.Scan)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		items = append(items, *rev)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	resp := map[string]any{
+		"revisions": items,
+		"has_more":  hasMore,
+	}
+	if hasMore {
+		resp["next_before"] = items[len(items)-1].ID
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// HandleRevertRevision restores a plushie's profile and conversation to how
+// they were right after the given revision. The revert is itself recorded as
+// a revision, so it can be undone in turn.
+func (a *App) HandleRevertRevision(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	revisionID, err := parseURLInt64(r, "revisionID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	if err := a.revertPlushie(r, id, revisionID, userID); err != nil {
+		if errors.Is(err, errRevisionNotFound) {
+			respondError(w, http.StatusNotFound, ErrRevisionNotFound)
+		} else if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToRevert)
+		}
+		return
+	}
+
+	p, err := a.scanPlushieFromRow(a.DB.QueryRow(`SELECT `+plushieColumns+` FROM plushies WHERE id = ?`, userID, id).Scan)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToGetPlushie)
+		return
+	}
+	a.setPlushieETag(w, id)
+	respondJSON(w, http.StatusOK, p)
+}
+
+var errRevisionNotFound = errors.New(ErrRevisionNotFound)
+
+// revertPlushie undoes every revision after revisionID, newest first, and
+// writes the resulting state to the plushie
+func (a *App) revertPlushie(r *http.Request, plushieID, revisionID int64, userID string) error {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkPlushieIfMatch(tx, r, plushieID); err != nil {
+		return err
+	}
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM plushie_revisions WHERE id = ? AND plushie_id = ?`, revisionID, plushieID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errRevisionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := loadPlushieSnapshot(tx, plushieID)
+	if err != nil {
+		return err
+	}
+	target, err := loadPlushieSnapshot(tx, plushieID)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT changes FROM plushie_revisions WHERE plushie_id = ? AND id > ? ORDER BY id DESC`,
+		plushieID, revisionID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var changes string
+		var d revisionDiff
+		if err := rows.Scan(&changes); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal([]byte(changes), &d); err != nil {
+			rows.Close()
+			return err
+		}
+		d.undo(target)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	d := diffSnapshots(current, target)
+	if d.empty() {
+		return nil
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE plushies SET name = ?, kind = ?, adopted_at = ?, notes = ?, updated_at = ?
+		WHERE id = ?
+	`, target.Fields["name"], target.Fields["kind"], nullIfEmpty(target.Fields["adopted_at"]), target.Fields["notes"],
+		now, plushieID)
+	if err != nil {
+		return err
+	}
+	if m := d.Messages; m != nil {
+		for _, msg := range m.Added {
+			// Messages come back with their old IDs, which AUTOINCREMENT never reuses
+			_, err := tx.Exec(`
+				INSERT INTO conversation_messages (id, plushie_id, speaker, role, content, timestamp, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			`, msg.ID, plushieID, msg.Speaker, msg.Role, msg.Content, msg.Timestamp, now, now)
+			if err != nil {
+				return err
+			}
+		}
+		for _, msg := range m.Removed {
+			if _, err := tx.Exec(`DELETE FROM conversation_messages WHERE id = ?`, msg.ID); err != nil {
+				return err
+			}
+		}
+		for _, e := range m.Edited {
+			_, err := tx.Exec(`
+				UPDATE conversation_messages SET speaker = ?, role = ?, content = ?, timestamp = ?, updated_at = ?
+				WHERE id = ?
+			`, e.New.Speaker, e.New.Role, e.New.Content, e.New.Timestamp, now, e.New.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := recordRevision(tx, plushieID, userID, RevisionRevert, current, &revisionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
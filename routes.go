@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/cors"
+)
+
+// routes builds the HTTP handler with every API route
+func (a *App) routes() http.Handler {
+	allowedHeaders := []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "If-Match", "If-None-Match"}
+	// supabase-js sends these, also to the built-in identity provider
+	allowedHeaders = append(allowedHeaders, "apikey", "X-Client-Info", "X-Supabase-Api-Version")
+
+	r := chi.NewRouter()
+	r.Use(cors.Handler(cors.Options{
+		AllowedOrigins:   a.Config.CORSOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   allowedHeaders,
+		ExposedHeaders:   []string{"Link", "ETag"},
+		AllowCredentials: true,
+		MaxAge:           300,
+	}))
+
+	r.Route("/api", func(r chi.Router) {
+		r.Post("/register", a.HandleRegister)
+		r.Post("/login", a.HandleLogin)
+		r.Post("/logout", a.HandleLogout)
+		r.Get("/shared/{token}", a.HandleGetSharedPlushie)
+
+		r.Group(func(r chi.Router) {
+			r.Use(a.SessionMiddleware)
+			r.Get("/sessions", a.HandleListSessions)
+			r.Delete("/sessions", a.HandleRevokeAllSessions)
+			r.Delete("/sessions/{sessionID}", a.HandleRevokeSession)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(a.AuthMiddleware)
+			r.Get("/me", a.HandleMe)
+
+			r.Get("/search", a.HandleSearch)
+			r.Get("/plushies", a.HandleListPlushies)
+			r.Post("/plushies", a.HandleCreatePlushie)
+			r.Get("/plushies.csv", a.HandleExportPlushiesCSV)
+			r.Post("/plushies.csv", a.HandleImportPlushiesCSV)
+			r.Get("/plushies/{id}", a.HandleGetPlushie)
+			r.Put("/plushies/{id}", a.HandleUpdatePlushie)
+			r.Patch("/plushies/{id}", a.HandlePatchPlushie)
+			r.Put("/plushies/{id}/conversation", a.HandleUpdateConversation)
+			r.Get("/plushies/{id}/messages", a.HandleListMessages)
+			r.Post("/plushies/{id}/messages", a.HandleAppendMessage)
+			r.Put("/plushies/{id}/messages/{messageID}", a.HandleUpdateMessage)
+			r.Delete("/plushies/{id}/messages/{messageID}", a.HandleDeleteMessage)
+			r.With(routeTimeout(ChatTimeout)).Post("/plushies/{id}/chat", a.HandleChat)
+			r.With(routeTimeout(ChatStreamTimeout)).Post("/plushies/{id}/chat/stream", a.HandleChatStream)
+			r.Delete("/plushies/{id}", a.HandleDeletePlushie)
+			r.Put("/plushies/{id}/tags", a.HandleSetPlushieTags)
+			r.Get("/plushies/{id}/photos", a.HandleListPhotos)
+			r.Post("/plushies/{id}/photos", a.HandleAddPhoto)
+			r.Put("/plushies/{id}/photos/order", a.HandleReorderPhotos)
+			r.Put("/plushies/{id}/photos/{photoID}", a.HandleUpdatePhoto)
+			r.Delete("/plushies/{id}/photos/{photoID}", a.HandleDeletePhoto)
+			r.Get("/plushies/{id}/revisions", a.HandleListRevisions)
+			r.Post("/plushies/{id}/revisions/{revisionID}/revert", a.HandleRevertRevision)
+			r.Get("/plushies/{id}/shares", a.HandleListShareLinks)
+			r.Post("/plushies/{id}/shares", a.HandleCreateShareLink)
+			r.Delete("/plushies/{id}/shares/{shareID}", a.HandleRevokeShareLink)
+			r.Put("/plushies/{id}/household", a.HandleMovePlushie)
+
+			r.Get("/households", a.HandleListHouseholds)
+			r.Post("/households", a.HandleCreateHousehold)
+			r.Get("/households/{householdID}", a.HandleGetHousehold)
+			r.Put("/households/{householdID}", a.HandleUpdateHousehold)
+			r.Delete("/households/{householdID}", a.HandleDeleteHousehold)
+			r.Get("/households/{householdID}/invitations", a.HandleListHouseholdInvitations)
+			r.Post("/households/{householdID}/invitations", a.HandleCreateHouseholdInvitation)
+			r.Delete("/households/{householdID}/invitations/{invitationID}", a.HandleRevokeHouseholdInvitation)
+			r.Put("/households/{householdID}/members/{memberID}", a.HandleUpdateHouseholdMember)
+			r.Delete("/households/{householdID}/members/{memberID}", a.HandleRemoveHouseholdMember)
+			r.Post("/invitations/{token}/accept", a.HandleAcceptHouseholdInvitation)
+
+			r.With(routeTimeout(ArchiveTimeout)).Get("/export", a.HandleExport)
+			r.With(routeTimeout(ArchiveTimeout)).Post("/import", a.HandleImport)
+
+			r.Get("/trash", a.HandleListTrash)
+			r.Delete("/trash", a.HandleEmptyTrash)
+			r.Post("/trash/{id}/restore", a.HandleRestorePlushie)
+			r.Delete("/trash/{id}", a.HandlePurgePlushie)
+
+			r.Get("/tags", a.HandleListTags)
+			r.Post("/tags", a.HandleCreateTag)
+			r.Put("/tags/{tagID}", a.HandleRenameTag)
+			r.Delete("/tags/{tagID}", a.HandleDeleteTag)
+
+			r.Get("/collections", a.HandleListCollections)
+			r.Post("/collections", a.HandleCreateCollection)
+			r.Get("/collections/{collectionID}", a.HandleGetCollection)
+			r.Put("/collections/{collectionID}", a.HandleUpdateCollection)
+			r.Delete("/collections/{collectionID}", a.HandleDeleteCollection)
+			r.Put("/collections/{collectionID}/plushies", a.HandleSetCollectionPlushies)
+			r.Post("/collections/{collectionID}/plushies", a.HandleAddCollectionPlushies)
+			r.Delete("/collections/{collectionID}/plushies/{plushieID}", a.HandleRemoveCollectionPlushie)
+		})
+	})
+
+	// Supabase Auth compatible endpoints of the built-in identity provider
+	if a.LocalAuth != nil {
+		r.Route("/auth/v1", func(r chi.Router) {
+			r.Post("/signup", a.HandleAuthSignup)
+			r.Post("/token", a.HandleAuthToken)
+			r.Get("/user", a.HandleAuthUser)
+			r.Put("/user", a.HandleAuthUpdateUser)
+			r.Post("/logout", a.HandleAuthLogout)
+			r.Post("/recover", a.HandleAuthRecover)
+			r.Post("/verify", a.HandleAuthVerify)
+		})
+	}
+
+	// serve uploaded images to their owners or via signed URLs
+	r.Get("/uploads/{key}", a.HandleServeImage)
+	r.Head("/uploads/{key}", a.HandleServeImage)
+
+	return r
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search settings
+const (
+	DefaultSearchLimit      = 20
+	MaxSearchLimit          = 50
+	MaxSearchQueryLength    = 200 // runes
+	MaxSearchTerms          = 10
+	MaxSearchMessageMatches = 3  // message snippets returned per plushie
+	searchSnippetLength     = 80 // runes of context in a snippet
+	searchTrigramLength     = 3  // shorter terms can't use the trigram index
+)
+
+// SearchResult is a plushie matching a search, with highlighted snippets of
+// the fields and messages that matched. Snippets are HTML: text is escaped and
+// matches are wrapped in <mark>.
+type SearchResult struct {
+	Plushie  Plushie              `json:"plushie"`
+	Score    float64              `json:"score"` // higher is more relevant
+	Matches  []SearchFieldMatch   `json:"matches"`
+	Messages []SearchMessageMatch `json:"messages"`
+}
+
+type SearchFieldMatch struct {
+	Field   string `json:"field"` // name, kind or notes
+	Snippet string `json:"snippet"`
+}
+
+type SearchMessageMatch struct {
+	ID        int64     `json:"id"`
+	Speaker   string    `json:"speaker"`
+	Role      string    `json:"role"`
+	Timestamp time.Time `json:"timestamp"`
+	Snippet   string    `json:"snippet"`
+}
+
+// sqliteHasFTS5 reports whether SQLite was built with the FTS5 module, which
+// go-sqlite3 only includes with -tags sqlite_fts5
+func sqliteHasFTS5(q rowQuerier) (bool, error) {
+	var fts5 bool
+	err := q.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5)
+	return fts5, err
+}
+
+// ensureSearchIndex builds the full-text index if migrations ran without
+// FTS5 and the server now has it, replacing any index without message_search.
+// A database with an index can't be used without FTS5, since every write to
+// plushies would fail in its triggers.
+func ensureSearchIndex(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fts5, err := sqliteHasFTS5(tx)
+	if err != nil {
+		return err
+	}
+	exists, err := tableExists(tx, "message_search")
+	if err != nil {
+		return err
+	}
+	switch {
+	case fts5 && !exists:
+		log.Printf("Building the search index")
+		if err := dropSearchIndex(tx); err != nil {
+			return err
+		}
+		if err := createSearchIndex(tx); err != nil {
+			return err
+		}
+	case !fts5 && exists:
+		return errors.New("the database has a full-text search index but SQLite was built without FTS5; build the server with -tags sqlite_fts5")
+	case !fts5:
+		log.Printf("Warning: SQLite was built without FTS5; search will scan plushies without an index (build with -tags sqlite_fts5)")
+	}
+	return tx.Commit()
+}
+
+// parseSearchTerms splits a query on whitespace (including full-width spaces)
+func parseSearchTerms(q string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for _, t := range strings.Fields(q) {
+		if !seen[t] && len(terms) < MaxSearchTerms {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// ftsPhrase quotes a term as an FTS5 string so operators in it have no effect
+func ftsPhrase(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
+
+// likePattern matches values containing term
+func likePattern(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(term) + "%"
+}
+
+// HandleSearch searches the user's plushies by name, kind, notes and
+// conversation (GET /api/search?q=...&limit=...).
+//
+// All whitespace-separated terms must appear somewhere in the plushie or its
+// conversation. Results are ranked with BM25, weighting the name highest.
+// Terms of one or two characters can't use the trigram index and are
+// matched with a slower substring scan, as are all terms when SQLite was
+// built without FTS5.
+func (a *App) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	terms := parseSearchTerms(q)
+	if len(terms) == 0 {
+		respondError(w, http.StatusBadRequest, ErrSearchQueryRequired)
+		return
+	}
+	if utf8.RuneCountInString(q) > MaxSearchQueryLength {
+		respondError(w, http.StatusBadRequest, ErrSearchQueryTooLong)
+		return
+	}
+	limit := DefaultSearchLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			respondError(w, http.StatusBadRequest, ErrInvalidPagination)
+			return
+		}
+		limit = min(n, MaxSearchLimit)
+	}
+
+	indexed, err := tableExists(a.DB, "message_search")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSearch)
+		return
+	}
+	var conds, phrases []string
+	var condArgs []any
+	for _, t := range terms {
+		cond, args := searchTermCond(t, indexed)
+		conds = append(conds, cond)
+		condArgs = append(condArgs, args...)
+		if indexed && utf8.RuneCountInString(t) >= searchTrigramLength {
+			phrases = append(phrases, ftsPhrase(t))
+		}
+	}
+	rank, joins := `0.0`, ``
+	args := []any{userID} // plushieTagsExpr
+	if len(phrases) > 0 {
+		rank = `COALESCE(profile_rank.rank, 0.0) + COALESCE(message_rank.rank, 0.0)`
+		joins = searchRankJoins
+		match := strings.Join(phrases, " OR ")
+		args = append(args, match, match)
+	}
+
+	columns := strings.Replace(plushieColumns, conversationHistoryExpr, "NULL", 1)
+	query := `
+		SELECT ` + columns + `, ` + rank + ` AS search_rank
+		FROM plushies` + joins + `
+		WHERE ` + householdAccess("plushies.household_id", permView) + ` AND plushies.deleted_at IS NULL
+			AND ` + strings.Join(conds, " AND ") + `
+		ORDER BY search_rank, plushies.updated_at DESC
+		LIMIT ?`
+	args = append(args, userID)
+	args = append(args, condArgs...)
+	args = append(args, limit)
+
+	rows, err := a.DB.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSearch)
+		return
+	}
+	results := []SearchResult{}
+	for rows.Next() {
+		var res SearchResult
+		p, err := a.scanPlushieFromRow(func(dest ...any) error {
+			return rows.Scan(append(dest, &res.Score)...)
+		})
+		if err != nil {
+			rows.Close()
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		res.Plushie = *p
+		res.Score = -res.Score // bm25 is lower for better matches
+		results = append(results, res)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSearch)
+		return
+	}
+
+	for i := range results {
+		res := &results[i]
+		res.Matches = []SearchFieldMatch{}
+		for _, f := range []struct{ name, value string }{
+			{"name", res.Plushie.Name}, {"kind", res.Plushie.Kind}, {"notes", res.Plushie.Notes},
+		} {
+			if snippet, ok := highlightSnippet(f.value, terms); ok {
+				res.Matches = append(res.Matches, SearchFieldMatch{Field: f.name, Snippet: snippet})
+			}
+		}
+		res.Messages, err = a.searchMessages(r, res.Plushie.ID, terms)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSearch)
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{
+		"query":   q,
+		"results": results,
+	})
+}
+
+// searchTermCond returns a condition on plushies that holds if term appears
+// in the name, kind, notes or any message. With the index, terms long enough
+// for trigrams use it; the others are substring scans.
+func searchTermCond(term string, indexed bool) (string, []any) {
+	if indexed && utf8.RuneCountInString(term) >= searchTrigramLength {
+		p := ftsPhrase(term)
+		return `(plushies.id IN (SELECT rowid FROM plushie_search WHERE plushie_search MATCH ?)
+			OR plushies.id IN (
+				SELECT m.plushie_id FROM message_search JOIN conversation_messages m ON m.id = message_search.rowid
+				WHERE message_search MATCH ?
+			))`, []any{p, p}
+	}
+	p := likePattern(term)
+	return `(plushies.name LIKE ? ESCAPE '\' OR plushies.kind LIKE ? ESCAPE '\' OR plushies.notes LIKE ? ESCAPE '\'
+		OR plushies.id IN (SELECT plushie_id FROM conversation_messages WHERE content LIKE ? ESCAPE '\'))`, []any{p, p, p, p}
+}
+
+// searchRankJoins adds the BM25 rank of a plushie's profile and of its best
+// matching message. Both take the same MATCH expression.
+const searchRankJoins = `
+	LEFT JOIN (
+		-- Column weights: name, kind, notes
+		SELECT rowid AS plushie_id, bm25(plushie_search, 10.0, 5.0, 2.0) AS rank
+		FROM plushie_search WHERE plushie_search MATCH ?
+	) profile_rank ON profile_rank.plushie_id = plushies.id
+	LEFT JOIN (
+		-- rank is bm25(); the function itself can't be used under GROUP BY
+		SELECT m.plushie_id, MIN(hits.rank) AS rank
+		FROM (SELECT rowid AS id, rank FROM message_search WHERE message_search MATCH ?) hits
+		JOIN conversation_messages m ON m.id = hits.id
+		GROUP BY m.plushie_id
+	) message_rank ON message_rank.plushie_id = plushies.id`
+
+// searchMessages returns snippets of the most recent messages of a plushie that contain any of the terms
+func (a *App) searchMessages(r *http.Request, plushieID int64, terms []string) ([]SearchMessageMatch, error) {
+	conds := make([]string, len(terms))
+	args := []any{plushieID}
+	for i, t := range terms {
+		conds[i] = `content LIKE ? ESCAPE '\'`
+		args = append(args, likePattern(t))
+	}
+	args = append(args, MaxSearchMessageMatches)
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT id, speaker, role, content, timestamp
+		FROM conversation_messages
+		WHERE plushie_id = ? AND (`+strings.Join(conds, " OR ")+`)
+		ORDER BY id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []SearchMessageMatch{}
+	for rows.Next() {
+		var m SearchMessageMatch
+		var content string
+		var ts sql.NullTime
+		if err := rows.Scan(&m.ID, &m.Speaker, &m.Role, &content, &ts); err != nil {
+			return nil, err
+		}
+		m.Timestamp = ts.Time
+		m.Snippet, _ = highlightSnippet(content, terms)
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// highlightSnippet cuts the part of text around the first match of any term
+// and marks every match in it. Matching ignores case. The result is HTML.
+func highlightSnippet(text string, terms []string) (string, bool) {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	lower := lowerRunes(runes)
+
+	// marked[i] is true for runes inside a match
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, t := range terms {
+		tr := lowerRunes([]rune(t))
+		for i := 0; i+len(tr) <= len(lower); i++ {
+			if string(lower[i:i+len(tr)]) != string(tr) {
+				continue
+			}
+			for j := i; j < i+len(tr); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	start := max(0, first-searchSnippetLength/3)
+	end := min(len(runes), start+searchSnippetLength)
+	start = max(0, min(start, end-searchSnippetLength))
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		segment := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + segment + "</mark>")
+		} else {
+			b.WriteString(segment)
+		}
+		i = j
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// lowerRunes lower-cases rune by rune, so indexes stay aligned with the input
+func lowerRunes(runes []rune) []rune {
+	lower := make([]rune, len(runes))
+	for i, c := range runes {
+		lower[i] = unicode.ToLower(c)
+	}
+	return lower
+}
@@ -0,0 +1,105 @@
+//go:build sqlite_fts5
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// search returns the IDs of the plushies matching q, best first
+func (ta *testApp) search(t *testing.T, q string) []int64 {
+	t.Helper()
+	var resp struct {
+		Results []SearchResult `json:"results"`
+	}
+	mustStatus(t, ta.request(t, ownerUser, "GET", "/api/search?q="+url.QueryEscape(q), nil), http.StatusOK, &resp)
+	ids := []int64{}
+	for _, res := range resp.Results {
+		ids = append(ids, res.Plushie.ID)
+	}
+	return ids
+}
+
+// indexedMessages returns the IDs of the messages message_search matches for q
+func (ta *testApp) indexedMessages(t *testing.T, q string) []int64 {
+	t.Helper()
+	rows, err := ta.DB.Query(`SELECT rowid FROM message_search WHERE message_search MATCH ? ORDER BY rowid`, ftsPhrase(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestSearchRanksNameMatchesFirst(t *testing.T) {
+	ta := newTestApp(t)
+	// The notes match is updated last, so it would come first without ranking
+	inName := ta.createPlushie(t, ownerUser, 0, "もふもふ")
+	inNotes := ta.createPlushie(t, ownerUser, 0, "くま")
+	mustStatus(t, ta.request(t, ownerUser, "PATCH", plushiePath(inNotes), `{"notes": "もふもふ"}`,
+		"Content-Type", "application/merge-patch+json"), http.StatusOK, nil)
+	ta.createPlushie(t, ownerUser, 0, "うさぎ")
+
+	got := ta.search(t, "もふもふ")
+	if len(got) != 2 || got[0] != inName || got[1] != inNotes {
+		t.Errorf("search results = %v, want [%d %d]", got, inName, inNotes)
+	}
+}
+
+func TestMessageSearchFollowsMessages(t *testing.T) {
+	ta := newTestApp(t)
+	id := ta.createPlushie(t, ownerUser, 0, "くま")
+	path := plushiePath(id)
+
+	var m ConversationMessage
+	mustStatus(t, ta.request(t, ownerUser, "POST", path+"/messages", map[string]string{"content": "しっぽがかわいい"}), http.StatusCreated, &m)
+	msgPath := path + "/messages/" + strconv.FormatInt(m.ID, 10)
+	if got := ta.indexedMessages(t, "しっぽ"); len(got) != 1 || got[0] != m.ID {
+		t.Fatalf("after adding: indexed %v, want [%d]", got, m.ID)
+	}
+	if got := ta.search(t, "しっぽ"); len(got) != 1 || got[0] != id {
+		t.Fatalf("search after adding = %v, want [%d]", got, id)
+	}
+
+	mustStatus(t, ta.request(t, ownerUser, "PUT", msgPath, map[string]string{"content": "みみがかわいい"}), http.StatusOK, nil)
+	if got := ta.indexedMessages(t, "しっぽ"); len(got) != 0 {
+		t.Errorf("after editing: old text still indexed for %v", got)
+	}
+	if got := ta.indexedMessages(t, "みみが"); len(got) != 1 {
+		t.Errorf("after editing: new text indexed for %v", got)
+	}
+
+	mustStatus(t, ta.request(t, ownerUser, "DELETE", msgPath, nil), http.StatusNoContent, nil)
+	if got := ta.indexedMessages(t, "かわいい"); len(got) != 0 {
+		t.Errorf("after deleting: still indexed for %v", got)
+	}
+
+	// Purging the plushie removes its messages and its profile from the index
+	mustStatus(t, ta.request(t, ownerUser, "POST", path+"/messages", map[string]string{"content": "しっぽがかわいい"}), http.StatusCreated, nil)
+	mustStatus(t, ta.request(t, ownerUser, "DELETE", path, nil), http.StatusNoContent, nil)
+	mustStatus(t, ta.request(t, ownerUser, "DELETE", "/api/trash/"+strconv.FormatInt(id, 10), nil), http.StatusNoContent, nil)
+	if got := ta.indexedMessages(t, "しっぽ"); len(got) != 0 {
+		t.Errorf("after purging: messages still indexed %v", got)
+	}
+	var profiles int
+	if err := ta.DB.QueryRow(`SELECT COUNT(*) FROM plushie_search WHERE rowid = ?`, id).Scan(&profiles); err != nil {
+		t.Fatal(err)
+	}
+	if profiles != 0 {
+		t.Errorf("after purging: plushie still in plushie_search")
+	}
+}
@@ -2,53 +2,124 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"log"
+	"net"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 const sessionCookieName = "poppo_session"
 
+// Cookie session settings
+const (
+	SessionLifetime      = 7 * 24 * time.Hour
+	SessionSweepInterval = 10 * time.Minute
+	sessionTouchInterval = time.Minute // last_seen_at is updated at most this often
+	maxUserAgentLength   = 512
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore keeps the cookie sessions created by /api/login in the
+// sessions table. Cookies carry a random token; only its hash is stored, so a
+// leaked database can't be used to sign in.
 type SessionStore struct {
-	mu       sync.RWMutex
-	sessions map[string]sessionEntry
+	DB *sql.DB
 }
 
-type sessionEntry struct {
-	UserID int64
-	Expiry time.Time
+// Session is one signed-in browser or device
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int64     `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	Device     string    `json:"device"` // e.g. "Chrome on macOS", derived from UserAgent
+	IPAddress  string    `json:"ip_address"`
+	Current    bool      `json:"current"` // the session of the request that listed it
 }
 
-func NewSessionStore() *SessionStore {
-	return &SessionStore{
-		sessions: make(map[string]sessionEntry),
+// SessionMetadata describes the client a session was created from
+type SessionMetadata struct {
+	UserAgent string
+	IPAddress string
+}
+
+func sessionMetadataFromRequest(r *http.Request) SessionMetadata {
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
 	}
+	return SessionMetadata{UserAgent: ua, IPAddress: ip}
 }
 
-func (s *SessionStore) Set(token string, userID int64, expiry time.Time) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.sessions[token] = sessionEntry{UserID: userID, Expiry: expiry}
+func NewSessionStore(db *sql.DB) *SessionStore {
+	return &SessionStore{DB: db}
 }
 
-func (s *SessionStore) Delete(token string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.sessions, token)
+// Create starts a session and returns the token to put in the cookie
+func (s *SessionStore) Create(ctx context.Context, userID int64, expiry time.Time, meta SessionMetadata) (string, error) {
+	token, hash, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = s.DB.ExecContext(ctx, `
+		INSERT INTO sessions (id, token_hash, user_id, created_at, last_seen_at, expires_at, user_agent, ip_address)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, uuid.NewString(), hash, userID, now, now, expiry.UTC(), meta.UserAgent, meta.IPAddress)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
 }
 
-func (s *SessionStore) GetUserID(token string) (int64, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	entry, ok := s.sessions[token]
-	if !ok {
-		return 0, errors.New("not found")
+// Delete ends the session a token belongs to
+func (s *SessionStore) Delete(ctx context.Context, token string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash = ?`, hashToken(token))
+	return err
+}
+
+// Lookup returns the unexpired session a token belongs to and records that it was used
+func (s *SessionStore) Lookup(ctx context.Context, token string) (*Session, error) {
+	var sess Session
+	now := time.Now().UTC()
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT id, user_id, created_at, last_seen_at, expires_at, user_agent, ip_address
+		FROM sessions WHERE token_hash = ? AND expires_at > ?
+	`, hashToken(token), now).Scan(&sess.ID, &sess.UserID, &sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt, &sess.UserAgent, &sess.IPAddress)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if now.Sub(sess.LastSeenAt) > sessionTouchInterval {
+		if _, err := s.DB.ExecContext(ctx, `UPDATE sessions SET last_seen_at = ? WHERE id = ?`, now, sess.ID); err != nil {
+			log.Printf("Warning: failed to update session: %v", err)
+		}
+		sess.LastSeenAt = now
 	}
-	if time.Now().After(entry.Expiry) {
-		return 0, errors.New("expired")
+	sess.Device = describeUserAgent(sess.UserAgent)
+	return &sess, nil
+}
+
+func (s *SessionStore) GetUserID(token string) (int64, error) {
+	sess, err := s.Lookup(context.Background(), token)
+	if err != nil {
+		return 0, err
 	}
-	return entry.UserID, nil
+	return sess.UserID, nil
 }
 
 func (s *SessionStore) GetUserIDFromRequest(r *http.Request) (int64, error) {
@@ -59,9 +130,133 @@ func (s *SessionStore) GetUserIDFromRequest(r *http.Request) (int64, error) {
 	return s.GetUserID(c.Value)
 }
 
+// List returns a user's unexpired sessions, most recently used first
+func (s *SessionStore) List(ctx context.Context, userID int64) ([]Session, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT id, user_id, created_at, last_seen_at, expires_at, user_agent, ip_address
+		FROM sessions WHERE user_id = ? AND expires_at > ?
+		ORDER BY last_seen_at DESC
+	`, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.ID, &sess.UserID, &sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt, &sess.UserAgent, &sess.IPAddress); err != nil {
+			return nil, err
+		}
+		sess.Device = describeUserAgent(sess.UserAgent)
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// Revoke ends one of a user's sessions by id
+func (s *SessionStore) Revoke(ctx context.Context, userID int64, id string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends all of a user's sessions and returns how many there were
+func (s *SessionStore) RevokeAll(ctx context.Context, userID int64) (int64, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Sweep deletes expired sessions
+func (s *SessionStore) Sweep(ctx context.Context) (int64, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RunSessionSweeper deletes expired sessions (and, with the built-in identity
+// provider, its expired sessions and reset codes) every interval until ctx is cancelled
+func (a *App) RunSessionSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.SessionStore.Sweep(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: session cleanup failed: %v", err)
+		}
+		if a.LocalAuth != nil {
+			if err := a.LocalAuth.Sweep(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Warning: session cleanup failed: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// describeUserAgent turns a User-Agent header into a short label such as
+// "Safari on iPhone" for the session list. Unknown clients are "不明なデバイス".
+func describeUserAgent(ua string) string {
+	var browser, os string
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"), strings.Contains(ua, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		browser = "curl"
+	}
+	switch {
+	case strings.Contains(ua, "iPhone"):
+		os = "iPhone"
+	case strings.Contains(ua, "iPad"):
+		os = "iPad"
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "Mac OS X"), strings.Contains(ua, "Macintosh"):
+		os = "macOS"
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	}
+	return "不明なデバイス"
+}
+
 type contextKey string
 
-const userIDKey contextKey = "user_id"
+const (
+	userIDKey    contextKey = "user_id"
+	sessionIDKey contextKey = "session_id"
+)
 
 func withUserID(ctx context.Context, id int64) context.Context {
 	return context.WithValue(ctx, userIDKey, id)
@@ -78,4 +273,11 @@ func userIDFromContext(ctx context.Context) int64 {
 	return 0
 }
 
+func withSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionIDKey, id)
+}
 
+func sessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey).(string)
+	return id
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// MaxShareQuotes caps the conversation messages quoted on a share link
+const MaxShareQuotes = 10
+
+// ShareLink is a link to a plushie's public profile as its owner sees it.
+// The token is only returned when the link is created.
+type ShareLink struct {
+	ID           int64      `json:"id"`
+	Token        string     `json:"token,omitempty"`
+	URL          string     `json:"url,omitempty"` // public endpoint of the link
+	QuoteIDs     []int64    `json:"quote_ids"`     // quoted message IDs in display order
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Expired      bool       `json:"expired"`
+	ViewCount    int64      `json:"view_count"`
+	LastViewedAt *time.Time `json:"last_viewed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// SharedPlushie is the public profile behind a share link. It leaves out the
+// owner, notes, tags and every message that wasn't picked as a quote.
+type SharedPlushie struct {
+	Name           string        `json:"name"`
+	Kind           string        `json:"kind"`
+	AdoptedAt      string        `json:"adopted_at,omitempty"`
+	ImageURL       string        `json:"image_url"`
+	MediumImageURL string        `json:"medium_image_url"`
+	ThumbnailURL   string        `json:"thumbnail_url"`
+	Quotes         []SharedQuote `json:"quotes"`
+}
+
+type SharedQuote struct {
+	Speaker string `json:"speaker"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type shareLinkRequest struct {
+	ExpiresAt *time.Time `json:"expires_at"` // none for a link that never expires
+	QuoteIDs  []int64    `json:"quote_ids"`
+}
+
+func sharedPlushieURL(token string) string {
+	return "/api/shared/" + token
+}
+
+// HandleListShareLinks lists the share links of a plushie, newest first
+func (a *App) HandleListShareLinks(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	links, err := a.listShareLinks(r, id)
+	if err != nil {
+		log.Printf("API Error [share links]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToListShareLinks)
+		return
+	}
+	respondJSON(w, http.StatusOK, links)
+}
+
+func (a *App) listShareLinks(r *http.Request, plushieID int64) ([]ShareLink, error) {
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT id, expires_at, view_count, last_viewed_at, created_at
+		FROM share_links WHERE plushie_id = ? ORDER BY id DESC
+	`, plushieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	links := []ShareLink{}
+	index := map[int64]int{}
+	for rows.Next() {
+		l := ShareLink{QuoteIDs: []int64{}}
+		var expiresAt, lastViewedAt sql.NullTime
+		if err := rows.Scan(&l.ID, &expiresAt, &l.ViewCount, &lastViewedAt, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			l.ExpiresAt = &expiresAt.Time
+			l.Expired = !now.Before(expiresAt.Time)
+		}
+		if lastViewedAt.Valid {
+			l.LastViewedAt = &lastViewedAt.Time
+		}
+		index[l.ID] = len(links)
+		links = append(links, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = a.DB.QueryContext(r.Context(), `
+		SELECT q.share_link_id, q.message_id
+		FROM share_link_quotes q JOIN share_links s ON s.id = q.share_link_id
+		WHERE s.plushie_id = ? ORDER BY q.share_link_id, q.position
+	`, plushieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var linkID, messageID int64
+		if err := rows.Scan(&linkID, &messageID); err != nil {
+			return nil, err
+		}
+		l := &links[index[linkID]]
+		l.QuoteIDs = append(l.QuoteIDs, messageID)
+	}
+	return links, rows.Err()
+}
+
+// HandleCreateShareLink creates a share link for a plushie. The body may set
+// expires_at and quote_ids, the user and assistant messages to show on the
+// profile in that order. The response carries the token, which can't be
+// retrieved again.
+func (a *App) HandleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req shareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	now := time.Now().UTC()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		respondError(w, http.StatusBadRequest, ErrInvalidShareExpiry)
+		return
+	}
+	if len(req.QuoteIDs) > MaxShareQuotes {
+		respondError(w, http.StatusBadRequest, ErrTooManyShareQuotes)
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	link, err := a.createShareLink(r, id, &req, now)
+	if errors.Is(err, errInvalidShareQuote) {
+		respondError(w, http.StatusBadRequest, ErrInvalidShareQuote)
+		return
+	}
+	if err != nil {
+		log.Printf("API Error [share links]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToCreateShareLink)
+		return
+	}
+	respondJSON(w, http.StatusCreated, link)
+}
+
+var errInvalidShareQuote = errors.New(ErrInvalidShareQuote)
+
+func (a *App) createShareLink(r *http.Request, plushieID int64, req *shareLinkRequest, now time.Time) (*ShareLink, error) {
+	token, hash, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var expiresAt any
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC()
+	}
+	res, err := tx.Exec(`INSERT INTO share_links (plushie_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		plushieID, hash, now, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	linkID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	quoteIDs := []int64{}
+	seen := map[int64]bool{}
+	for _, messageID := range req.QuoteIDs {
+		if seen[messageID] {
+			continue
+		}
+		seen[messageID] = true
+		// System messages are prompts, not part of the conversation to show
+		var exists int
+		err := tx.QueryRow(`SELECT 1 FROM conversation_messages WHERE id = ? AND plushie_id = ? AND role IN ('user', 'assistant')`,
+			messageID, plushieID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errInvalidShareQuote
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO share_link_quotes (share_link_id, message_id, position) VALUES (?, ?, ?)`,
+			linkID, messageID, len(quoteIDs)); err != nil {
+			return nil, err
+		}
+		quoteIDs = append(quoteIDs, messageID)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	link := &ShareLink{
+		ID:        linkID,
+		Token:     token,
+		URL:       sharedPlushieURL(token),
+		QuoteIDs:  quoteIDs,
+		CreatedAt: now,
+	}
+	if req.ExpiresAt != nil {
+		t := req.ExpiresAt.UTC()
+		link.ExpiresAt = &t
+	}
+	return link, nil
+}
+
+// HandleRevokeShareLink deletes a share link; its URL stops working at once
+func (a *App) HandleRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	linkID, err := parseURLInt64(r, "shareID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	res, err := a.DB.ExecContext(r.Context(), `DELETE FROM share_links WHERE id = ? AND plushie_id = ?`, linkID, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToRevokeShareLink)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrShareLinkNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleGetSharedPlushie returns the public profile behind a share link
+// (GET /api/shared/{token}). It needs no authentication. Revoked and expired
+// links and plushies in the trash all answer 404.
+func (a *App) HandleGetSharedPlushie(w http.ResponseWriter, r *http.Request) {
+	hash := hashToken(chi.URLParam(r, "token"))
+	now := time.Now().UTC()
+
+	var linkID int64
+	var p SharedPlushie
+	var imagePath, mediumPath, thumbPath sql.NullString
+	err := a.DB.QueryRowContext(r.Context(), `
+		SELECT s.id, p.name, p.kind, COALESCE(p.adopted_at, ''), p.image_path, p.image_medium_path, p.image_thumb_path
+		FROM share_links s JOIN plushies p ON p.id = s.plushie_id
+		WHERE s.token_hash = ? AND p.deleted_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > ?)
+	`, hash, now).Scan(&linkID, &p.Name, &p.Kind, &p.AdoptedAt, &imagePath, &mediumPath, &thumbPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, ErrShareLinkNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("API Error [shared plushie]: %v", err)
+		respondError(w, http.StatusInternalServerError, ErrFailedToLoadSharedPlushie)
+		return
+	}
+	if imagePath.Valid {
+		p.ImageURL = a.imageURL(imagePath.String)
+		p.MediumImageURL = p.ImageURL
+		p.ThumbnailURL = p.ImageURL
+	}
+	if mediumPath.Valid {
+		p.MediumImageURL = a.imageURL(mediumPath.String)
+	}
+	if thumbPath.Valid {
+		p.ThumbnailURL = a.imageURL(thumbPath.String)
+	}
+	// adopted_at may carry a time after the date
+	if len(p.AdoptedAt) > len("2006-01-02") {
+		p.AdoptedAt = p.AdoptedAt[:len("2006-01-02")]
+	}
+
+	p.Quotes = []SharedQuote{}
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT m.speaker, m.role, m.content
+		FROM share_link_quotes q JOIN conversation_messages m ON m.id = q.message_id
+		WHERE q.share_link_id = ? AND m.role IN ('user', 'assistant')
+		ORDER BY q.position
+	`, linkID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToLoadSharedPlushie)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var q SharedQuote
+		if err := rows.Scan(&q.Speaker, &q.Role, &q.Content); err != nil {
+			respondError(w, http.StatusInternalServerError, ErrFailedToLoadSharedPlushie)
+			return
+		}
+		p.Quotes = append(p.Quotes, q)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToLoadSharedPlushie)
+		return
+	}
+
+	if _, err := a.DB.ExecContext(r.Context(),
+		`UPDATE share_links SET view_count = view_count + 1, last_viewed_at = ? WHERE id = ?`, now, linkID); err != nil {
+		log.Printf("Warning: failed to count share link view: %v", err)
+	}
+
+	// The token is in the URL: keep it out of caches, search engines and referrers
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	respondJSON(w, http.StatusOK, p)
+}
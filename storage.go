@@ -1,57 +1,97 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"github.com/google/uuid"
 )
 
 var ErrNoFile = errors.New("no file")
 
-// saveUploadedFile saves a file from a multipart form field to uploads directory.
-// It returns the relative path (filename only) or empty string if no file was provided.
-func saveUploadedFile(r *http.Request, field string) (string, error) {
+// respondImageError reports a failed upload from saveUploadedFile
+func respondImageError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnsupportedImage) {
+		respondError(w, http.StatusBadRequest, ErrUnsupportedImageFormat)
+		return
+	}
+	respondError(w, http.StatusBadRequest, ErrFailedToSaveImage+": "+err.Error())
+}
+
+// savedImage holds the blob store keys of an upload and its variants
+type savedImage struct {
+	Path       string
+	MediumPath string
+	ThumbPath  string
+}
+
+// saveUploadedFile processes an image from a multipart form field and saves it
+// with its medium and thumbnail variants to the blob store.
+// It returns ErrNoFile if no file was provided and ErrUnsupportedImage if the
+// content is not a JPEG, PNG, GIF or WebP image, whatever the filename says.
+func (a *App) saveUploadedFile(r *http.Request, field string) (*savedImage, error) {
 	file, header, err := r.FormFile(field)
 	if err != nil {
 		if errors.Is(err, http.ErrMissingFile) {
-			return "", ErrNoFile
+			return nil, ErrNoFile
 		}
-		var maxErr *multipart.Part
-		if errors.As(err, &maxErr) {
-			return "", fmt.Errorf("file too large")
+		if errors.Is(err, multipart.ErrMessageTooLarge) {
+			return nil, fmt.Errorf("file too large")
 		}
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
 
 	if header.Filename == "" {
-		return "", ErrNoFile
+		return nil, ErrNoFile
 	}
 
-	ext := filepath.Ext(header.Filename)
-	if ext == "" {
-		ext = ".dat"
+	data, err := io.ReadAll(io.LimitReader(file, a.Config.MaxUploadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > a.Config.MaxUploadSize {
+		return nil, fmt.Errorf("file too large")
 	}
-	filename := uuid.NewString() + ext
-	dstPath := filepath.Join(UploadsDir, filename)
+	return a.saveImageData(r.Context(), data)
+}
 
-	dst, err := os.Create(dstPath)
+// saveImageData processes an image and saves it with its medium and thumbnail
+// variants to the blob store, like saveUploadedFile
+func (a *App) saveImageData(ctx context.Context, data []byte) (*savedImage, error) {
+	img, err := processImage(data)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		return "", err
+	base := uuid.NewString()
+	saved := &savedImage{
+		Path:       base + img.Ext,
+		MediumPath: base + "_medium" + img.Ext,
+		ThumbPath:  base + "_thumb" + img.Ext,
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{saved.Path, img.Original},
+		{saved.MediumPath, img.Medium},
+		{saved.ThumbPath, img.Thumb},
+	}
+	contentType := contentTypeForKey(saved.Path)
+	for i, f := range files {
+		if err := a.Blobs.Put(ctx, f.name, f.data, contentType); err != nil {
+			// Don't leave a partial set of variants behind
+			for _, written := range files[:i] {
+				_ = a.Blobs.Delete(context.Background(), written.name)
+			}
+			return nil, err
+		}
 	}
 
-	return filename, nil
+	return saved, nil
 }
-
-
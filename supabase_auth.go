@@ -6,70 +6,151 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// SupabaseAuth verifies Supabase access tokens.
+// Legacy projects sign tokens with a shared HMAC secret (HS256); newer ones sign
+// with asymmetric keys (RS256/ES256) published at a JWKS endpoint. Either or
+// both can be configured.
 type SupabaseAuth struct {
-	JWTSecret string
+	JWTSecret string     // HMAC secret; empty rejects HMAC-signed tokens
+	JWKS      *JWKSCache // public keys; nil rejects asymmetrically signed tokens
+	Issuer    string     // required iss claim, e.g. https://<project>.supabase.co/auth/v1; must be set with JWKS
+	Audience  string     // required aud claim (Supabase uses "authenticated"); empty skips the check
+
+	// SessionActive, if set, rejects tokens whose session_id claim names a
+	// signed-out session (see LocalAuth)
+	SessionActive func(sessionID string) (bool, error)
 }
 
+// SupabaseClaims are the claims of a Supabase access token.
+// The user ID (a UUID) is the standard sub claim.
 type SupabaseClaims struct {
-	Sub      string                 `json:"sub"` // User ID (UUID)
-	Email    string                 `json:"email"`
-	Aud      string                 `json:"aud"`
-	Role     string                 `json:"role"`
-	Exp      int64                  `json:"exp"`
-	Iat      int64                  `json:"iat"`
-	UserMeta map[string]interface{} `json:"user_metadata,omitempty"`
+	Email     string                 `json:"email"`
+	Role      string                 `json:"role"`
+	UserMeta  map[string]interface{} `json:"user_metadata,omitempty"`
+	SessionID string                 `json:"session_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// NewSupabaseAuth creates a new Supabase auth instance
-func NewSupabaseAuth() *SupabaseAuth {
-	jwtSecret := os.Getenv("SUPABASE_JWT_SECRET")
+const DefaultSupabaseJWTAudience = "authenticated"
+
+// Signing algorithms accepted from the JWKS. "none" and anything else are always rejected.
+var supabaseAsymmetricAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// NewSupabaseAuth creates a new Supabase auth instance that only accepts HMAC tokens
+func NewSupabaseAuth(jwtSecret string) *SupabaseAuth {
 	return &SupabaseAuth{
 		JWTSecret: jwtSecret,
 	}
 }
 
-// VerifyToken verifies a Supabase JWT token and returns the user ID
-func (s *SupabaseAuth) VerifyToken(tokenString string) (string, error) {
-	if s.JWTSecret == "" {
-		return "", errors.New("SUPABASE_JWT_SECRET not configured")
+// NewSupabaseAuthFromConfig creates the Supabase auth instance described by cfg
+func NewSupabaseAuthFromConfig(cfg *Config) *SupabaseAuth {
+	s := &SupabaseAuth{
+		JWTSecret: cfg.SupabaseJWTSecret,
+		Issuer:    cfg.SupabaseJWTIssuer,
+		Audience:  cfg.SupabaseJWTAudience,
 	}
+	switch {
+	case cfg.SupabaseJWKSFile != "":
+		s.JWKS = NewJWKSCacheFromFile(cfg.SupabaseJWKSFile)
+	case cfg.SupabaseJWKSURL != "":
+		s.JWKS = NewJWKSCacheFromURL(cfg.SupabaseJWKSURL, nil)
+	}
+	return s
+}
 
-	// Parse token with verification
-	token, err := jwt.ParseWithClaims(tokenString, &SupabaseClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Verify signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// Configured reports whether any way of verifying tokens is set up
+func (s *SupabaseAuth) Configured() bool {
+	return s.JWTSecret != "" || s.JWKS != nil
+}
+
+// ParseToken verifies a Supabase JWT (signature, exp, nbf, iss, aud) and returns its claims
+func (s *SupabaseAuth) ParseToken(tokenString string) (*SupabaseClaims, error) {
+	if !s.Configured() {
+		return nil, errors.New("SUPABASE_JWT_SECRET not configured")
+	}
+
+	var methods []string
+	if s.JWTSecret != "" {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if s.JWKS != nil {
+		if s.Issuer == "" {
+			return nil, errors.New("issuer not configured for JWKS verification")
 		}
-		return []byte(s.JWTSecret), nil
-	})
+		methods = append(methods, supabaseAsymmetricAlgs...)
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if s.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(s.Issuer))
+	}
+	if s.Audience != "" {
+		opts = append(opts, jwt.WithAudience(s.Audience))
+	}
 
+	// Parse token with verification
+	token, err := jwt.ParseWithClaims(tokenString, &SupabaseClaims{}, s.keyFunc, opts...)
 	if err != nil {
 		log.Printf("JWT parse error: %v", err)
-		return "", fmt.Errorf("failed to parse token: %w", err)
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, errors.New("token expired")
+		}
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	claims, ok := token.Claims.(*SupabaseClaims)
+	if !ok || !token.Valid || claims.Subject == "" {
+		return nil, errors.New("invalid token")
+	}
+	if s.SessionActive != nil {
+		active, err := s.SessionActive(claims.SessionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check session: %w", err)
+		}
+		if !active {
+			// Reported like an expired token so clients sign in again
+			return nil, errors.New("token expired: session has been signed out")
+		}
 	}
+	return claims, nil
+}
 
-	if claims, ok := token.Claims.(*SupabaseClaims); ok && token.Valid {
-		// Check expiration
-		if claims.Exp > 0 && time.Now().Unix() > claims.Exp {
-			return "", errors.New("token expired")
+// keyFunc picks the verification key for a token's signing method
+func (s *SupabaseAuth) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return []byte(s.JWTSecret), nil
+	default:
+		if s.JWKS == nil {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return claims.Sub, nil
+		kid, _ := token.Header["kid"].(string)
+		return s.JWKS.Key(context.Background(), kid, token.Method.Alg())
 	}
+}
 
-	return "", errors.New("invalid token")
+// VerifyToken verifies a Supabase JWT token and returns the user ID
+func (s *SupabaseAuth) VerifyToken(tokenString string) (string, error) {
+	claims, err := s.ParseToken(tokenString)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
 }
 
 // GetUserIDFromRequest extracts user ID from Authorization header or cookie
 func (s *SupabaseAuth) GetUserIDFromRequest(r *http.Request) (string, error) {
-	if s.JWTSecret == "" {
+	if !s.Configured() {
 		return "", errors.New("SUPABASE_JWT_SECRET not configured")
 	}
 
@@ -112,9 +193,9 @@ func (s *SupabaseAuth) GetUserIDFromRequest(r *http.Request) (string, error) {
 // SupabaseAuthMiddleware verifies Supabase JWT and sets user ID in context
 func (a *App) SupabaseAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		supabaseAuth := NewSupabaseAuth()
-		if supabaseAuth.JWTSecret == "" {
-			log.Printf("ERROR: SUPABASE_JWT_SECRET not configured")
+		supabaseAuth := a.SupabaseAuth
+		if !supabaseAuth.Configured() {
+			log.Printf("ERROR: neither SUPABASE_JWT_SECRET nor SUPABASE_JWKS_URL is configured")
 			respondError(w, http.StatusInternalServerError, ErrServerConfigError)
 			return
 		}
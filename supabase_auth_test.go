@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer    = "https://example.supabase.co/auth/v1"
+	testJWTSecret = "test-secret-that-is-long-enough-for-hs256"
+)
+
+func testClaims(sub string) SupabaseClaims {
+	now := time.Now()
+	return SupabaseClaims{
+		Email: sub + "@example.com",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   sub,
+			Issuer:    testIssuer,
+			Audience:  jwt.ClaimStrings{DefaultSupabaseJWTAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key crypto.PrivateKey, kid string, claims SupabaseClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestJWKSAuth(srv *testJWKSServer) *SupabaseAuth {
+	return &SupabaseAuth{
+		JWKS:     NewJWKSCacheFromURL(srv.URL, nil),
+		Issuer:   testIssuer,
+		Audience: DefaultSupabaseJWTAudience,
+	}
+}
+
+func TestSupabaseAuthVerifiesJWKSTokens(t *testing.T) {
+	rsaKey, ecKey := newRSAKey(t), newECKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+	auth := newTestJWKSAuth(srv)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"RS256", signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", testClaims("rs-user"))},
+		{"ES256", signTestToken(t, jwt.SigningMethodES256, ecKey, "ec-1", testClaims("es-user"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := auth.ParseToken(tt.token)
+			if err != nil {
+				t.Fatalf("ParseToken: %v", err)
+			}
+			if want := testClaims("").Issuer; claims.Issuer != want {
+				t.Errorf("iss = %q, want %q", claims.Issuer, want)
+			}
+		})
+	}
+
+	// A token signed by a key outside the set
+	other := newRSAKey(t)
+	if _, err := auth.ParseToken(signTestToken(t, jwt.SigningMethodRS256, other, "rsa-1", testClaims("x"))); err == nil {
+		t.Error("accepted a token signed by a key outside the set")
+	}
+}
+
+func TestSupabaseAuthFollowsKeyRotation(t *testing.T) {
+	oldKey, newKey := newRSAKey(t), newRSAKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("old", oldKey))
+	auth := newTestJWKSAuth(srv)
+
+	if _, err := auth.VerifyToken(signTestToken(t, jwt.SigningMethodRS256, oldKey, "old", testClaims("u"))); err != nil {
+		t.Fatalf("old key: %v", err)
+	}
+
+	srv.setKeys(rsaJWK("old", oldKey), rsaJWK("new", newKey))
+	expireLastAttempt(auth.JWKS)
+	sub, err := auth.VerifyToken(signTestToken(t, jwt.SigningMethodRS256, newKey, "new", testClaims("u")))
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	if sub != "u" {
+		t.Errorf("sub = %q, want u", sub)
+	}
+	if n := srv.fetchCount(); n != 2 {
+		t.Errorf("fetches = %d, want 2", n)
+	}
+}
+
+func TestSupabaseAuthRejectsInvalidClaims(t *testing.T) {
+	key := newRSAKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("k", key))
+	auth := newTestJWKSAuth(srv)
+
+	tests := []struct {
+		name   string
+		modify func(c *SupabaseClaims)
+	}{
+		{"wrong iss", func(c *SupabaseClaims) { c.Issuer = "https://attacker.example/auth/v1" }},
+		{"missing iss", func(c *SupabaseClaims) { c.Issuer = "" }},
+		{"wrong aud", func(c *SupabaseClaims) { c.Audience = jwt.ClaimStrings{"anon"} }},
+		{"missing exp", func(c *SupabaseClaims) { c.ExpiresAt = nil }},
+		{"expired", func(c *SupabaseClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) }},
+		{"missing sub", func(c *SupabaseClaims) { c.Subject = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := testClaims("u")
+			tt.modify(&claims)
+			if _, err := auth.ParseToken(signTestToken(t, jwt.SigningMethodRS256, key, "k", claims)); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+}
+
+func TestSupabaseAuthRequiresIssuerWithJWKS(t *testing.T) {
+	key := newRSAKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("k", key))
+	auth := newTestJWKSAuth(srv)
+	auth.Issuer = ""
+
+	if _, err := auth.ParseToken(signTestToken(t, jwt.SigningMethodRS256, key, "k", testClaims("u"))); err == nil {
+		t.Error("accepted a JWKS token without an issuer configured")
+	}
+}
+
+func TestSupabaseAuthHMAC(t *testing.T) {
+	auth := NewSupabaseAuth(testJWTSecret)
+
+	// Legacy tokens carry no iss/aud requirement unless configured
+	sub, err := auth.VerifyToken(signTestToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), "", testClaims("legacy")))
+	if err != nil {
+		t.Fatalf("HS256: %v", err)
+	}
+	if sub != "legacy" {
+		t.Errorf("sub = %q, want legacy", sub)
+	}
+
+	if _, err := auth.VerifyToken(signTestToken(t, jwt.SigningMethodHS256, []byte("wrong-secret"), "", testClaims("u"))); err == nil {
+		t.Error("accepted a token signed with another secret")
+	}
+
+	// Asymmetric tokens need a JWKS
+	key := newRSAKey(t)
+	if _, err := auth.VerifyToken(signTestToken(t, jwt.SigningMethodRS256, key, "k", testClaims("u"))); err == nil {
+		t.Error("accepted an RS256 token without a JWKS")
+	}
+}
+
+func TestSupabaseAuthJWKSOnlyRejectsHMAC(t *testing.T) {
+	key := newRSAKey(t)
+	srv := newTestJWKSServer(t, rsaJWK("k", key))
+	auth := newTestJWKSAuth(srv)
+
+	// Without a secret an HS256 token must not be verified against anything
+	if _, err := auth.VerifyToken(signTestToken(t, jwt.SigningMethodHS256, []byte(""), "", testClaims("u"))); err == nil {
+		t.Error("accepted an HS256 token without a secret configured")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Tag limits
+const (
+	MaxTagNameLength  = 50 // runes
+	MaxTagsPerPlushie = 20
+)
+
+// Tag is a user-defined label. Names are unique per user, ignoring case.
+type Tag struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	PlushieCount int       `json:"plushie_count"` // not counting plushies in the trash
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// plushieTagsExpr selects a plushie's tag names as a JSON array, sorted by
+// name. Tags are personal, so on a shared plushie each member only sees their
+// own; its one placeholder is the user's ID.
+const plushieTagsExpr = `(
+	SELECT json_group_array(name) FROM (
+		SELECT t.name FROM plushie_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.plushie_id = plushies.id AND t.user_id = ?
+		ORDER BY t.name COLLATE NOCASE
+	)
+)`
+
+// tagColumns counts only plushies the tag's owner can still see, in case they
+// left a household whose plushies carry the tag
+var tagColumns = `id, name, (SELECT COUNT(*) FROM plushie_tags pt JOIN plushies p ON p.id = pt.plushie_id
+	WHERE pt.tag_id = tags.id AND p.deleted_at IS NULL AND ` + householdAccessOf("p.household_id", "tags.user_id", permView) + `), created_at`
+
+func scanTag(scan func(dest ...any) error) (*Tag, error) {
+	var t Tag
+	if err := scan(&t.ID, &t.Name, &t.PlushieCount, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// normalizeTagName trims a tag name and returns the error message to show if it is invalid
+func normalizeTagName(name string) (string, string) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrTagNameRequired
+	}
+	if utf8.RuneCountInString(name) > MaxTagNameLength {
+		return "", ErrTagNameTooLong
+	}
+	return name, ""
+}
+
+// isUniqueConstraintError reports whether err is a UNIQUE constraint violation
+func isUniqueConstraintError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+func (a *App) getTag(r *http.Request, id int64, userID string) (*Tag, error) {
+	return scanTag(a.DB.QueryRowContext(r.Context(),
+		`SELECT `+tagColumns+` FROM tags WHERE id = ? AND user_id = ?`, id, userID).Scan)
+}
+
+// HandleListTags lists the user's tags with the number of plushies carrying each
+func (a *App) HandleListTags(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(),
+		`SELECT `+tagColumns+` FROM tags WHERE user_id = ? ORDER BY name COLLATE NOCASE`, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListTags)
+		return
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		t, err := scanTag(rows.Scan)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		tags = append(tags, *t)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	respondJSON(w, http.StatusOK, tags)
+}
+
+type tagRequest struct {
+	Name string `json:"name"`
+}
+
+// HandleCreateTag creates a tag that isn't attached to any plushie yet
+func (a *App) HandleCreateTag(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	var req tagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	name, msg := normalizeTagName(req.Name)
+	if msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := a.ensureUserExistsFromRequest(r, userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToSaveTag)
+		return
+	}
+	res, err := a.DB.ExecContext(r.Context(),
+		`INSERT INTO tags (user_id, name, created_at) VALUES (?, ?, ?)`, userID, name, time.Now().UTC())
+	if err != nil {
+		if isUniqueConstraintError(err) {
+			respondError(w, http.StatusConflict, ErrTagAlreadyExists)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveTag)
+		}
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	t, err := a.getTag(r, id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	respondJSON(w, http.StatusCreated, t)
+}
+
+// HandleRenameTag renames a tag on every plushie that carries it
+func (a *App) HandleRenameTag(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parseURLInt64(r, "tagID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req tagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	name, msg := normalizeTagName(req.Name)
+	if msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	res, err := a.DB.ExecContext(r.Context(),
+		`UPDATE tags SET name = ? WHERE id = ? AND user_id = ?`, name, id, userID)
+	if err != nil {
+		if isUniqueConstraintError(err) {
+			respondError(w, http.StatusConflict, ErrTagAlreadyExists)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveTag)
+		}
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrTagNotFound)
+		return
+	}
+
+	t, err := a.getTag(r, id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	respondJSON(w, http.StatusOK, t)
+}
+
+// HandleDeleteTag deletes a tag and removes it from all plushies
+func (a *App) HandleDeleteTag(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parseURLInt64(r, "tagID")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res, err := a.DB.ExecContext(r.Context(), `DELETE FROM tags WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeleteTag)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrTagNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSetPlushieTags replaces the tags of a plushie (PUT /api/plushies/{id}/tags).
+// The body is {"tags": ["name", ...]}; tags that don't exist yet are created.
+func (a *App) HandleSetPlushieTags(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	// Names differing only in case are the same tag
+	var names []string
+	seen := map[string]bool{}
+	for _, n := range req.Tags {
+		name, msg := normalizeTagName(n)
+		if msg != "" {
+			respondError(w, http.StatusBadRequest, msg)
+			return
+		}
+		if key := strings.ToLower(name); !seen[key] {
+			seen[key] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) > MaxTagsPerPlushie {
+		respondError(w, http.StatusBadRequest, ErrTooManyTags)
+		return
+	}
+
+	if !a.plushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	tags, err := a.setPlushieTags(r, id, userID, names)
+	if err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			respondError(w, http.StatusPreconditionFailed, ErrPlushieModified)
+		} else {
+			respondError(w, http.StatusInternalServerError, ErrFailedToSaveTag)
+		}
+		return
+	}
+	a.setPlushieETag(w, id)
+	respondJSON(w, http.StatusOK, map[string]any{"tags": tags})
+}
+
+// setPlushieTags replaces a plushie's tags, creating missing ones, and returns
+// the stored names sorted like plushieTagsExpr
+func (a *App) setPlushieTags(r *http.Request, plushieID int64, userID string, names []string) ([]string, error) {
+	tx, err := a.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := checkPlushieIfMatch(tx, r, plushieID); err != nil {
+		return nil, err
+	}
+	// Other members' tags on a shared plushie are left alone
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`DELETE FROM plushie_tags WHERE plushie_id = ? AND tag_id IN (SELECT id FROM tags WHERE user_id = ?)`,
+		plushieID, userID); err != nil {
+		return nil, err
+	}
+	stored, err := addPlushieTags(tx, plushieID, userID, names, now)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE plushies SET updated_at = ? WHERE id = ?`, now, plushieID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(stored, func(i, j int) bool { return strings.ToLower(stored[i]) < strings.ToLower(stored[j]) })
+	return stored, nil
+}
+
+// addPlushieTags attaches tags to a plushie that has none of them yet,
+// creating missing ones, and returns the stored names
+func addPlushieTags(tx *sql.Tx, plushieID int64, userID string, names []string, now time.Time) ([]string, error) {
+	stored := []string{}
+	for _, name := range names {
+		if _, err := tx.Exec(`INSERT INTO tags (user_id, name, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+			userID, name, now); err != nil {
+			return nil, err
+		}
+		// An existing tag keeps its spelling
+		var tagID int64
+		var storedName string
+		err := tx.QueryRow(`SELECT id, name FROM tags WHERE user_id = ? AND name = ? COLLATE NOCASE`,
+			userID, name).Scan(&tagID, &storedName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO plushie_tags (plushie_id, tag_id) VALUES (?, ?)`, plushieID, tagID); err != nil {
+			return nil, err
+		}
+		stored = append(stored, storedName)
+	}
+	return stored, nil
+}
+
+// parsePlushieTags decodes the JSON array selected by plushieTagsExpr
+func parsePlushieTags(s sql.NullString) ([]string, error) {
+	tags := []string{}
+	if !s.Valid {
+		return tags, nil
+	}
+	if err := json.Unmarshal([]byte(s.String), &tags); err != nil {
+		return nil, errors.New(ErrDataReadFailed)
+	}
+	return tags, nil
+}
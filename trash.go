@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Trash settings
+const (
+	DefaultTrashRetention = 30 * 24 * time.Hour
+	TrashPurgeInterval    = time.Hour
+)
+
+// TrashedPlushie is a deleted plushie waiting in the trash
+type TrashedPlushie struct {
+	Plushie
+	DeletedAt time.Time  `json:"deleted_at"`
+	PurgeAt   *time.Time `json:"purge_at"` // null if the trash is never emptied automatically
+}
+
+// HandleListTrash lists the deleted plushies of the user's households, most
+// recently deleted first
+func (a *App) HandleListTrash(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	columns := strings.Replace(plushieColumns, conversationHistoryExpr, "NULL", 1)
+	rows, err := a.DB.QueryContext(r.Context(), `
+		SELECT `+columns+`, deleted_at
+		FROM plushies
+		WHERE `+householdAccess("household_id", permView)+` AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id DESC
+	`, userID, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToListTrash)
+		return
+	}
+	defer rows.Close()
+
+	items := []TrashedPlushie{}
+	for rows.Next() {
+		var t TrashedPlushie
+		p, err := a.scanPlushieFromRow(func(dest ...any) error {
+			return rows.Scan(append(dest, &t.DeletedAt)...)
+		})
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+			return
+		}
+		t.Plushie = *p
+		if a.Config.TrashRetention > 0 {
+			purgeAt := t.DeletedAt.Add(a.Config.TrashRetention)
+			t.PurgeAt = &purgeAt
+		}
+		items = append(items, t)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrDataReadFailed)
+		return
+	}
+	respondJSON(w, http.StatusOK, items)
+}
+
+// trashedPlushieAccessOrError is plushieAccessOrError for plushies in the trash
+func (a *App) trashedPlushieAccessOrError(w http.ResponseWriter, plushieID int64, userID string, perm permission) bool {
+	err := a.checkPlushieAccess(plushieID, userID, perm, true)
+	if err != nil && err.Error() == ErrPlushieNotFound {
+		respondError(w, http.StatusNotFound, ErrPlushieNotInTrash)
+		return false
+	}
+	return respondAccessError(w, err)
+}
+
+// HandleRestorePlushie moves a plushie out of the trash. Editors may restore.
+func (a *App) HandleRestorePlushie(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.trashedPlushieAccessOrError(w, id, userID, permEdit) {
+		return
+	}
+
+	res, err := a.DB.ExecContext(r.Context(), `
+		UPDATE plushies SET deleted_at = NULL, updated_at = ?
+		WHERE id = ? AND deleted_at IS NOT NULL AND `+householdAccess("household_id", permEdit),
+		time.Now().UTC(), id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToRestorePlushie)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrPlushieNotInTrash)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePurgePlushie permanently deletes a plushie in the trash with its
+// conversation and photos. Only owners of its household may.
+func (a *App) HandlePurgePlushie(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	id, err := parsePlushieID(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.trashedPlushieAccessOrError(w, id, userID, permManage) {
+		return
+	}
+
+	res, err := a.DB.ExecContext(r.Context(),
+		`DELETE FROM plushies WHERE id = ? AND deleted_at IS NOT NULL AND `+householdAccess("household_id", permManage), id, userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePlushie)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		respondError(w, http.StatusNotFound, ErrPlushieNotInTrash)
+		return
+	}
+	// The plushie's images were queued for deletion by triggers
+	a.cleanupImagesAsync()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEmptyTrash permanently deletes every plushie in the trash of the
+// households the user owns
+func (a *App) HandleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromRequest(r)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, ErrAuthRequired)
+		return
+	}
+
+	if _, err := a.DB.ExecContext(r.Context(),
+		`DELETE FROM plushies WHERE deleted_at IS NOT NULL AND `+householdAccess("household_id", permManage), userID); err != nil {
+		respondError(w, http.StatusInternalServerError, ErrFailedToDeletePlushie)
+		return
+	}
+	a.cleanupImagesAsync()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeTrash permanently deletes plushies that have been in the trash for
+// longer than the retention period, then removes their images
+func (a *App) PurgeTrash(ctx context.Context) (int64, error) {
+	cutoff := time.Now().UTC().Add(-a.Config.TrashRetention)
+	res, err := a.DB.ExecContext(ctx,
+		`DELETE FROM plushies WHERE deleted_at IS NOT NULL AND deleted_at <= ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		if err := a.drainBlobDeletions(ctx); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// RunTrashPurger empties expired trash every interval until ctx is cancelled.
+// It does nothing if the retention period is 0.
+func (a *App) RunTrashPurger(ctx context.Context, interval time.Duration) {
+	if a.Config.TrashRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := a.PurgeTrash(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: trash purge failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d plushie(s) from the trash", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}